@@ -1,220 +1,131 @@
 package bestof
 
 import (
-	"fmt"
 	"net/http"
 	"net/url"
 	"reflect"
-	"sync"
+	"time"
 
+	"github.com/jangie/goloadbalancers/forward"
 	"github.com/jangie/goloadbalancers/util"
 )
 
 //ChoiceOfBalancer is a bookkeeping struct
 type ChoiceOfBalancer struct {
-	balancees       map[*url.URL]int
-	highWatermark   map[url.URL]int
-	requestCounter  map[url.URL]int
-	isTesting       bool
-	randomGenerator util.RandomInt
-	next            http.Handler
-	choices         int
-	keys            []*url.URL
-	lock            *sync.Mutex
+	*util.Balancer
+	picker *ChoiceOfPicker
 }
 
 type ChoiceOfBalancerOptions struct {
 	RandomGenerator util.RandomInt
 	Choices         int
-	IsTesting       bool
+	//IsTesting keeps per-balancee request counts and high watermarks, for RequestCount and HighWatermark in tests
+	IsTesting bool
+	//MaxInFlight is the most outstanding requests any one balancee may have. Zero means no limit.
+	MaxInFlight int
+	//Limiter, when set, learns each balancee's in-flight limit from request latency instead of using MaxInFlight
+	Limiter util.LimiterFactory
+	//Queue configures waiting for a slot when every balancee is at its in-flight limit
+	Queue util.QueueOptions
+	//Rewrite builds the URL each request is forwarded to. Defaults to util.JoinURL.
+	Rewrite util.URLRewriter
+	//ConnectionWeight is how much each long-lived connection, such as a WebSocket, counts towards a balancee's load,
+	//compared to an outstanding request. Zero or less defaults to 1, counting a connection as one more request.
+	ConnectionWeight float64
+	//IgnoreConnections leaves long-lived connections out of load altogether, whatever ConnectionWeight says
+	IgnoreConnections bool
+	//Ejection configures taking balancees which keep failing out of rotation for a while
+	Ejection util.EjectionOptions
+	//StreamAfter is how long a gRPC call may stay in flight before it is counted as a long-lived connection, as its
+	//stream may stay open for hours, rather than as an outstanding request. Defaults to 5s. A negative value means calls
+	//are never counted as connections. Other requests are always counted as outstanding requests.
+	StreamAfter time.Duration
 }
 
-func (b *ChoiceOfBalancer) nextServer() (*url.URL, error) {
-	b.lock.Lock()
-	defer b.lock.Unlock()
-	//Special case: If balancees are nil or empty, return an error.
-	if b.balancees == nil || len(b.balancees) == 0 {
-		return nil, fmt.Errorf("Number of balancees is zero, cannot handle")
-	}
-	//Special case: If balancees is 1, there is no need to balance
-	if len(b.balancees) == 1 {
-		for key := range b.balancees {
-			return key, nil
-		}
-	}
-	var normalizedChoices = b.choices
+//ChoiceOfPicker randomly chooses a number of balancees, and of those picks the one with the lowest load
+type ChoiceOfPicker struct {
+	//RandomGenerator defaults to util.GoRandom when nil
+	RandomGenerator util.RandomInt
+	//Choices defaults to 2 when <= 1
+	Choices int
+}
+
+func (p *ChoiceOfPicker) Pick(balancees []util.Balancee, req *http.Request) (*url.URL, error) {
+	var normalizedChoices = p.Choices
 	//Special case: If choices is <= 1, default to 2. 1 choice is effectively a random LB.
 	if normalizedChoices <= 1 {
 		normalizedChoices = 2
 	}
 	//Special case: If choices > number of balancees, default to number of backends
-	if normalizedChoices > len(b.balancees) {
-		normalizedChoices = len(b.balancees)
+	if normalizedChoices > len(balancees) {
+		normalizedChoices = len(balancees)
 	}
-	var potentialChoices = make([]*url.URL, normalizedChoices)
-	var keysCopy = make([]*url.URL, len(b.keys))
-	copy(keysCopy, b.keys)
+	var potentialChoices = balancees
 
-	if normalizedChoices == len(b.balancees) {
-		potentialChoices = keysCopy
-	} else {
-		//shuffle keys, we'll choose the first N from the shuffled result
-		for i := range keysCopy {
+	if normalizedChoices < len(balancees) {
+		var randomGenerator = p.RandomGenerator
+		if randomGenerator == nil {
+			randomGenerator = &util.GoRandom{}
+		}
+		//shuffle a copy of the balancees, we'll choose the first N from the shuffled result
+		potentialChoices = make([]util.Balancee, len(balancees))
+		copy(potentialChoices, balancees)
+		for i := range potentialChoices {
 			var j int
-			j, _ = b.randomGenerator.NextInt(0, i+1)
-			keysCopy[i], keysCopy[j] = keysCopy[j], keysCopy[i]
+			j, _ = randomGenerator.NextInt(0, i+1)
+			potentialChoices[i], potentialChoices[j] = potentialChoices[j], potentialChoices[i]
 		}
-		potentialChoices = keysCopy
 	}
 
-	var bestChoice *url.URL
-	var leastConns = -1
-	for index, key := range potentialChoices {
-		if index > normalizedChoices {
-			break
-		}
-		if leastConns == -1 {
-			leastConns = b.balancees[key]
-			bestChoice = key
-			continue
-		}
-		if leastConns > b.balancees[key] {
-			leastConns = b.balancees[key]
-			bestChoice = key
+	var bestChoice = potentialChoices[0]
+	for _, balancee := range potentialChoices[1:normalizedChoices] {
+		if bestChoice.Load() > balancee.Load() {
+			bestChoice = balancee
 		}
 	}
-	return bestChoice, nil
+	return bestChoice.URL, nil
 }
 
-//NewChoiceOfBalancer gives a new ChoiceOfBalancer back
+//NewChoiceOfBalancer gives a new ChoiceOfBalancer back. Without a next handler, requests are forwarded to the chosen balancee by
+//a forward.Forwarder with default options.
 func NewChoiceOfBalancer(balancees []url.URL, options ChoiceOfBalancerOptions, next http.Handler) *ChoiceOfBalancer {
-	var b = ChoiceOfBalancer{
-		lock: &sync.Mutex{},
-	}
-	b.balancees = make(map[*url.URL]int)
-	if options.IsTesting {
-		b.requestCounter = make(map[url.URL]int)
-		b.highWatermark = make(map[url.URL]int)
+	if next == nil {
+		next = forward.New(forward.Options{})
 	}
-	for index := range balancees {
-		b.keys = append(b.keys, &balancees[index])
-		b.balancees[&balancees[index]] = 0
+	var picker = &ChoiceOfPicker{
+		RandomGenerator: options.RandomGenerator,
+		Choices:         options.Choices,
 	}
-
-	if options.RandomGenerator == nil {
-		b.randomGenerator = &util.GoRandom{}
-	} else {
-		b.randomGenerator = options.RandomGenerator
+	if picker.RandomGenerator == nil {
+		picker.RandomGenerator = &util.GoRandom{}
 	}
 	//Zero choices makes for an impossible decision, one choice is effectively a random LB
-	if options.Choices <= 1 {
-		b.choices = 2
-	} else {
-		b.choices = options.Choices
-	}
-	b.next = next
-	return &b
-}
-
-func (b *ChoiceOfBalancer) acquire(u *url.URL) {
-	b.lock.Lock()
-	defer b.lock.Unlock()
-	b.balancees[u]++
-	if b.isTesting {
-		if b.balancees[u] > b.highWatermark[*u] {
-			b.highWatermark[*u] = b.balancees[u]
-		}
-		b.requestCounter[*u]++
+	if picker.Choices <= 1 {
+		picker.Choices = 2
+	}
+	return &ChoiceOfBalancer{
+		Balancer: util.NewBalancer(balancees, picker, util.BalancerOptions{
+			Name:              "bestofnlb",
+			IsTesting:         options.IsTesting,
+			MaxInFlight:       options.MaxInFlight,
+			Limiter:           options.Limiter,
+			Queue:             options.Queue,
+			Rewrite:           options.Rewrite,
+			ConnectionWeight:  options.ConnectionWeight,
+			IgnoreConnections: options.IgnoreConnections,
+			Ejection:          options.Ejection,
+			StreamAfter:       options.StreamAfter,
+		}, next),
+		picker: picker,
 	}
 }
 
-func (b *ChoiceOfBalancer) release(u *url.URL) {
-	b.lock.Lock()
-	defer b.lock.Unlock()
-	b.balancees[u]--
-}
-
-//NumberOfBalancees returns the number of balancees that this balancer knows about
-func (b *ChoiceOfBalancer) NumberOfBalancees() int {
-	return len(b.keys)
-}
-
-//OutstandingRequests returns the number of outstanding requests for a particular balancee
-func (b *ChoiceOfBalancer) OutstandingRequests(u *url.URL) int {
-	return b.balancees[u]
-}
-
-//HighWatermark returns the most outstanding requests for a particular balancee
-func (b *ChoiceOfBalancer) HighWatermark(u *url.URL) int {
-	return b.highWatermark[*u]
-}
-
-//RequestCount gives back the number of requests that have come into a particular URL
-func (b *ChoiceOfBalancer) RequestCount(u *url.URL) int {
-	return b.requestCounter[*u]
-}
-
 //ConfiguredChoices returns the configured number of choices to randomly choose and then pick the best of
 func (b *ChoiceOfBalancer) ConfiguredChoices() int {
-	return b.choices
+	return b.picker.Choices
 }
 
 //ConfiguredRandomInt returns the string representation of the random generator assigned to the balancee. Used for testing.
 func (b *ChoiceOfBalancer) ConfiguredRandomInt() string {
-	return reflect.TypeOf(b.randomGenerator).String()
-}
-
-func (b *ChoiceOfBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if w == nil || req == nil {
-		return
-	}
-	if len(b.keys) == 0 {
-		http.Error(w, "bestofnlb has no balancees. no backend server available to fulfill this request.", http.StatusBadGateway)
-		return
-		//return 502
-	}
-	var next, _ = b.nextServer()
-	newReq := *req
-	newReq.URL = next
-	b.acquire(next)
-	if b.next != nil {
-		b.next.ServeHTTP(w, &newReq)
-	} else {
-		fmt.Fprint(w, "bestofnlb does not have a next middleware and is unable to forward to the balancee.")
-	}
-	b.release(next)
-}
-
-//Add a url to the loadbalancer
-func (b *ChoiceOfBalancer) Add(u *url.URL) error {
-	b.lock.Lock()
-	defer b.lock.Unlock()
-	for _, key := range b.keys {
-		if *key == *u {
-			//Looks like we already have this url.
-			return nil
-		}
-	}
-	b.keys = append(b.keys, u)
-	b.balancees[u] = 0
-	return nil
-}
-
-//Remove a url from the loadbalancer.
-func (b *ChoiceOfBalancer) Remove(u *url.URL) error {
-	b.lock.Lock()
-	defer b.lock.Unlock()
-	newkeys := b.keys[:0]
-	for _, x := range b.keys {
-		if *x == *u {
-			newkeys = append(newkeys, x)
-		}
-	}
-	b.keys = newkeys
-	for key := range b.balancees {
-		if *key == *u {
-			delete(b.balancees, key)
-		}
-	}
-	return nil
+	return reflect.TypeOf(b.picker.RandomGenerator).String()
 }
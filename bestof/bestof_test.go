@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/jangie/goloadbalancers/lbtest"
 	"github.com/jangie/goloadbalancers/util"
 )
 
@@ -34,6 +35,12 @@ func (t *testHTTPResponseWriter) Write(b []byte) (int, error) {
 	return 0, nil
 }
 
+func (t *testHTTPResponseWriter) written() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.timesWritten
+}
+
 func (t *testHTTPResponseWriter) WriteHeader(int) {
 
 }
@@ -60,9 +67,9 @@ type testRequestThrottler struct {
 }
 
 func (t *testRequestThrottler) tryAcquireRequest() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	if t.outstandingRequests < t.maximumSimultaneousRequests {
-		t.lock.Lock()
-		defer t.lock.Unlock()
 		t.outstandingRequests++
 		return true
 	}
@@ -103,7 +110,7 @@ func TestBestOfWithOneBalanceeNeverRandomlyChooses(t *testing.T) {
 	var handler = NewChoiceOfBalancer([]url.URL{*urlA}, ChoiceOfBalancerOptions{
 		RandomGenerator: randomGenerator,
 		IsTesting:       true,
-	}, nil)
+	}, &testHTTPHandler{})
 	handler.ServeHTTP(&testHTTPResponseWriter{lock: &sync.Mutex{}}, &http.Request{})
 	if randomGenerator.CallCount > 0 {
 		t.Fatalf("Random generator shouldn't be called! The degenerate case of one balancee means that it should be returned.")
@@ -118,7 +125,7 @@ func TestBestOfWithThreeBalanceesAndTwoChoicesRandomlyChooses(t *testing.T) {
 		RandomGenerator: randomGenerator,
 		Choices:         2,
 		IsTesting:       true,
-	}, nil)
+	}, &testHTTPHandler{})
 
 	handler.ServeHTTP(&testHTTPResponseWriter{lock: &sync.Mutex{}}, &http.Request{})
 	if randomGenerator.CallCount == 0 {
@@ -134,7 +141,7 @@ func TestBestOfWithThreeBalanceesAndThreeChoicesDoesNotRandomlyChoose(t *testing
 		RandomGenerator: randomGenerator,
 		Choices:         3,
 		IsTesting:       true,
-	}, nil)
+	}, &testHTTPHandler{})
 	handler.ServeHTTP(&testHTTPResponseWriter{lock: &sync.Mutex{}}, &http.Request{})
 	if randomGenerator.CallCount > 0 {
 		t.Fatalf("Random generator shouldn't be called! The degenerate case of #balancees == choices means that we should use JSQ.")
@@ -165,7 +172,7 @@ func TestPerformsJSQWhenBalanceesEqualNumberOfChoices(t *testing.T) {
 	var allWritten = false
 	for allWritten != true {
 		time.Sleep(100)
-		if writer.timesWritten == numberOfWrites {
+		if writer.written() == numberOfWrites {
 			allWritten = true
 		}
 	}
@@ -199,7 +206,7 @@ func TestPerformsChooseJSQWhenBalanceesGreaterThanNumberOfChoices(t *testing.T)
 	var allWritten = false
 	for allWritten != true {
 		time.Sleep(100)
-		if writer.timesWritten == numberOfWrites {
+		if writer.written() == numberOfWrites {
 			allWritten = true
 		}
 	}
@@ -213,3 +220,23 @@ func TestPerformsChooseJSQWhenBalanceesGreaterThanNumberOfChoices(t *testing.T)
 		t.Fatalf("We are not shuffling the keys, this means we are not following power of choice")
 	}
 }
+
+func TestChoiceOfConformance(t *testing.T) {
+	lbtest.Run(t, func(balancees []url.URL, next http.Handler) util.LoadBalancer {
+		return NewChoiceOfBalancer(balancees, ChoiceOfBalancerOptions{}, next)
+	})
+}
+
+func BenchmarkChoiceOfPick4(b *testing.B) {
+	lbtest.BenchmarkPicker(b, &ChoiceOfPicker{RandomGenerator: util.NewShardedRandom(1, 0), Choices: 2}, 4)
+}
+
+func BenchmarkChoiceOfPick64(b *testing.B) {
+	lbtest.BenchmarkPicker(b, &ChoiceOfPicker{RandomGenerator: util.NewShardedRandom(1, 0), Choices: 2}, 64)
+}
+
+func BenchmarkChoiceOfParallelServeHTTP(b *testing.B) {
+	lbtest.BenchmarkParallelServeHTTP(b, func(balancees []url.URL, next http.Handler) util.LoadBalancer {
+		return NewChoiceOfBalancer(balancees, ChoiceOfBalancerOptions{RandomGenerator: util.NewShardedRandom(1, 0)}, next)
+	}, 4)
+}
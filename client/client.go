@@ -0,0 +1,258 @@
+//Package client balances the requests a service makes itself, with an http.Client, rather than those it proxies. A
+//RoundTripper picks a host for each outgoing request with a util.Picker, so the same algorithms balance calls as
+//balance proxied requests.
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/jangie/goloadbalancers/jsq"
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//RoundTripperOptions holds the optional configuration for a RoundTripper
+type RoundTripperOptions struct {
+	//Picker chooses the host for each request. Defaults to jsq.JoinShortestQueuePicker. random.RandomPicker and
+	//bestof.ChoiceOfPicker work just as well.
+	Picker util.Picker
+	//Transport sends the requests once their host is chosen. Defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+	//Attempts is how many different hosts a request is tried on before giving up. Defaults to 3. Only requests
+	//which were never sent, or which are safe to send again, are retried, and only if their body can be rewound.
+	Attempts int
+	//MaxInFlight is the most outstanding requests any one host may have. Zero means no limit.
+	MaxInFlight int
+	//Queue configures waiting for a slot when every host is at its in-flight limit
+	Queue util.QueueOptions
+	//Rewrite builds the URL each request is sent to. Defaults to util.JoinURL.
+	Rewrite util.URLRewriter
+}
+
+//RoundTripper is an http.RoundTripper which sends each request to one of its hosts, whatever host the request was
+//made for. A request stays in flight against its host until its response body is closed.
+type RoundTripper struct {
+	pool    *util.Pool
+	picker  util.Picker
+	options RoundTripperOptions
+}
+
+//NewRoundTripper gives a new RoundTripper back
+func NewRoundTripper(balancees []url.URL, options RoundTripperOptions) *RoundTripper {
+	var r = RoundTripper{
+		pool: util.NewPool(balancees, util.PoolOptions{
+			MaxInFlight: options.MaxInFlight,
+			Queue:       options.Queue,
+		}),
+		picker:  options.Picker,
+		options: options,
+	}
+	if r.picker == nil {
+		r.picker = jsq.JoinShortestQueuePicker{}
+	}
+	if r.options.Transport == nil {
+		r.options.Transport = http.DefaultTransport
+	}
+	if r.options.Attempts <= 0 {
+		r.options.Attempts = 3
+	}
+	if r.options.Rewrite == nil {
+		r.options.Rewrite = util.JoinURL
+	}
+	return &r
+}
+
+//RoundTrip sends req to a host chosen by the picker, trying other hosts when it can't be reached or is overloaded
+func (r *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	var tried = make(map[url.URL]bool)
+	var picker = util.PickerFunc(func(balancees []util.Balancee, req *http.Request) (*url.URL, error) {
+		var untried []util.Balancee
+		for _, balancee := range balancees {
+			if !tried[*balancee.URL] {
+				untried = append(untried, balancee)
+			}
+		}
+		if len(untried) == 0 {
+			return nil, fmt.Errorf("every host has already been tried")
+		}
+		return r.picker.Pick(untried, req)
+	})
+	//held is an overloaded host's response, given back if no other host does better. It is still in flight.
+	var held *http.Response
+	var heldURL *url.URL
+	var lastErr error
+	for attempt := 0; attempt < r.options.Attempts; attempt++ {
+		if attempt > 0 && !rewindable(req) {
+			break
+		}
+		var u, err = r.pool.Acquire(picker, req)
+		if err != nil {
+			if attempt == 0 {
+				closeBody(req)
+				return nil, err
+			}
+			break
+		}
+		if tried[*u] {
+			//The only host left to choose from has already been tried
+			r.pool.Release(u)
+			break
+		}
+		tried[*u] = true
+		var outReq, bodyErr = r.outgoingRequest(req, u, attempt)
+		if bodyErr != nil {
+			r.pool.Release(u)
+			lastErr = bodyErr
+			break
+		}
+		var resp, rtErr = r.options.Transport.RoundTrip(outReq)
+		if rtErr != nil {
+			var kind = util.Classify(rtErr)
+			//A caller giving up says nothing about the host
+			if req.Context().Err() == nil {
+				r.pool.RecordError(u, kind)
+			}
+			r.pool.Release(u)
+			lastErr = rtErr
+			if req.Context().Err() != nil || (kind != util.DialError && !idempotent(req)) {
+				break
+			}
+			continue
+		}
+		if held != nil {
+			held.Body.Close()
+			r.pool.Release(heldURL)
+			held = nil
+		}
+		if attempt+1 < r.options.Attempts && overloaded(resp.StatusCode) && idempotent(req) {
+			held, heldURL = resp, u
+			continue
+		}
+		return r.track(resp, u), nil
+	}
+	if held != nil {
+		return r.track(held, heldURL), nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no host available")
+	}
+	return nil, lastErr
+}
+
+//outgoingRequest gives back the request to send to u, with its body rewound for every attempt after the first
+func (r *RoundTripper) outgoingRequest(req *http.Request, u *url.URL, attempt int) (*http.Request, error) {
+	var outReq = req.Clone(req.Context())
+	outReq.URL = r.options.Rewrite(u, req)
+	if req.Host == req.URL.Host {
+		//The host the request was made for names the service, not any one of its hosts
+		outReq.Host = ""
+	}
+	if attempt > 0 && req.GetBody != nil {
+		var body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		outReq.Body = body
+	}
+	return outReq, nil
+}
+
+//track keeps resp in flight against u until its body is closed. The body of a 101 Switching Protocols response can
+//still be written to, as net/http gives it.
+func (r *RoundTripper) track(resp *http.Response, u *url.URL) *http.Response {
+	var body = &trackedBody{ReadCloser: resp.Body, release: func() {
+		r.pool.Release(u)
+	}}
+	if writer, ok := resp.Body.(io.ReadWriteCloser); ok {
+		resp.Body = &trackedReadWriteBody{trackedBody: body, Writer: writer}
+	} else {
+		resp.Body = body
+	}
+	return resp
+}
+
+//trackedBody releases its host the first time it is closed
+type trackedBody struct {
+	io.ReadCloser
+	release func()
+	once    sync.Once
+}
+
+func (b *trackedBody) Close() error {
+	var err = b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+//trackedReadWriteBody is a trackedBody which can be written to, for connections which have switched protocols
+type trackedReadWriteBody struct {
+	*trackedBody
+	io.Writer
+}
+
+//rewindable reports whether req can be sent again
+func rewindable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+//idempotent reports whether sending req twice is as safe as sending it once, following net/http's rules
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	if _, ok := req.Header["Idempotency-Key"]; ok {
+		return true
+	}
+	_, ok := req.Header["X-Idempotency-Key"]
+	return ok
+}
+
+//overloaded reports whether a status says the host could not handle the request, rather than that it was bad
+func overloaded(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+func closeBody(req *http.Request) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+}
+
+//Add a host to the round tripper
+func (r *RoundTripper) Add(u *url.URL) error {
+	return r.pool.Add(u)
+}
+
+//Remove a host from the round tripper. Requests already in flight to it are left to finish.
+func (r *RoundTripper) Remove(u *url.URL) error {
+	return r.pool.Remove(u)
+}
+
+//SetHealthy marks a host as healthy or unhealthy. Unhealthy hosts are sent no new requests.
+func (r *RoundTripper) SetHealthy(u *url.URL, healthy bool) error {
+	return r.pool.SetHealthy(u, healthy)
+}
+
+//Pool gives back the pool of hosts behind this round tripper
+func (r *RoundTripper) Pool() *util.Pool {
+	return r.pool
+}
+
+//NumberOfBalancees returns the number of hosts that this round tripper knows about
+func (r *RoundTripper) NumberOfBalancees() int {
+	return r.pool.NumberOfBalancees()
+}
+
+//OutstandingRequests returns the number of requests in flight to a particular host, whose bodies are not yet closed
+func (r *RoundTripper) OutstandingRequests(u *url.URL) int {
+	return r.pool.OutstandingRequests(u)
+}
+
+//Errors gives back how many requests to a host failed, by how they failed
+func (r *RoundTripper) Errors(u *url.URL) util.ErrorCounts {
+	return r.pool.Errors(u)
+}
@@ -0,0 +1,159 @@
+package client
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+//echoBackend answers with its name, the host it was asked for, the path and query, and any body it was sent
+func echoBackend(name string, status int) (*httptest.Server, *url.URL) {
+	var backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body, _ = io.ReadAll(req.Body)
+		w.WriteHeader(status)
+		io.WriteString(w, name+" "+req.Host+" "+req.URL.RequestURI()+" "+string(body))
+	}))
+	var u, _ = url.Parse(backend.URL)
+	return backend, u
+}
+
+//closedAddress gives back a host nothing is listening on
+func closedAddress() *url.URL {
+	var listener, _ = net.Listen("tcp", "127.0.0.1:0")
+	var u, _ = url.Parse("http://" + listener.Addr().String())
+	listener.Close()
+	return u
+}
+
+//readAll reads and closes a response's body, or gives back why there wasn't one
+func readAll(resp *http.Response, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	defer resp.Body.Close()
+	var body, _ = io.ReadAll(resp.Body)
+	return string(body)
+}
+
+func TestRoundTripperRewritesAndTracksUntilBodyClosed(t *testing.T) {
+	var a, urlA = echoBackend("a", http.StatusOK)
+	defer a.Close()
+	var b, urlB = echoBackend("b", http.StatusOK)
+	defer b.Close()
+	var transport = NewRoundTripper([]url.URL{*urlA, *urlB}, RoundTripperOptions{})
+	var client = &http.Client{Transport: transport}
+
+	var first, err = client.Get("http://users.internal/api/list?page=2")
+	if err != nil {
+		t.Fatalf("Request failed: %s", err)
+	}
+	if transport.OutstandingRequests(urlA) != 1 {
+		t.Fatalf("Expected the request to stay in flight until its body is closed")
+	}
+	//The shortest queue is now b's, as a's request is still being read
+	var second = readAll(client.Get("http://users.internal/api/list?page=3"))
+	if second != "b "+urlB.Host+" /api/list?page=3 " {
+		t.Fatalf("Expected the second request to go to b, rewritten, got %q", second)
+	}
+	var body = readAll(first, nil)
+	if body != "a "+urlA.Host+" /api/list?page=2 " {
+		t.Fatalf("Expected the first request to go to a, rewritten, got %q", body)
+	}
+	if transport.OutstandingRequests(urlA) != 0 || transport.OutstandingRequests(urlB) != 0 {
+		t.Fatalf("Expected closing the bodies to release their hosts")
+	}
+}
+
+func TestRoundTripperRetriesAnotherHost(t *testing.T) {
+	var down = closedAddress()
+	var busy, urlBusy = echoBackend("busy", http.StatusServiceUnavailable)
+	defer busy.Close()
+	var ok, urlOK = echoBackend("ok", http.StatusOK)
+	defer ok.Close()
+	var transport = NewRoundTripper([]url.URL{*down, *urlBusy, *urlOK}, RoundTripperOptions{})
+	var client = &http.Client{Transport: transport}
+
+	var req, _ = http.NewRequest("PUT", "http://users.internal/user/1", strings.NewReader("name=jo"))
+	var body = readAll(client.Do(req))
+	if body != "ok "+urlOK.Host+" /user/1 name=jo" {
+		t.Fatalf("Expected the request to be retried, body and all, on the host which works, got %q", body)
+	}
+	if transport.Errors(down).Dial != 1 {
+		t.Fatalf("Expected the host which couldn't be reached to be counted, got %+v", transport.Errors(down))
+	}
+	for _, u := range []*url.URL{down, urlBusy, urlOK} {
+		if transport.OutstandingRequests(u) != 0 {
+			t.Fatalf("Expected every attempt to be released, %s has %d", u.Host, transport.OutstandingRequests(u))
+		}
+	}
+}
+
+func TestRoundTripperOnlyRetriesWhatIsSafe(t *testing.T) {
+	var busy, urlBusy = echoBackend("busy", http.StatusServiceUnavailable)
+	defer busy.Close()
+	var ok, urlOK = echoBackend("ok", http.StatusOK)
+	defer ok.Close()
+	var client = &http.Client{Transport: NewRoundTripper([]url.URL{*urlBusy, *urlOK}, RoundTripperOptions{})}
+
+	var resp, err = client.Post("http://users.internal/user", "text/plain", strings.NewReader("name=jo"))
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a POST to be sent only once, got %v", err)
+	}
+	resp.Body.Close()
+
+	//With nowhere else to go, the overloaded host's answer is given back
+	var single = &http.Client{Transport: NewRoundTripper([]url.URL{*urlBusy}, RoundTripperOptions{})}
+	resp, err = single.Get("http://users.internal/user/1")
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected the only host's 503 back, got %v", err)
+	}
+	resp.Body.Close()
+
+	var none = &http.Client{Transport: NewRoundTripper([]url.URL{}, RoundTripperOptions{})}
+	if _, err = none.Get("http://users.internal/"); err == nil {
+		t.Fatalf("Expected an error with no hosts")
+	}
+}
+
+func TestRoundTripperKeepsUpgradedBodiesWritable(t *testing.T) {
+	var backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var conn, rw, _ = w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		var line, _ = rw.ReadString('\n')
+		rw.WriteString(line)
+		rw.Flush()
+	}))
+	defer backend.Close()
+	var u, _ = url.Parse(backend.URL)
+	var transport = NewRoundTripper([]url.URL{*u}, RoundTripperOptions{})
+
+	var req, _ = http.NewRequest("GET", "http://echo.internal/socket", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "echo")
+	var resp, err = (&http.Client{Transport: transport}).Do(req)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected to switch protocols, got %v %v", resp, err)
+	}
+	var conn, ok = resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		t.Fatalf("Expected the upgraded body to be writable, got %T", resp.Body)
+	}
+	io.WriteString(conn, "hello\n")
+	var echoed = make([]byte, len("hello\n"))
+	if _, err := io.ReadFull(conn, echoed); err != nil || string(echoed) != "hello\n" {
+		t.Fatalf("Expected the upgraded connection to echo, got %q %v", echoed, err)
+	}
+	if transport.OutstandingRequests(u) != 1 {
+		t.Fatalf("Expected the upgraded connection to stay in flight until closed")
+	}
+	conn.Close()
+	if transport.OutstandingRequests(u) != 0 {
+		t.Fatalf("Expected closing the upgraded connection to release its host")
+	}
+}
@@ -0,0 +1,81 @@
+//Command lbbench fires load at a balancer fronting in-process fake backends, and reports how it did.
+//
+//	lbbench -algorithm jsq -backends uneven -concurrency 50 -n 1000
+//	lbbench -algorithm all -backends a=exp:20ms,b=exp:60ms -qps 500 -duration 30s -cpuprofile cpu.out
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/jangie/goloadbalancers/loadgen"
+	"github.com/jangie/goloadbalancers/replay"
+)
+
+func main() {
+	var algorithm = flag.String("algorithm", "all", "balancer to test: random, jsq, bestof or all")
+	var backendSpec = flag.String("backends", "uneven", "even, uneven, or a comma separated list of name=latency, latency being 300ms, exp:<mean>, uniform:<min>-<max> or lognormal:<median>:<sigma>")
+	var concurrency = flag.Int("concurrency", 50, "requests to send at once")
+	var qps = flag.Float64("qps", 0, "requests to send a second, 0 for as many as concurrency allows")
+	var requests = flag.Int("n", 1000, "requests to send, 0 for no limit")
+	var duration = flag.Duration("duration", 0, "how long to send requests for, 0 for no limit")
+	var seed = flag.Int64("seed", time.Now().UnixNano(), "seed for backend latencies and balancer choices")
+	var cpuProfile = flag.String("cpuprofile", "", "file to write a CPU profile to, suffixed with the algorithm")
+	var memProfile = flag.String("memprofile", "", "file to write an allocation profile to, suffixed with the algorithm")
+	flag.Parse()
+
+	var backends, err = loadgen.ParseBackends(*backendSpec)
+	if err != nil {
+		fail(err)
+	}
+	var ran = false
+	for _, candidate := range replay.DefaultAlgorithms() {
+		if *algorithm != "all" && *algorithm != candidate.Name {
+			continue
+		}
+		ran = true
+		var config = loadgen.Config{
+			Backends:    backends,
+			NewBalancer: candidate.NewBalancer,
+			Concurrency: *concurrency,
+			QPS:         *qps,
+			Requests:    *requests,
+			Duration:    *duration,
+			Seed:        *seed,
+		}
+		if *cpuProfile != "" {
+			var file = create(*cpuProfile + "." + candidate.Name)
+			defer file.Close()
+			config.CPUProfile = file
+		}
+		if *memProfile != "" {
+			var file = create(*memProfile + "." + candidate.Name)
+			defer file.Close()
+			config.MemProfile = file
+		}
+		var result, runErr = loadgen.Run(config)
+		if runErr != nil {
+			fail(runErr)
+		}
+		fmt.Printf("%s:\n", candidate.Name)
+		result.WriteTo(os.Stdout)
+	}
+	if !ran {
+		fail(fmt.Errorf("Unknown algorithm %s", *algorithm))
+	}
+}
+
+func create(name string) *os.File {
+	var file, err = os.Create(name)
+	if err != nil {
+		fail(err)
+	}
+	return file
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
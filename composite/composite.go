@@ -0,0 +1,204 @@
+package composite
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//CompositeBalancer balances between child balancers rather than urls, for example choosing a zone with JSQ and then
+//a host within it with best-of-2. The picker is handed one balancee per child, whose url is "child://<name>" and whose
+//outstanding requests are the child's total, so any util.Picker can choose between children.
+//
+//A child's load is taken from its Outstanding method when it implements util.LoadReporter, which includes requests
+//that reached it other than through this balancer, and otherwise from the requests this balancer has sent it.
+type CompositeBalancer struct {
+	children     []*child
+	byName       map[string]*child
+	picker       util.Picker
+	defaultChild string
+	view         []util.Balancee
+	lock         *sync.Mutex
+}
+
+type CompositeBalancerOptions struct {
+	//DefaultChild names the child that Add puts new urls into
+	DefaultChild string
+}
+
+type child struct {
+	name        string
+	key         *url.URL
+	balancer    util.LoadBalancer
+	outstanding int
+	requests    int
+}
+
+//NewCompositeBalancer gives a new CompositeBalancer back
+func NewCompositeBalancer(picker util.Picker, options CompositeBalancerOptions) *CompositeBalancer {
+	return &CompositeBalancer{
+		byName:       make(map[string]*child),
+		picker:       picker,
+		defaultChild: options.DefaultChild,
+		lock:         &sync.Mutex{},
+	}
+}
+
+//AddChild adds a named child balancer
+func (c *CompositeBalancer) AddChild(name string, balancer util.LoadBalancer) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.byName[name]; ok {
+		return fmt.Errorf("There is already a child named %q", name)
+	}
+	var ch = &child{
+		name:     name,
+		key:      &url.URL{Scheme: "child", Host: name},
+		balancer: balancer,
+	}
+	c.children = append(c.children, ch)
+	c.byName[name] = ch
+	return nil
+}
+
+//RemoveChild removes a named child balancer. Requests already sent to it are unaffected.
+func (c *CompositeBalancer) RemoveChild(name string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.byName[name]; !ok {
+		return fmt.Errorf("There is no child named %q", name)
+	}
+	delete(c.byName, name)
+	var newchildren = make([]*child, 0, len(c.children))
+	for _, ch := range c.children {
+		if ch.name != name {
+			newchildren = append(newchildren, ch)
+		}
+	}
+	c.children = newchildren
+	return nil
+}
+
+//NumberOfChildren returns the number of child balancers
+func (c *CompositeBalancer) NumberOfChildren() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.children)
+}
+
+//load gives back a child's outstanding requests. The balancer must be locked.
+func (ch *child) load() int {
+	if reporter, ok := ch.balancer.(util.LoadReporter); ok {
+		//Requests which have been dispatched but not yet acquired by the child still count
+		if reported := reporter.Outstanding(); reported > ch.outstanding {
+			return reported
+		}
+	}
+	return ch.outstanding
+}
+
+//ChildOutstanding returns the outstanding requests of a named child, as the picker sees them
+func (c *CompositeBalancer) ChildOutstanding(name string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if ch, ok := c.byName[name]; ok {
+		return ch.load()
+	}
+	return 0
+}
+
+//ChildRequestCount returns the number of requests sent to a named child
+func (c *CompositeBalancer) ChildRequestCount(name string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if ch, ok := c.byName[name]; ok {
+		return ch.requests
+	}
+	return 0
+}
+
+//Outstanding returns the total outstanding requests across every child, so that composites can themselves be
+//children
+func (c *CompositeBalancer) Outstanding() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var total = 0
+	for _, ch := range c.children {
+		total += ch.load()
+	}
+	return total
+}
+
+//acquire picks a child and counts a request against it
+func (c *CompositeBalancer) acquire(req *http.Request) (*child, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.children) == 0 {
+		return nil, util.ErrNoBalancees
+	}
+	var chosen = c.children[0]
+	if len(c.children) > 1 {
+		c.view = c.view[:0]
+		for _, ch := range c.children {
+			c.view = append(c.view, util.Balancee{URL: ch.key, Outstanding: ch.load(), Healthy: true})
+		}
+		var key, err = c.picker.Pick(c.view, req)
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if chosen, ok = c.byName[key.Host]; !ok || key.Scheme != "child" {
+			return nil, fmt.Errorf("Picker chose %s, which is not a child", key)
+		}
+	}
+	chosen.outstanding++
+	chosen.requests++
+	return chosen, nil
+}
+
+func (c *CompositeBalancer) release(ch *child) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch.outstanding--
+}
+
+func (c *CompositeBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if w == nil || req == nil {
+		return
+	}
+	var ch, err = c.acquire(req)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("composite was unable to choose a child: %s", err), http.StatusBadGateway)
+		return
+	}
+	defer c.release(ch)
+	ch.balancer.ServeHTTP(w, req)
+}
+
+//Add a url to the default child
+func (c *CompositeBalancer) Add(u *url.URL) error {
+	c.lock.Lock()
+	var ch, ok = c.byName[c.defaultChild]
+	c.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("There is no default child to add %s to", u)
+	}
+	return ch.balancer.Add(u)
+}
+
+//Remove a url from every child.
+func (c *CompositeBalancer) Remove(u *url.URL) error {
+	c.lock.Lock()
+	var children = make([]*child, len(c.children))
+	copy(children, c.children)
+	c.lock.Unlock()
+	for _, ch := range children {
+		if err := ch.balancer.Remove(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package composite
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/jangie/goloadbalancers/bestof"
+	"github.com/jangie/goloadbalancers/jsq"
+	"github.com/jangie/goloadbalancers/util"
+)
+
+func parse(hosts ...string) []url.URL {
+	var urls []url.URL
+	for _, host := range hosts {
+		var u, _ = url.Parse(host)
+		urls = append(urls, *u)
+	}
+	return urls
+}
+
+type gate struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (g *gate) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	g.started <- struct{}{}
+	<-g.release
+}
+
+func TestCompositeImplements(t *testing.T) {
+	var loadbalancer util.LoadBalancer
+	loadbalancer = NewCompositeBalancer(jsq.JoinShortestQueuePicker{}, CompositeBalancerOptions{})
+	loadbalancer.ServeHTTP(nil, nil)
+	var recorder = httptest.NewRecorder()
+	loadbalancer.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusBadGateway {
+		t.Fatalf("Expected a 502 with no children, got %d", recorder.Code)
+	}
+	var _ util.LoadReporter = &CompositeBalancer{}
+}
+
+func TestCompositeSeesChildLoad(t *testing.T) {
+	var g = &gate{started: make(chan struct{}), release: make(chan struct{})}
+	var east = bestof.NewChoiceOfBalancer(parse("http://e1", "http://e2"), bestof.ChoiceOfBalancerOptions{}, g)
+	var west = bestof.NewChoiceOfBalancer(parse("http://w1", "http://w2"), bestof.ChoiceOfBalancerOptions{}, g)
+	var c = NewCompositeBalancer(jsq.JoinShortestQueuePicker{}, CompositeBalancerOptions{})
+	c.AddChild("east", east)
+	c.AddChild("west", west)
+
+	//Load east up directly, without going through the composite
+	var wg sync.WaitGroup
+	wg.Add(2)
+	var i = 0
+	for ; i < 2; i++ {
+		go func() {
+			defer wg.Done()
+			east.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}()
+		<-g.started
+	}
+	if c.ChildOutstanding("east") != 2 || c.Outstanding() != 2 {
+		t.Fatalf("The composite should see the child's total outstanding requests")
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	<-g.started
+	if c.ChildRequestCount("west") != 1 {
+		t.Fatalf("JSQ across children should pick the less loaded child")
+	}
+	close(g.release)
+	wg.Wait()
+	if c.Outstanding() != 0 {
+		t.Fatalf("Expected no outstanding requests once everything finished, had %d", c.Outstanding())
+	}
+}
+
+func TestCompositesNest(t *testing.T) {
+	var next = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	var inner = NewCompositeBalancer(jsq.JoinShortestQueuePicker{}, CompositeBalancerOptions{DefaultChild: "a"})
+	inner.AddChild("a", jsq.NewJoinShortestQueueBalancer(parse("http://a"), jsq.JoinShortestQueueBalancerOptions{}, next))
+	var outer = NewCompositeBalancer(jsq.JoinShortestQueuePicker{}, CompositeBalancerOptions{DefaultChild: "inner"})
+	outer.AddChild("inner", inner)
+	outer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if inner.ChildRequestCount("a") != 1 {
+		t.Fatalf("Requests should flow down through nested composites")
+	}
+	var u, _ = url.Parse("http://b")
+	if err := outer.Add(u); err != nil {
+		t.Fatalf("Add should flow down to the default child: %s", err)
+	}
+}
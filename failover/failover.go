@@ -0,0 +1,207 @@
+package failover
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/jangie/goloadbalancers/forward"
+	"github.com/jangie/goloadbalancers/jsq"
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//FailoverBalancer groups balancees into priority tiers, 0 being the most preferred. Each tier is given a share of
+//traffic based on how healthy it is: a tier whose healthy share of balancees, multiplied by the overprovisioning
+//factor, reaches 100% takes all traffic not already taken by more preferred tiers. As a tier loses balancees, the
+//traffic it can no longer take shifts gradually to the next tier.
+type FailoverBalancer struct {
+	tiers            map[int]*util.Balancer
+	priorities       []int
+	priorityOf       map[url.URL]int
+	options          FailoverBalancerOptions
+	overprovisioning float64
+	randomGenerator  util.RandomInt
+	next             http.Handler
+	lock             *sync.RWMutex
+}
+
+type FailoverBalancerOptions struct {
+	//Picker chooses between balancees within a tier. Defaults to jsq.JoinShortestQueuePicker.
+	Picker util.Picker
+	//OverprovisioningFactor is how much spare capacity a tier is assumed to have. With the default of 1.4, a tier
+	//keeps all of its traffic until fewer than 1/1.4 (about 71%) of its balancees are healthy.
+	OverprovisioningFactor float64
+	//RandomGenerator decides which tier each request goes to. Defaults to util.GoRandom.
+	RandomGenerator util.RandomInt
+	IsTesting       bool
+	//Rewrite builds the URL each request is forwarded to. Defaults to util.JoinURL.
+	Rewrite util.URLRewriter
+}
+
+//loadResolution is the granularity with which tiers are chosen
+const loadResolution = 10000
+
+//NewFailoverBalancer gives a new FailoverBalancer back, with the given balancees at priority 0
+func NewFailoverBalancer(balancees []url.URL, options FailoverBalancerOptions, next http.Handler) *FailoverBalancer {
+	var b = FailoverBalancer{
+		tiers:            make(map[int]*util.Balancer),
+		priorityOf:       make(map[url.URL]int),
+		options:          options,
+		overprovisioning: options.OverprovisioningFactor,
+		randomGenerator:  options.RandomGenerator,
+		lock:             &sync.RWMutex{},
+	}
+	if b.options.Picker == nil {
+		b.options.Picker = jsq.JoinShortestQueuePicker{}
+	}
+	if b.overprovisioning < 1 {
+		b.overprovisioning = 1.4
+	}
+	if b.randomGenerator == nil {
+		b.randomGenerator = &util.GoRandom{}
+	}
+	if next == nil {
+		//Every tier shares one forwarder, and so its connections
+		next = forward.New(forward.Options{})
+	}
+	b.next = next
+	for index := range balancees {
+		b.AddWithPriority(&balancees[index], 0)
+	}
+	return &b
+}
+
+//AddWithPriority adds a url to the loadbalancer in a priority tier, 0 being the most preferred. A url already in
+//another tier is moved.
+func (b *FailoverBalancer) AddWithPriority(u *url.URL, priority int) error {
+	if priority < 0 {
+		return fmt.Errorf("Priority must not be negative, was %d", priority)
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if current, ok := b.priorityOf[*u]; ok {
+		if current == priority {
+			return nil
+		}
+		b.tiers[current].Remove(u)
+	}
+	var tier, ok = b.tiers[priority]
+	if !ok {
+		tier = util.NewBalancer([]url.URL{}, b.options.Picker, util.BalancerOptions{
+			Name:      fmt.Sprintf("failover tier %d", priority),
+			IsTesting: b.options.IsTesting,
+			Rewrite:   b.options.Rewrite,
+		}, b.next)
+		b.tiers[priority] = tier
+		b.priorities = append(b.priorities, priority)
+		sort.Ints(b.priorities)
+	}
+	b.priorityOf[*u] = priority
+	return tier.Add(u)
+}
+
+//Add a url to the loadbalancer at priority 0
+func (b *FailoverBalancer) Add(u *url.URL) error {
+	return b.AddWithPriority(u, 0)
+}
+
+//Remove a url from the loadbalancer.
+func (b *FailoverBalancer) Remove(u *url.URL) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var priority, ok = b.priorityOf[*u]
+	if !ok {
+		return nil
+	}
+	delete(b.priorityOf, *u)
+	return b.tiers[priority].Remove(u)
+}
+
+//SetHealthy marks a balancee as healthy or unhealthy, shifting traffic between tiers accordingly
+func (b *FailoverBalancer) SetHealthy(u *url.URL, healthy bool) error {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	var priority, ok = b.priorityOf[*u]
+	if !ok {
+		return fmt.Errorf("%s is not a balancee", u)
+	}
+	return b.tiers[priority].SetHealthy(u, healthy)
+}
+
+//Tier gives back the balancer for a priority tier, or nil if nothing has been added at that priority
+func (b *FailoverBalancer) Tier(priority int) *util.Balancer {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.tiers[priority]
+}
+
+//Loads gives back the share of traffic, between 0 and 1, each priority tier currently receives
+func (b *FailoverBalancer) Loads() map[int]float64 {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	var loads = make(map[int]float64)
+	for index, load := range b.loads() {
+		loads[b.priorities[index]] = load
+	}
+	return loads
+}
+
+//loads gives back the share of traffic for each tier, in order of priority. The balancer must be locked.
+func (b *FailoverBalancer) loads() []float64 {
+	var loads = make([]float64, len(b.priorities))
+	var remaining = 1.0
+	for index, priority := range b.priorities {
+		var healthy, total = b.tiers[priority].HealthyCount()
+		if total == 0 {
+			continue
+		}
+		var health = math.Min(1, b.overprovisioning*float64(healthy)/float64(total))
+		loads[index] = math.Min(health, remaining)
+		remaining -= loads[index]
+	}
+	//When the tiers together can't take all of the traffic, share it out in proportion to what each can take
+	var assigned = 1 - remaining
+	if assigned > 0 && assigned < 1 {
+		for index := range loads {
+			loads[index] /= assigned
+		}
+	}
+	return loads
+}
+
+func (b *FailoverBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if w == nil || req == nil {
+		return
+	}
+	var tier = b.chooseTier()
+	if tier == nil {
+		http.Error(w, "failover has no balancees. no backend server available to fulfill this request.", http.StatusBadGateway)
+		return
+	}
+	tier.ServeHTTP(w, req)
+}
+
+//chooseTier gives back the tier a request should go to, or nil if there are no balancees at all
+func (b *FailoverBalancer) chooseTier() *util.Balancer {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	var loads = b.loads()
+	var roll, _ = b.randomGenerator.NextInt(0, loadResolution)
+	var cumulative = 0.0
+	for index, load := range loads {
+		cumulative += load * loadResolution
+		if load > 0 && float64(roll) < cumulative {
+			return b.tiers[b.priorities[index]]
+		}
+	}
+	//Nothing is healthy, so send the request to the most preferred tier that has any balancees at all
+	for _, priority := range b.priorities {
+		if b.tiers[priority].NumberOfBalancees() > 0 {
+			return b.tiers[priority]
+		}
+	}
+	return nil
+}
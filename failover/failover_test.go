@@ -0,0 +1,126 @@
+package failover
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/jangie/goloadbalancers/lbtest"
+	"github.com/jangie/goloadbalancers/util"
+)
+
+func parse(s string) *url.URL {
+	var u, _ = url.Parse(s)
+	return u
+}
+
+var primary = []*url.URL{parse("http://p1"), parse("http://p2"), parse("http://p3"), parse("http://p4"), parse("http://p5")}
+var secondary = []*url.URL{parse("http://s1"), parse("http://s2")}
+
+func newTestFailover(randomGenerator util.RandomInt) *FailoverBalancer {
+	var b = NewFailoverBalancer([]url.URL{}, FailoverBalancerOptions{
+		RandomGenerator: randomGenerator,
+		IsTesting:       true,
+	}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	for _, u := range primary {
+		b.AddWithPriority(u, 0)
+	}
+	for _, u := range secondary {
+		b.AddWithPriority(u, 1)
+	}
+	return b
+}
+
+func closeTo(a float64, b float64) bool {
+	return math.Abs(a-b) < 0.0001
+}
+
+func TestFailoverImplements(t *testing.T) {
+	var loadbalancer util.LoadBalancer
+	loadbalancer = NewFailoverBalancer([]url.URL{}, FailoverBalancerOptions{}, nil)
+	loadbalancer.ServeHTTP(nil, nil)
+	var recorder = httptest.NewRecorder()
+	loadbalancer.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusBadGateway {
+		t.Fatalf("Expected a 502 with no balancees, got %d", recorder.Code)
+	}
+}
+
+func TestFailoverKeepsTrafficOnHealthyPrimary(t *testing.T) {
+	var b = newTestFailover(nil)
+	//4 of 5 healthy, with overprovisioning of 1.4, is still over 100%
+	b.SetHealthy(primary[0], false)
+	var loads = b.Loads()
+	if !closeTo(loads[0], 1) || !closeTo(loads[1], 0) {
+		t.Fatalf("Expected all traffic on the primary tier, got %v", loads)
+	}
+}
+
+func TestFailoverShiftsTrafficGradually(t *testing.T) {
+	var b = newTestFailover(nil)
+	b.SetHealthy(primary[0], false)
+	b.SetHealthy(primary[1], false)
+	b.SetHealthy(primary[2], false)
+	//2 of 5 healthy is 40%, overprovisioned to 56%
+	var loads = b.Loads()
+	if !closeTo(loads[0], 0.56) || !closeTo(loads[1], 0.44) {
+		t.Fatalf("Expected traffic split 56/44, got %v", loads)
+	}
+}
+
+func TestFailoverNormalizesWhenEverythingIsDegraded(t *testing.T) {
+	var b = newTestFailover(nil)
+	for _, u := range primary[:4] {
+		b.SetHealthy(u, false)
+	}
+	b.SetHealthy(secondary[0], false)
+	//primary: 1/5*1.4 = 28%, secondary: 1/2*1.4 = 70%, which together can take 98% of traffic
+	var loads = b.Loads()
+	if !closeTo(loads[0], 0.28/0.98) || !closeTo(loads[1], 0.70/0.98) {
+		t.Fatalf("Expected loads to be normalized, got %v", loads)
+	}
+}
+
+func TestFailoverRoutesToChosenTier(t *testing.T) {
+	var b = newTestFailover(&util.TestingRandom{Values: []int{9999}})
+	for _, u := range primary[:3] {
+		b.SetHealthy(u, false)
+	}
+	b.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	var secondaryRequests = b.Tier(1).RequestCount(secondary[0]) + b.Tier(1).RequestCount(secondary[1])
+	if secondaryRequests != 1 {
+		t.Fatalf("A roll past the primary tier's load should go to the secondary tier")
+	}
+}
+
+func TestFailoverWithNothingHealthyUsesPrimary(t *testing.T) {
+	var b = newTestFailover(nil)
+	for _, u := range append(primary, secondary...) {
+		b.SetHealthy(u, false)
+	}
+	var recorder = httptest.NewRecorder()
+	b.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusBadGateway {
+		t.Fatalf("Expected a 502 when nothing is healthy, got %d", recorder.Code)
+	}
+}
+
+func TestFailoverMovesBalanceesBetweenTiers(t *testing.T) {
+	var b = newTestFailover(nil)
+	b.AddWithPriority(secondary[0], 0)
+	if b.Tier(0).NumberOfBalancees() != 6 || b.Tier(1).NumberOfBalancees() != 1 {
+		t.Fatalf("Re-adding a balancee at another priority should move it")
+	}
+	b.Remove(secondary[0])
+	if b.Tier(0).NumberOfBalancees() != 5 {
+		t.Fatalf("Removing a balancee should drop it from its tier")
+	}
+}
+
+func TestFailoverConformance(t *testing.T) {
+	lbtest.Run(t, func(balancees []url.URL, next http.Handler) util.LoadBalancer {
+		return NewFailoverBalancer(balancees, FailoverBalancerOptions{}, next)
+	})
+}
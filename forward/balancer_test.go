@@ -0,0 +1,217 @@
+package forward
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//pickFirst always picks the first balancee it is offered
+var pickFirst = util.PickerFunc(func(balancees []util.Balancee, req *http.Request) (*url.URL, error) {
+	return balancees[0].URL, nil
+})
+
+func TestBalancerCountsForwardingErrors(t *testing.T) {
+	var backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte("from backend"))
+	}))
+	defer backend.Close()
+	var listener, _ = net.Listen("tcp", "127.0.0.1:0")
+	var closed, _ = url.Parse("http://" + listener.Addr().String())
+	listener.Close()
+	var live, _ = url.Parse(backend.URL)
+
+	var balancer = util.NewBalancer([]url.URL{*live, *closed}, pickFirst, util.BalancerOptions{}, New(Options{}))
+	var recorder = httptest.NewRecorder()
+	balancer.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Body.String() != "from backend" {
+		t.Fatalf("Expected the request to be forwarded to the balancee, got %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	balancer.Remove(live)
+	recorder = httptest.NewRecorder()
+	balancer.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusBadGateway {
+		t.Fatalf("Expected a 502 from a balancee which cannot be dialed, got %d", recorder.Code)
+	}
+	if errors := balancer.Errors(closed); errors.Dial != 1 || errors.Timeout != 0 || errors.Response != 0 {
+		t.Fatalf("Expected one dial error to be counted, got %+v", errors)
+	}
+}
+
+//echoUpgradeServer switches to an echo protocol on request, echoing lines back until the connection closes
+func echoUpgradeServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !util.IsUpgrade(req) {
+			w.Write([]byte("not upgraded"))
+			return
+		}
+		var conn, rw, _ = w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		for {
+			var line, err = rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			rw.WriteString(line)
+			rw.Flush()
+		}
+	}))
+}
+
+//dialUpgrade opens an upgraded connection through the server at address
+func dialUpgrade(t *testing.T, address string) (net.Conn, *bufio.Reader) {
+	var conn, err = net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Unable to dial %s: %s", address, err)
+	}
+	conn.Write([]byte("GET /socket HTTP/1.1\r\nHost: front\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	var reader = bufio.NewReader(conn)
+	var resp, respErr = http.ReadResponse(reader, nil)
+	if respErr != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected to switch protocols, got %v %v", resp, respErr)
+	}
+	return conn, reader
+}
+
+func TestBalancerProxiesUpgradesAndDrains(t *testing.T) {
+	var backend = echoUpgradeServer()
+	defer backend.Close()
+	var u, _ = url.Parse(backend.URL)
+	var balancer = util.NewBalancer([]url.URL{*u}, pickFirst, util.BalancerOptions{MaxInFlight: 1}, New(Options{}))
+	var front = httptest.NewServer(balancer)
+	defer front.Close()
+
+	var conn, reader = dialUpgrade(t, front.Listener.Addr().String())
+	defer conn.Close()
+	conn.Write([]byte("hello\n"))
+	if line, _ := reader.ReadString('\n'); line != "hello\n" {
+		t.Fatalf("Expected the upgraded connection to be proxied, got %q", line)
+	}
+	if balancer.Connections(u) != 1 || balancer.OutstandingRequests(u) != 0 {
+		t.Fatalf("Expected the connection to be counted apart from requests, got %d connections and %d requests", balancer.Connections(u), balancer.OutstandingRequests(u))
+	}
+	//The connection doesn't hold one of the balancee's in-flight slots
+	var resp, err = http.Get(front.URL)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected an ordinary request to get through alongside the connection, got %v %v", resp, err)
+	}
+	resp.Body.Close()
+
+	balancer.Drain(u, 10*time.Millisecond)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Fatalf("Expected the connection to be closed once its balancee was drained")
+	}
+	if balancer.NumberOfBalancees() != 0 {
+		t.Fatalf("Expected a drained balancee to be removed")
+	}
+}
+
+func TestBalancerSpreadsGRPCStreams(t *testing.T) {
+	var finish = make(chan struct{})
+	var started = make(chan string, 3)
+	var balancees []url.URL
+	for i := 0; i < 3; i++ {
+		var status = "0"
+		if i == 0 {
+			status = "14"
+		}
+		var backend = h2cServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.ProtoMajor != 2 {
+				t.Errorf("Expected the stream to reach the balancee over HTTP/2, got %s", req.Proto)
+			}
+			w.Header().Set("Content-Type", "application/grpc")
+			w.Header().Set("Trailer", "Grpc-Status")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			started <- req.Host
+			<-finish
+			w.Header().Set("Grpc-Status", status)
+		}))
+		defer backend.Close()
+		var u, _ = url.Parse(backend.URL)
+		balancees = append(balancees, *u)
+	}
+	var pickLowestLoad = util.PickerFunc(func(balancees []util.Balancee, req *http.Request) (*url.URL, error) {
+		var best = balancees[0]
+		for _, balancee := range balancees[1:] {
+			if balancee.Load() < best.Load() {
+				best = balancee
+			}
+		}
+		return best.URL, nil
+	})
+	var balancer = util.NewBalancer(balancees, pickLowestLoad, util.BalancerOptions{StreamAfter: 20 * time.Millisecond}, New(Options{}))
+	var front = h2cServer(balancer)
+	defer front.Close()
+
+	//Every stream shares the one HTTP/2 connection to the balancer
+	var transport = &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	defer transport.CloseIdleConnections()
+	var responses = make(chan *http.Response, 3)
+	for i := 0; i < 3; i++ {
+		go func() {
+			var req, _ = http.NewRequest("POST", front.URL+"/pkg.Service/Stream", nil)
+			req.Header.Set("Content-Type", "application/grpc")
+			var resp, err = transport.RoundTrip(req)
+			if err != nil {
+				t.Errorf("Stream failed: %v", err)
+				started <- ""
+				return
+			}
+			responses <- resp
+		}()
+	}
+	var seen = map[string]bool{}
+	for i := 0; i < 3; i++ {
+		seen[<-started] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("Expected the streams to be spread over every balancee, got %v", seen)
+	}
+
+	var deadline = time.Now().Add(time.Second)
+	for _, u := range balancees {
+		for balancer.Connections(&u) != 1 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if balancer.Connections(&u) != 1 || balancer.OutstandingRequests(&u) != 0 {
+			t.Fatalf("Expected a long-lived stream to count as a connection, got %d connections and %d requests",
+				balancer.Connections(&u), balancer.OutstandingRequests(&u))
+		}
+	}
+
+	close(finish)
+	var statuses = map[string]int{}
+	for i := 0; i < 3; i++ {
+		var resp = <-responses
+		io.ReadAll(resp.Body)
+		resp.Body.Close()
+		statuses[resp.Trailer.Get("Grpc-Status")]++
+	}
+	if statuses["14"] != 1 || statuses["0"] != 2 {
+		t.Fatalf("Expected the balancees' statuses in the trailers, got %v", statuses)
+	}
+	if balancer.Errors(&balancees[0]).GRPC != 1 || balancer.Errors(&balancees[1]).GRPC != 0 {
+		t.Fatalf("Expected UNAVAILABLE to be counted against its balancee")
+	}
+	for _, u := range balancees {
+		for balancer.Connections(&u) != 0 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if balancer.Connections(&u) != 0 {
+			t.Fatalf("Expected finished streams to be released")
+		}
+	}
+}
@@ -0,0 +1,279 @@
+//Package forward sends requests on to the balancee a balancer chose, as a reverse proxy built on
+//httputil.ReverseProxy. The balancers use a Forwarder with default options when they are not given a next handler.
+package forward
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//TransportOptions tune the connections to a balancee. Zero values take the defaults given.
+type TransportOptions struct {
+	//DialTimeout limits how long connecting may take. Defaults to 30s.
+	DialTimeout time.Duration
+	//KeepAlive is how often idle connections are probed. Defaults to 30s.
+	KeepAlive time.Duration
+	//TLSHandshakeTimeout limits how long a TLS handshake may take. Defaults to 10s.
+	TLSHandshakeTimeout time.Duration
+	//ResponseHeaderTimeout limits how long to wait for response headers once the request is sent. Zero means no limit.
+	ResponseHeaderTimeout time.Duration
+	//IdleConnTimeout is how long an idle connection is kept. Defaults to 90s.
+	IdleConnTimeout time.Duration
+	//MaxIdleConnsPerHost is how many idle connections are kept to each balancee. Defaults to 32.
+	MaxIdleConnsPerHost int
+	//MaxConnsPerHost limits connections to each balancee, dialing or in use. Zero means no limit.
+	MaxConnsPerHost int
+	//TLSClientConfig configures connections to https balancees. HTTP/2 is negotiated with them when they support it.
+	TLSClientConfig *tls.Config
+}
+
+//transport builds an http.Transport from the options. An h2c transport speaks HTTP/2 without TLS, with prior
+//knowledge, to http balancees.
+func (t TransportOptions) transport(h2c bool) *http.Transport {
+	var dialer = &net.Dialer{
+		Timeout:   orDefault(t.DialTimeout, 30*time.Second),
+		KeepAlive: orDefault(t.KeepAlive, 30*time.Second),
+	}
+	var maxIdle = t.MaxIdleConnsPerHost
+	if maxIdle <= 0 {
+		maxIdle = 32
+	}
+	var transport = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		ForceAttemptHTTP2:     true,
+		TLSHandshakeTimeout:   orDefault(t.TLSHandshakeTimeout, 10*time.Second),
+		ResponseHeaderTimeout: t.ResponseHeaderTimeout,
+		IdleConnTimeout:       orDefault(t.IdleConnTimeout, 90*time.Second),
+		MaxIdleConnsPerHost:   maxIdle,
+		MaxConnsPerHost:       t.MaxConnsPerHost,
+		TLSClientConfig:       t.TLSClientConfig,
+	}
+	if h2c {
+		transport.Protocols = new(http.Protocols)
+		transport.Protocols.SetHTTP2(true)
+		transport.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return transport
+}
+
+//backendTransport holds the transports to a balancee, the h2c one only being built once it is needed
+type backendTransport struct {
+	options TransportOptions
+	plain   *http.Transport
+	h2c     *http.Transport
+	lock    sync.Mutex
+}
+
+func newBackendTransport(options TransportOptions) *backendTransport {
+	return &backendTransport{options: options, plain: options.transport(false)}
+}
+
+func (b *backendTransport) roundTripper(h2c bool) http.RoundTripper {
+	if !h2c {
+		return b.plain
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.h2c == nil {
+		b.h2c = b.options.transport(true)
+	}
+	return b.h2c
+}
+
+func (b *backendTransport) closeIdleConnections() {
+	b.plain.CloseIdleConnections()
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.h2c != nil {
+		b.h2c.CloseIdleConnections()
+	}
+}
+
+func orDefault(d time.Duration, fallback time.Duration) time.Duration {
+	if d <= 0 {
+		return fallback
+	}
+	return d
+}
+
+//Options holds the optional configuration for a Forwarder
+type Options struct {
+	//PassHostHeader sends the client's Host header on to the balancee, rather than the balancee's own host
+	PassHostHeader bool
+	//Host, when set, is the Host header sent to every balancee, whatever PassHostHeader says
+	Host string
+	//TrustForwardHeaders adds to the X-Forwarded-* and Forwarded headers the client sent, rather than replacing them.
+	//Only set it when every client reaches the balancer through proxies you run.
+	TrustForwardHeaders bool
+	//Transport tunes the connections to every balancee without transport options of its own
+	Transport TransportOptions
+	//BackendTransports tunes the connections to particular balancees, keyed by their host
+	BackendTransports map[string]TransportOptions
+	//RoundTripper, when set, sends every request, and no transports are built from the options
+	RoundTripper http.RoundTripper
+	//UnencryptedHTTP2 sends every request to http balancees over HTTP/2 without TLS (h2c), with prior knowledge.
+	//gRPC calls always are, as gRPC needs HTTP/2.
+	UnencryptedHTTP2 bool
+	//FlushInterval is how often the response is flushed to the client while it is copied. Zero flushes only for
+	//streaming responses, and a negative value flushes after every write.
+	FlushInterval time.Duration
+	//OnError, when set, is told about every failed request as well as the balancer
+	OnError func(req *http.Request, kind util.ErrorKind, err error)
+}
+
+//Forwarder is a reverse proxy to whichever balancee the request's URL points at
+type Forwarder struct {
+	options          Options
+	proxy            *httputil.ReverseProxy
+	defaultTransport *backendTransport
+	transports       map[string]*backendTransport
+	lock             *sync.RWMutex
+}
+
+//New gives a new Forwarder back
+func New(options Options) *Forwarder {
+	var f = &Forwarder{
+		options:    options,
+		transports: make(map[string]*backendTransport),
+		lock:       &sync.RWMutex{},
+	}
+	if options.RoundTripper == nil {
+		f.defaultTransport = newBackendTransport(options.Transport)
+		for host, transportOptions := range options.BackendTransports {
+			f.transports[host] = newBackendTransport(transportOptions)
+		}
+	}
+	f.proxy = &httputil.ReverseProxy{
+		Rewrite:        f.rewrite,
+		Transport:      roundTripperFunc(f.roundTrip),
+		FlushInterval:  options.FlushInterval,
+		ErrorHandler:   f.handleError,
+		ModifyResponse: f.reportGRPCStatus,
+	}
+	return f
+}
+
+func (f *Forwarder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.proxy.ServeHTTP(w, req)
+}
+
+//SetBackendTransport changes how connections to the balancee with the given host are tuned. Requests already in
+//flight finish on the connections they have.
+func (f *Forwarder) SetBackendTransport(host string, options TransportOptions) {
+	if f.options.RoundTripper != nil {
+		return
+	}
+	f.lock.Lock()
+	var previous = f.transports[host]
+	f.transports[host] = newBackendTransport(options)
+	f.lock.Unlock()
+	if previous != nil {
+		previous.closeIdleConnections()
+	}
+}
+
+//rewrite turns the request the balancer handed over into the one sent to the balancee
+func (f *Forwarder) rewrite(pr *httputil.ProxyRequest) {
+	var target = *pr.In.URL
+	pr.Out.URL = &target
+	switch {
+	case f.options.Host != "":
+		pr.Out.Host = f.options.Host
+	case f.options.PassHostHeader:
+		pr.Out.Host = pr.In.Host
+	default:
+		pr.Out.Host = ""
+	}
+
+	//Rewrite has already dropped the client's forwarding headers from the outgoing request
+	var forwarded = []string{forwardedElement(pr.In)}
+	if f.options.TrustForwardHeaders {
+		pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+		forwarded = append(pr.In.Header.Values("Forwarded"), forwarded...)
+	}
+	pr.SetXForwarded()
+	if f.options.TrustForwardHeaders {
+		if host := pr.In.Header.Get("X-Forwarded-Host"); host != "" {
+			pr.Out.Header.Set("X-Forwarded-Host", host)
+		}
+		if proto := pr.In.Header.Get("X-Forwarded-Proto"); proto != "" {
+			pr.Out.Header.Set("X-Forwarded-Proto", proto)
+		}
+	}
+	pr.Out.Header.Set("Forwarded", strings.Join(forwarded, ", "))
+}
+
+//forwardedElement describes the hop from the client to the balancer, as an RFC 7239 Forwarded element
+func forwardedElement(req *http.Request) string {
+	var parts []string
+	if client, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if strings.Contains(client, ":") {
+			//IPv6 addresses have to be bracketed and quoted
+			client = `"[` + client + `]"`
+		}
+		parts = append(parts, "for="+client)
+	}
+	if req.Host != "" {
+		parts = append(parts, "host="+quoteIfNeeded(req.Host))
+	}
+	var proto = "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	return strings.Join(append(parts, "proto="+proto), ";")
+}
+
+func quoteIfNeeded(value string) string {
+	if strings.ContainsAny(value, ":;,=\" ") {
+		return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+	}
+	return value
+}
+
+func (f *Forwarder) roundTrip(req *http.Request) (*http.Response, error) {
+	if f.options.RoundTripper != nil {
+		return f.options.RoundTripper.RoundTrip(req)
+	}
+	f.lock.RLock()
+	var transport, ok = f.transports[req.URL.Host]
+	f.lock.RUnlock()
+	if !ok {
+		transport = f.defaultTransport
+	}
+	var h2c = req.URL.Scheme == "http" && (f.options.UnencryptedHTTP2 || util.IsGRPC(req))
+	return transport.roundTripper(h2c).RoundTrip(req)
+}
+
+//handleError answers the client when the balancee could not, and reports what went wrong
+func (f *Forwarder) handleError(w http.ResponseWriter, req *http.Request, err error) {
+	if req.Context().Err() == context.Canceled {
+		//The client went away, which says nothing about the balancee
+		w.WriteHeader(util.StatusClientClosedRequest)
+		return
+	}
+	var kind = util.Classify(err)
+	util.ReportError(req.Context(), kind, err)
+	if f.options.OnError != nil {
+		f.options.OnError(req, kind, err)
+	}
+	if kind == util.TimeoutError {
+		w.WriteHeader(http.StatusGatewayTimeout)
+		return
+	}
+	w.WriteHeader(http.StatusBadGateway)
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (r roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return r(req)
+}
@@ -0,0 +1,170 @@
+package forward
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//balancerRequest builds the request a balancer hands to the forwarder, pointed at target
+func balancerRequest(target string) *http.Request {
+	var req = httptest.NewRequest("GET", "http://public.example/page", nil)
+	var u, _ = url.Parse(target)
+	req.URL = u
+	return req
+}
+
+func TestForwardsToBalancee(t *testing.T) {
+	var seen *http.Request
+	var backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen = req
+		w.Header().Set("Connection", "X-Secret")
+		w.Header().Set("X-Secret", "hop")
+		w.Write([]byte("hello"))
+	}))
+	defer backend.Close()
+
+	var req = balancerRequest(backend.URL)
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set("Forwarded", "for=10.0.0.1")
+	var recorder = httptest.NewRecorder()
+	New(Options{}).ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "hello" {
+		t.Fatalf("Unexpected response %d %q", recorder.Code, recorder.Body.String())
+	}
+	if seen.Host != backend.Listener.Addr().String() {
+		t.Fatalf("Expected the balancee's host to be sent by default, got %s", seen.Host)
+	}
+	if seen.Header.Get("X-Hop") != "" || seen.Header.Get("Keep-Alive") != "" {
+		t.Fatalf("Hop-by-hop headers were forwarded: %v", seen.Header)
+	}
+	if recorder.Header().Get("X-Secret") != "" {
+		t.Fatalf("Hop-by-hop headers were sent back: %v", recorder.Header())
+	}
+	if seen.Header.Get("X-Forwarded-For") != "192.0.2.1" {
+		t.Fatalf("Untrusted X-Forwarded-For should be replaced, got %q", seen.Header.Get("X-Forwarded-For"))
+	}
+	if seen.Header.Get("X-Forwarded-Host") != "public.example" || seen.Header.Get("X-Forwarded-Proto") != "http" {
+		t.Fatalf("Unexpected X-Forwarded-* headers: %v", seen.Header)
+	}
+	if got := seen.Header.Values("Forwarded"); len(got) != 1 || got[0] != "for=192.0.2.1;host=public.example;proto=http" {
+		t.Fatalf("Unexpected Forwarded header %q", got)
+	}
+}
+
+func TestTrustForwardHeaders(t *testing.T) {
+	var seen *http.Request
+	var backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen = req
+	}))
+	defer backend.Close()
+
+	var req = balancerRequest(backend.URL)
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("Forwarded", "for=10.0.0.1;proto=https")
+	New(Options{TrustForwardHeaders: true}).ServeHTTP(httptest.NewRecorder(), req)
+
+	if seen.Header.Get("X-Forwarded-For") != "10.0.0.1, 192.0.2.1" {
+		t.Fatalf("Trusted X-Forwarded-For should be added to, got %q", seen.Header.Get("X-Forwarded-For"))
+	}
+	if seen.Header.Get("X-Forwarded-Proto") != "https" {
+		t.Fatalf("Trusted X-Forwarded-Proto should be kept, got %q", seen.Header.Get("X-Forwarded-Proto"))
+	}
+	if got := seen.Header.Get("Forwarded"); got != "for=10.0.0.1;proto=https, for=192.0.2.1;host=public.example;proto=http" {
+		t.Fatalf("Trusted Forwarded header should be added to, got %q", got)
+	}
+}
+
+func TestHostRewriting(t *testing.T) {
+	var host string
+	var backend = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host = req.Host
+	}))
+	defer backend.Close()
+
+	New(Options{PassHostHeader: true}).ServeHTTP(httptest.NewRecorder(), balancerRequest(backend.URL))
+	if host != "public.example" {
+		t.Fatalf("Expected the client's host to be passed on, got %s", host)
+	}
+	New(Options{PassHostHeader: true, Host: "internal.example"}).ServeHTTP(httptest.NewRecorder(), balancerRequest(backend.URL))
+	if host != "internal.example" {
+		t.Fatalf("Expected the configured host to win, got %s", host)
+	}
+}
+
+func TestErrorsAreClassifiedAndReported(t *testing.T) {
+	var listener, _ = net.Listen("tcp", "127.0.0.1:0")
+	var closedAddress = listener.Addr().String()
+	listener.Close()
+
+	var slow = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer slow.Close()
+	var broken = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var conn, _, _ = w.(http.Hijacker).Hijack()
+		conn.Write([]byte("not http\r\n\r\n"))
+		conn.Close()
+	}))
+	defer broken.Close()
+
+	var slowHost = slow.Listener.Addr().String()
+	var onError []util.ErrorKind
+	var forwarder = New(Options{
+		BackendTransports: map[string]TransportOptions{slowHost: {ResponseHeaderTimeout: 20 * time.Millisecond}},
+		OnError: func(req *http.Request, kind util.ErrorKind, err error) {
+			onError = append(onError, kind)
+		},
+	})
+	var cases = []struct {
+		target string
+		kind   util.ErrorKind
+		status int
+	}{
+		{"http://" + closedAddress, util.DialError, http.StatusBadGateway},
+		{slow.URL, util.TimeoutError, http.StatusGatewayTimeout},
+		{broken.URL, util.ResponseError, http.StatusBadGateway},
+	}
+	for _, c := range cases {
+		var reported []util.ErrorKind
+		var req = balancerRequest(c.target)
+		req = req.WithContext(util.WithErrorReporter(req.Context(), func(kind util.ErrorKind, err error) {
+			reported = append(reported, kind)
+		}))
+		var recorder = httptest.NewRecorder()
+		forwarder.ServeHTTP(recorder, req)
+		if recorder.Code != c.status {
+			t.Fatalf("Expected %d from %s, got %d", c.status, c.kind, recorder.Code)
+		}
+		if len(reported) != 1 || reported[0] != c.kind {
+			t.Fatalf("Expected a %s error to be reported, got %v", c.kind, reported)
+		}
+	}
+	if len(onError) != 3 {
+		t.Fatalf("Expected OnError to hear about every failure, got %v", onError)
+	}
+}
+
+func TestSetBackendTransport(t *testing.T) {
+	var slow = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer slow.Close()
+	var forwarder = New(Options{})
+	forwarder.SetBackendTransport(slow.Listener.Addr().String(), TransportOptions{ResponseHeaderTimeout: 10 * time.Millisecond})
+	var recorder = httptest.NewRecorder()
+	forwarder.ServeHTTP(recorder, balancerRequest(slow.URL))
+	if recorder.Code != http.StatusGatewayTimeout {
+		t.Fatalf("Expected the tuned transport to time out, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,53 @@
+package forward
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//reportGRPCStatus reports gRPC calls which the balancee failed, once their status is known
+func (f *Forwarder) reportGRPCStatus(resp *http.Response) error {
+	if resp.Request == nil || !util.IsGRPC(resp.Request) {
+		return nil
+	}
+	if code, ok := util.GRPCStatus(resp.Header); ok {
+		//A call which failed straight away has its status in its headers
+		f.reportGRPCFailure(resp, resp.Header, code)
+		return nil
+	}
+	resp.Body = &trailerWatcher{ReadCloser: resp.Body, resp: resp, forwarder: f}
+	return nil
+}
+
+func (f *Forwarder) reportGRPCFailure(resp *http.Response, header http.Header, code int) {
+	if !util.GRPCFailure(code) {
+		return
+	}
+	var err = fmt.Errorf("grpc-status %d: %s", code, header.Get("Grpc-Message"))
+	util.ReportError(resp.Request.Context(), util.GRPCError, err)
+	if f.options.OnError != nil {
+		f.options.OnError(resp.Request, util.GRPCError, err)
+	}
+}
+
+//trailerWatcher looks for the gRPC status in a response's trailers once its body has been read
+type trailerWatcher struct {
+	io.ReadCloser
+	resp      *http.Response
+	forwarder *Forwarder
+	done      bool
+}
+
+func (t *trailerWatcher) Read(p []byte) (int, error) {
+	var n, err = t.ReadCloser.Read(p)
+	if err == io.EOF && !t.done {
+		t.done = true
+		if code, ok := util.GRPCStatus(t.resp.Trailer); ok {
+			t.forwarder.reportGRPCFailure(t.resp, t.resp.Trailer, code)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,137 @@
+package forward
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//h2cServer starts a server speaking HTTP/2 without TLS as well as HTTP/1
+func h2cServer(handler http.Handler) *httptest.Server {
+	var server = httptest.NewUnstartedServer(handler)
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	return server
+}
+
+//grpcBackend answers every call over h2c with the status in the request's X-Status header, in its trailers
+func grpcBackend(t *testing.T) *httptest.Server {
+	return h2cServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.ProtoMajor != 2 {
+			t.Errorf("Expected gRPC calls to reach the balancee over HTTP/2, got %s", req.Proto)
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		w.Write([]byte("\x00\x00\x00\x00\x00"))
+		w.Header().Set("Grpc-Status", req.Header.Get("X-Status"))
+		w.Header().Set("Grpc-Message", "from the backend")
+	}))
+}
+
+func grpcRequest(target string, status int) *http.Request {
+	var req = balancerRequest(target)
+	req.Method = "POST"
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("X-Status", strconv.Itoa(status))
+	return req
+}
+
+func TestGRPCIsForwardedOverH2CWithTrailers(t *testing.T) {
+	var backend = grpcBackend(t)
+	defer backend.Close()
+
+	var reported []util.ErrorKind
+	var forwarder = New(Options{})
+	for _, status := range []int{0, 5, 14} {
+		var req = grpcRequest(backend.URL, status)
+		req = req.WithContext(util.WithErrorReporter(req.Context(), func(kind util.ErrorKind, err error) {
+			reported = append(reported, kind)
+		}))
+		var recorder = httptest.NewRecorder()
+		forwarder.ServeHTTP(recorder, req)
+		var resp = recorder.Result()
+		io.ReadAll(resp.Body)
+		if got, ok := util.GRPCStatus(resp.Trailer); !ok || got != status {
+			t.Fatalf("Expected grpc-status %d in the trailers, got %v", status, resp.Trailer)
+		}
+	}
+	if len(reported) != 1 || reported[0] != util.GRPCError {
+		t.Fatalf("Expected only UNAVAILABLE to be reported, got %v", reported)
+	}
+}
+
+func TestTrailersOnlyGRPCFailureIsReported(t *testing.T) {
+	var backend = h2cServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "8")
+	}))
+	defer backend.Close()
+
+	var onError []util.ErrorKind
+	var forwarder = New(Options{
+		OnError: func(req *http.Request, kind util.ErrorKind, err error) {
+			onError = append(onError, kind)
+		},
+	})
+	//Only gRPC calls are checked for a status, even when the answer looks like one
+	forwarder.ServeHTTP(httptest.NewRecorder(), balancerRequest(backend.URL))
+	if len(onError) != 0 {
+		t.Fatalf("Expected an ordinary request not to be checked, got %v", onError)
+	}
+	forwarder.ServeHTTP(httptest.NewRecorder(), grpcRequest(backend.URL, 0))
+	if len(onError) != 1 || onError[0] != util.GRPCError {
+		t.Fatalf("Expected RESOURCE_EXHAUSTED in the headers to be reported, got %v", onError)
+	}
+}
+
+func TestGRPCOverTLS(t *testing.T) {
+	var backend = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.Write([]byte(req.Proto))
+		w.Header().Set("Grpc-Status", "0")
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+
+	var forwarder = New(Options{Transport: TransportOptions{
+		TLSClientConfig: &tls.Config{RootCAs: backend.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs},
+	}})
+	var recorder = httptest.NewRecorder()
+	forwarder.ServeHTTP(recorder, grpcRequest(backend.URL, 0))
+	if recorder.Body.String() != "HTTP/2.0" {
+		t.Fatalf("Expected HTTP/2 to be negotiated with the balancee, got %d %q", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestGRPCFailuresEjectTheirBalancee(t *testing.T) {
+	var backend = grpcBackend(t)
+	defer backend.Close()
+	var u, _ = url.Parse(backend.URL)
+	var balancer = util.NewBalancer([]url.URL{*u}, pickFirst, util.BalancerOptions{
+		Ejection: util.EjectionOptions{ConsecutiveFailures: 2},
+	}, New(Options{}))
+	for _, status := range []int{14, 0, 14, 14} {
+		var recorder = httptest.NewRecorder()
+		balancer.ServeHTTP(recorder, grpcRequest("http://public.example/pkg.Service/Call", status))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("Expected the call to reach the balancee, got %d", recorder.Code)
+		}
+	}
+	if balancer.Pool().Healthy(u) {
+		t.Fatalf("Expected UNAVAILABLE twice in a row to eject the balancee")
+	}
+	var recorder = httptest.NewRecorder()
+	balancer.ServeHTTP(recorder, grpcRequest("http://public.example/pkg.Service/Call", 0))
+	if recorder.Code != http.StatusBadGateway {
+		t.Fatalf("Expected no healthy balancee to be left, got %d", recorder.Code)
+	}
+}
@@ -1,167 +1,75 @@
 package jsq
 
 import (
-	"fmt"
 	"net/http"
 	"net/url"
-	"sync"
+	"time"
+
+	"github.com/jangie/goloadbalancers/forward"
+	"github.com/jangie/goloadbalancers/util"
 )
 
 //JoinShortestQueueBalancer is a bookkeeping struct
 type JoinShortestQueueBalancer struct {
-	balancees      map[*url.URL]int
-	highWatermark  map[url.URL]int
-	requestCounter map[url.URL]int
-	isTesting      bool
-	next           http.Handler
-	keys           []*url.URL
-	lock           *sync.Mutex
+	*util.Balancer
 }
 
 type JoinShortestQueueBalancerOptions struct {
+	//IsTesting keeps per-balancee request counts and high watermarks, for RequestCount and HighWatermark in tests
 	IsTesting bool
+	//MaxInFlight is the most outstanding requests any one balancee may have. Zero means no limit.
+	MaxInFlight int
+	//Limiter, when set, learns each balancee's in-flight limit from request latency instead of using MaxInFlight
+	Limiter util.LimiterFactory
+	//Queue configures waiting for a slot when every balancee is at its in-flight limit
+	Queue util.QueueOptions
+	//Rewrite builds the URL each request is forwarded to. Defaults to util.JoinURL.
+	Rewrite util.URLRewriter
+	//ConnectionWeight is how much each long-lived connection, such as a WebSocket, counts towards a balancee's load,
+	//compared to an outstanding request. Zero or less defaults to 1, counting a connection as one more request.
+	ConnectionWeight float64
+	//IgnoreConnections leaves long-lived connections out of load altogether, whatever ConnectionWeight says
+	IgnoreConnections bool
+	//Ejection configures taking balancees which keep failing out of rotation for a while
+	Ejection util.EjectionOptions
+	//StreamAfter is how long a gRPC call may stay in flight before it is counted as a long-lived connection, as its
+	//stream may stay open for hours, rather than as an outstanding request. Defaults to 5s. A negative value means calls
+	//are never counted as connections. Other requests are always counted as outstanding requests.
+	StreamAfter time.Duration
 }
 
-func (b *JoinShortestQueueBalancer) nextServer() (*url.URL, error) {
-	b.lock.Lock()
-	defer b.lock.Unlock()
-	//Special case: If balancees are nil or empty, return an error.
-	if b.balancees == nil || len(b.balancees) == 0 {
-		return nil, fmt.Errorf("Number of balancees is zero, cannot handle")
-	}
-	//Special case: If balancees is 1, there is no need to balance
-	if len(b.balancees) == 1 {
-		for key := range b.balancees {
-			return key, nil
-		}
-	}
-	var keysCopy = make([]*url.URL, len(b.keys))
-	copy(keysCopy, b.keys)
+//JoinShortestQueuePicker chooses the balancee with the lowest load, preferring earlier balancees on ties. Load is
+//outstanding requests, plus long-lived connections at their weight.
+type JoinShortestQueuePicker struct{}
 
-	var bestChoice *url.URL
-	var leastConns = -1
-	for _, key := range keysCopy {
-		if leastConns == -1 {
-			leastConns = b.balancees[key]
-			bestChoice = key
-			continue
-		}
-		if leastConns > b.balancees[key] {
-			leastConns = b.balancees[key]
-			bestChoice = key
+func (p JoinShortestQueuePicker) Pick(balancees []util.Balancee, req *http.Request) (*url.URL, error) {
+	var bestChoice = balancees[0]
+	for _, balancee := range balancees[1:] {
+		if bestChoice.Load() > balancee.Load() {
+			bestChoice = balancee
 		}
 	}
-	return bestChoice, nil
+	return bestChoice.URL, nil
 }
 
-//NewJoinShortestQueueBalancer gives a new ChoiceOfBalancer back
+//NewJoinShortestQueueBalancer gives a new JoinShortestQueueBalancer back. Without a next handler, requests are forwarded to the chosen balancee by
+//a forward.Forwarder with default options.
 func NewJoinShortestQueueBalancer(balancees []url.URL, options JoinShortestQueueBalancerOptions, next http.Handler) *JoinShortestQueueBalancer {
-	var b = JoinShortestQueueBalancer{
-		lock: &sync.Mutex{},
-	}
-	b.balancees = make(map[*url.URL]int)
-	if options.IsTesting {
-		b.requestCounter = make(map[url.URL]int)
-		b.highWatermark = make(map[url.URL]int)
-	}
-	for index := range balancees {
-		b.keys = append(b.keys, &balancees[index])
-		b.balancees[&balancees[index]] = 0
-	}
-
-	b.next = next
-	return &b
-}
-
-func (b *JoinShortestQueueBalancer) acquire(u *url.URL) {
-	b.lock.Lock()
-	defer b.lock.Unlock()
-	b.balancees[u]++
-	if b.isTesting {
-		if b.balancees[u] > b.highWatermark[*u] {
-			b.highWatermark[*u] = b.balancees[u]
-		}
-		b.requestCounter[*u]++
-	}
-}
-
-func (b *JoinShortestQueueBalancer) release(u *url.URL) {
-	b.lock.Lock()
-	defer b.lock.Unlock()
-	b.balancees[u]--
-}
-
-//NumberOfBalancees returns the number of balancees that this balancer knows about
-func (b *JoinShortestQueueBalancer) NumberOfBalancees() int {
-	return len(b.keys)
-}
-
-//OutstandingRequests returns the number of outstanding requests for a particular balancee
-func (b *JoinShortestQueueBalancer) OutstandingRequests(u *url.URL) int {
-	return b.balancees[u]
-}
-
-//HighWatermark returns the most outstanding requests for a particular balancee
-func (b *JoinShortestQueueBalancer) HighWatermark(u *url.URL) int {
-	return b.highWatermark[*u]
-}
-
-//RequestCount gives back the number of requests that have come into a particular URL
-func (b *JoinShortestQueueBalancer) RequestCount(u *url.URL) int {
-	return b.requestCounter[*u]
-}
-
-func (b *JoinShortestQueueBalancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	if w == nil || req == nil {
-		return
-	}
-	if len(b.keys) == 0 {
-		http.Error(w, "jsq has no balancees. no backend server available to fulfill this request.", http.StatusBadGateway)
-		return
-		//return 502
-	}
-	var next, _ = b.nextServer()
-	newReq := *req
-	newReq.URL = next
-	b.acquire(next)
-	if b.next != nil {
-		b.next.ServeHTTP(w, &newReq)
-	} else {
-		fmt.Fprint(w, "jsq does not have a next middleware and is unable to forward to the balancee.")
+	if next == nil {
+		next = forward.New(forward.Options{})
 	}
-	b.release(next)
-}
-
-//Add a url to the loadbalancer
-func (b *JoinShortestQueueBalancer) Add(u *url.URL) error {
-	b.lock.Lock()
-	defer b.lock.Unlock()
-	for _, key := range b.keys {
-		if *key == *u {
-			//Looks like we already have this url.
-			return nil
-		}
-	}
-	b.keys = append(b.keys, u)
-	b.balancees[u] = 0
-	return nil
-}
-
-//Remove a url from the loadbalancer.
-func (b *JoinShortestQueueBalancer) Remove(u *url.URL) error {
-	b.lock.Lock()
-	defer b.lock.Unlock()
-	newkeys := b.keys[:0]
-	for _, x := range b.keys {
-		if *x == *u {
-			newkeys = append(newkeys, x)
-		}
-	}
-	b.keys = newkeys
-	for key := range b.balancees {
-		if *key == *u {
-			delete(b.balancees, key)
-		}
+	return &JoinShortestQueueBalancer{
+		Balancer: util.NewBalancer(balancees, JoinShortestQueuePicker{}, util.BalancerOptions{
+			Name:              "jsq",
+			IsTesting:         options.IsTesting,
+			MaxInFlight:       options.MaxInFlight,
+			Limiter:           options.Limiter,
+			Queue:             options.Queue,
+			Rewrite:           options.Rewrite,
+			ConnectionWeight:  options.ConnectionWeight,
+			IgnoreConnections: options.IgnoreConnections,
+			Ejection:          options.Ejection,
+			StreamAfter:       options.StreamAfter,
+		}, next),
 	}
-	return nil
 }
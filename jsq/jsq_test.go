@@ -6,6 +6,9 @@ import (
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/jangie/goloadbalancers/lbtest"
+	"github.com/jangie/goloadbalancers/util"
 )
 
 var urlA, _ = url.Parse("http://a")
@@ -32,6 +35,12 @@ func (t *testHTTPResponseWriter) Write(b []byte) (int, error) {
 	return 0, nil
 }
 
+func (t *testHTTPResponseWriter) written() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.timesWritten
+}
+
 func (t *testHTTPResponseWriter) WriteHeader(int) {
 
 }
@@ -58,9 +67,9 @@ type testRequestThrottler struct {
 }
 
 func (t *testRequestThrottler) tryAcquireRequest() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
 	if t.outstandingRequests < t.maximumSimultaneousRequests {
-		t.lock.Lock()
-		defer t.lock.Unlock()
 		t.outstandingRequests++
 		return true
 	}
@@ -85,8 +94,9 @@ func TestJSQImplements(t *testing.T) {
 }
 
 func TestJSQDefaults(t *testing.T) {
-	var handler = NewJoinShortestQueueBalancer([]url.URL{}, JoinShortestQueueBalancerOptions{}, nil)
-	if handler.isTesting {
+	var handler = NewJoinShortestQueueBalancer([]url.URL{*urlA}, JoinShortestQueueBalancerOptions{}, &testHTTPHandler{})
+	handler.ServeHTTP(&testHTTPResponseWriter{lock: &sync.Mutex{}}, &http.Request{URL: &url.URL{}})
+	if handler.RequestCount(urlA) != 0 {
 		t.Fatalf("Should not default to testing mode")
 	}
 }
@@ -94,7 +104,7 @@ func TestJSQDefaults(t *testing.T) {
 func TestJSQBehavior(t *testing.T) {
 	var handler = NewJoinShortestQueueBalancer([]url.URL{*urlA, *urlB, *urlC}, JoinShortestQueueBalancerOptions{
 		IsTesting: true,
-	}, nil)
+	}, &testHTTPHandler{})
 
 	var i = 0
 	var requestThrottler = &testRequestThrottler{lock: &sync.Mutex{}, maximumSimultaneousRequests: 60}
@@ -107,7 +117,7 @@ func TestJSQBehavior(t *testing.T) {
 	var allWritten = false
 	for allWritten != true {
 		time.Sleep(100)
-		if writer.timesWritten == numberOfWrites {
+		if writer.written() == numberOfWrites {
 			allWritten = true
 		}
 	}
@@ -119,3 +129,23 @@ func TestJSQBehavior(t *testing.T) {
 		t.Fatalf("We are either unlucky or are not following JSQ")
 	}
 }
+
+func TestJSQConformance(t *testing.T) {
+	lbtest.Run(t, func(balancees []url.URL, next http.Handler) util.LoadBalancer {
+		return NewJoinShortestQueueBalancer(balancees, JoinShortestQueueBalancerOptions{}, next)
+	})
+}
+
+func BenchmarkJSQPick4(b *testing.B) {
+	lbtest.BenchmarkPicker(b, JoinShortestQueuePicker{}, 4)
+}
+
+func BenchmarkJSQPick64(b *testing.B) {
+	lbtest.BenchmarkPicker(b, JoinShortestQueuePicker{}, 64)
+}
+
+func BenchmarkJSQParallelServeHTTP(b *testing.B) {
+	lbtest.BenchmarkParallelServeHTTP(b, func(balancees []url.URL, next http.Handler) util.LoadBalancer {
+		return NewJoinShortestQueueBalancer(balancees, JoinShortestQueueBalancerOptions{}, next)
+	}, 4)
+}
@@ -0,0 +1,63 @@
+package lbtest
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//benchmarkBalancees gives back n balancees with varied outstanding requests
+func benchmarkBalancees(n int) []util.Balancee {
+	var balancees []util.Balancee
+	for i := 0; i < n; i++ {
+		var u, _ = url.Parse(fmt.Sprintf("http://backend-%d", i))
+		balancees = append(balancees, util.Balancee{URL: u, Outstanding: (i * 7) % 13})
+	}
+	return balancees
+}
+
+//BenchmarkPicker measures how long picker takes to choose between n balancees with varied outstanding requests
+func BenchmarkPicker(b *testing.B, picker util.Picker, n int) {
+	var balancees = benchmarkBalancees(n)
+	var req = &http.Request{}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		picker.Pick(balancees, req)
+	}
+}
+
+//nopResponseWriter throws every response away
+type nopResponseWriter struct{}
+
+func (n nopResponseWriter) Header() http.Header {
+	return http.Header{}
+}
+
+func (n nopResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (n nopResponseWriter) WriteHeader(int) {
+}
+
+//BenchmarkParallelServeHTTP measures serving requests from every CPU at once through a balancer over n balancees,
+//with a next handler which does nothing, so that only the balancer's own work is counted
+func BenchmarkParallelServeHTTP(b *testing.B, newBalancer Factory, n int) {
+	var balancees []url.URL
+	for _, balancee := range benchmarkBalancees(n) {
+		balancees = append(balancees, *balancee.URL)
+	}
+	var handler = newBalancer(balancees, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		var req = &http.Request{}
+		for pb.Next() {
+			handler.ServeHTTP(nopResponseWriter{}, req)
+		}
+	})
+}
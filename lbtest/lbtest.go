@@ -0,0 +1,308 @@
+//Package lbtest is a conformance suite which any util.LoadBalancer can run from its own tests, so that every
+//balancer agrees on what adding, removing and serving mean
+package lbtest
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//Factory builds the balancer under test, over balancees, sending requests on to next
+type Factory func(balancees []url.URL, next http.Handler) util.LoadBalancer
+
+var urlA, _ = url.Parse("http://a")
+var urlB, _ = url.Parse("http://b")
+var urlC, _ = url.Parse("http://c")
+var urlD, _ = url.Parse("http://d")
+
+var conformanceTests = []struct {
+	name string
+	test func(t *testing.T, newBalancer Factory)
+}{
+	{"AddedBalanceeIsServed", testAddedBalanceeIsServed},
+	{"RemovedBalanceeIsNotServed", testRemovedBalanceeIsNotServed},
+	{"RemovingUnknownBalanceeIsHarmless", testRemovingUnknownBalanceeIsHarmless},
+	{"DuplicateAddIsIdempotent", testDuplicateAddIsIdempotent},
+	{"EmptyPoolIsBadGateway", testEmptyPoolIsBadGateway},
+	{"ConcurrentMembershipChanges", testConcurrentMembershipChanges},
+	{"NoLeakedInFlightRequests", testNoLeakedInFlightRequests},
+	{"DistributionSanity", testDistributionSanity},
+}
+
+//Run runs the whole conformance suite against the balancers newBalancer builds, each test as a subtest. Run it
+//with -race to check membership changes while serving.
+func Run(t *testing.T, newBalancer Factory) {
+	for _, conformanceTest := range conformanceTests {
+		var test = conformanceTest.test
+		t.Run(conformanceTest.name, func(t *testing.T) {
+			test(t, newBalancer)
+		})
+	}
+}
+
+//recordingHandler counts the requests it sees for each host
+type recordingHandler struct {
+	lock  sync.Mutex
+	hosts map[string]int
+}
+
+func newRecordingHandler() *recordingHandler {
+	return &recordingHandler{hosts: make(map[string]int)}
+}
+
+func (h *recordingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.lock.Lock()
+	h.hosts[req.URL.Host]++
+	h.lock.Unlock()
+}
+
+func (h *recordingHandler) count(host string) int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.hosts[host]
+}
+
+func (h *recordingHandler) total() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var total = 0
+	for _, count := range h.hosts {
+		total += count
+	}
+	return total
+}
+
+//serve sends a request through the balancer, giving back the status code
+func serve(balancer http.Handler) int {
+	var recorder = httptest.NewRecorder()
+	balancer.ServeHTTP(recorder, httptest.NewRequest("GET", "http://balancer/", nil))
+	return recorder.Code
+}
+
+//serveMany sends count requests through the balancer one after another, failing the test if any is not a 200
+func serveMany(t *testing.T, balancer http.Handler, count int) {
+	t.Helper()
+	var i = 0
+	for ; i < count; i++ {
+		if code := serve(balancer); code != http.StatusOK {
+			t.Fatalf("Expected request %d to succeed, got %d", i, code)
+		}
+	}
+}
+
+func testAddedBalanceeIsServed(t *testing.T, newBalancer Factory) {
+	var next = newRecordingHandler()
+	var balancer = newBalancer([]url.URL{}, next)
+	if err := balancer.Add(urlA); err != nil {
+		t.Fatalf("Unexpected error adding a balancee: %s", err)
+	}
+	serveMany(t, balancer, 10)
+	if next.count("a") != 10 {
+		t.Fatalf("Expected the only balancee to serve every request, got %v", next.hosts)
+	}
+}
+
+func testRemovedBalanceeIsNotServed(t *testing.T, newBalancer Factory) {
+	var next = newRecordingHandler()
+	var balancer = newBalancer([]url.URL{*urlA, *urlB, *urlC}, next)
+	if err := balancer.Remove(urlB); err != nil {
+		t.Fatalf("Unexpected error removing a balancee: %s", err)
+	}
+	serveMany(t, balancer, 100)
+	if next.count("b") != 0 {
+		t.Fatalf("A removed balancee was still sent requests: %v", next.hosts)
+	}
+	balancer.Remove(urlA)
+	balancer.Remove(urlC)
+	if code := serve(balancer); code != http.StatusBadGateway {
+		t.Fatalf("Expected a 502 once every balancee was removed, got %d", code)
+	}
+	if next.total() != 100 {
+		t.Fatalf("Nothing should be sent on once every balancee was removed: %v", next.hosts)
+	}
+}
+
+func testRemovingUnknownBalanceeIsHarmless(t *testing.T, newBalancer Factory) {
+	var next = newRecordingHandler()
+	var balancer = newBalancer([]url.URL{*urlA, *urlB}, next)
+	if err := balancer.Remove(urlD); err != nil {
+		t.Fatalf("Unexpected error removing a url which was never added: %s", err)
+	}
+	serveMany(t, balancer, 10)
+	if next.count("a")+next.count("b") != 10 {
+		t.Fatalf("Removing an unknown url should leave the others alone: %v", next.hosts)
+	}
+}
+
+func testDuplicateAddIsIdempotent(t *testing.T, newBalancer Factory) {
+	var next = newRecordingHandler()
+	var balancer = newBalancer([]url.URL{*urlA, *urlA}, next)
+	if err := balancer.Add(urlA); err != nil {
+		t.Fatalf("Adding a url twice should not be an error: %s", err)
+	}
+	balancer.Add(urlB)
+	//A single remove should be enough, however many times the url was added
+	balancer.Remove(urlA)
+	serveMany(t, balancer, 10)
+	if next.count("b") != 10 {
+		t.Fatalf("A balancee added more than once survived being removed: %v", next.hosts)
+	}
+}
+
+func testEmptyPoolIsBadGateway(t *testing.T, newBalancer Factory) {
+	var next = newRecordingHandler()
+	var balancer = newBalancer([]url.URL{}, next)
+	if code := serve(balancer); code != http.StatusBadGateway {
+		t.Fatalf("Expected a 502 with no balancees, got %d", code)
+	}
+	if next.total() != 0 {
+		t.Fatalf("Nothing should be sent on without balancees: %v", next.hosts)
+	}
+}
+
+func testConcurrentMembershipChanges(t *testing.T, newBalancer Factory) {
+	var next = newRecordingHandler()
+	var balancer = newBalancer([]url.URL{*urlA}, next)
+	var done = make(chan struct{})
+	var churn sync.WaitGroup
+	churn.Add(1)
+	go func() {
+		defer churn.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			balancer.Add(urlB)
+			balancer.Add(urlC)
+			balancer.Remove(urlB)
+			balancer.Add(urlD)
+			balancer.Remove(urlC)
+			balancer.Remove(urlD)
+		}
+	}()
+	var servers sync.WaitGroup
+	var failures = make(chan int, 8*100)
+	var i = 0
+	for ; i < 8; i++ {
+		servers.Add(1)
+		go func() {
+			defer servers.Done()
+			var j = 0
+			for ; j < 100; j++ {
+				if code := serve(balancer); code != http.StatusOK {
+					failures <- code
+				}
+			}
+		}()
+	}
+	servers.Wait()
+	close(done)
+	churn.Wait()
+	close(failures)
+	for code := range failures {
+		t.Fatalf("Expected every request to succeed while balancees came and went, got %d", code)
+	}
+	if next.total() != 800 {
+		t.Fatalf("Expected every request to be sent on, got %v", next.hosts)
+	}
+}
+
+func testNoLeakedInFlightRequests(t *testing.T, newBalancer Factory) {
+	var release = make(chan struct{})
+	var arrived sync.WaitGroup
+	var next = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		arrived.Done()
+		<-release
+		if req.URL.Host == "b" {
+			panic("backend failed")
+		}
+	})
+	var balancer = newBalancer([]url.URL{*urlA, *urlB, *urlC}, next)
+	var reporter, ok = balancer.(util.LoadReporter)
+	if !ok {
+		t.Skip("The balancer does not report its outstanding requests")
+	}
+
+	var requests = 30
+	var served sync.WaitGroup
+	arrived.Add(requests)
+	served.Add(requests)
+	var i = 0
+	for ; i < requests; i++ {
+		go func() {
+			defer served.Done()
+			//Panics from next are the caller's to deal with, but must not leak the request's slot
+			defer func() { recover() }()
+			serve(balancer)
+		}()
+	}
+	arrived.Wait()
+	if outstanding := reporter.Outstanding(); outstanding != requests {
+		t.Fatalf("Expected %d outstanding requests while they were being served, got %d", requests, outstanding)
+	}
+	close(release)
+	served.Wait()
+
+	//Requests whose clients have already gone away must not leak their slot either
+	var ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	var j = 0
+	for ; j < 10; j++ {
+		var recorder = httptest.NewRecorder()
+		balancer.ServeHTTP(recorder, httptest.NewRequest("GET", "http://balancer/", nil).WithContext(ctx))
+	}
+	if outstanding := reporter.Outstanding(); outstanding != 0 {
+		t.Fatalf("Expected no outstanding requests once every request finished, got %d", outstanding)
+	}
+}
+
+func testDistributionSanity(t *testing.T, newBalancer Factory) {
+	var lock sync.Mutex
+	var hosts = make(map[string]int)
+	var release = make(chan struct{})
+	var arrived sync.WaitGroup
+	//Requests are held open until they have all arrived, so that every balancer sees the load build up
+	var next = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		hosts[req.URL.Host]++
+		lock.Unlock()
+		arrived.Done()
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+	})
+	var balancer = newBalancer([]url.URL{*urlA, *urlB, *urlC}, next)
+
+	var requests = 90
+	var served sync.WaitGroup
+	arrived.Add(requests)
+	served.Add(requests)
+	var i = 0
+	for ; i < requests; i++ {
+		go func() {
+			defer served.Done()
+			serve(balancer)
+		}()
+	}
+	arrived.Wait()
+	close(release)
+	served.Wait()
+
+	//Each balancee should get at least a third of its fair share
+	var minimum = requests / 3 / 3
+	for _, host := range []string{"a", "b", "c"} {
+		if hosts[host] < minimum {
+			t.Fatalf("Expected %s to get at least %d of %d requests, got %v", host, minimum, requests, hosts)
+		}
+	}
+}
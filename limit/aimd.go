@@ -0,0 +1,80 @@
+package limit
+
+import (
+	"math"
+	"time"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//AIMDLimiter raises its limit by one for every successful request made while the limit was being put to use, and
+//cuts it by a backoff ratio whenever a request is dropped or takes longer than the timeout
+type AIMDLimiter struct {
+	limit   int
+	options AIMDLimiterOptions
+}
+
+type AIMDLimiterOptions struct {
+	//InitialLimit defaults to 20
+	InitialLimit int
+	//MinLimit defaults to 1
+	MinLimit int
+	//MaxLimit defaults to 200
+	MaxLimit int
+	//BackoffRatio is what the limit is multiplied by on a drop. Defaults to 0.9.
+	BackoffRatio float64
+	//Timeout is the latency above which a request counts as dropped. Zero means latency is never a drop.
+	Timeout time.Duration
+}
+
+//NewAIMDLimiter gives a new AIMDLimiter back
+func NewAIMDLimiter(options AIMDLimiterOptions) *AIMDLimiter {
+	if options.InitialLimit <= 0 {
+		options.InitialLimit = 20
+	}
+	if options.MinLimit <= 0 {
+		options.MinLimit = 1
+	}
+	if options.MaxLimit <= 0 {
+		options.MaxLimit = 200
+	}
+	if options.BackoffRatio <= 0 || options.BackoffRatio >= 1 {
+		options.BackoffRatio = 0.9
+	}
+	return &AIMDLimiter{
+		limit:   clamp(options.InitialLimit, options.MinLimit, options.MaxLimit),
+		options: options,
+	}
+}
+
+//AIMD gives back a factory for AIMDLimiters, for use as a balancer's Limiter option
+func AIMD(options AIMDLimiterOptions) util.LimiterFactory {
+	return func() util.Limiter {
+		return NewAIMDLimiter(options)
+	}
+}
+
+func (a *AIMDLimiter) Limit() int {
+	return a.limit
+}
+
+func (a *AIMDLimiter) OnSample(latency time.Duration, inFlight int, dropped bool) {
+	if dropped || (a.options.Timeout > 0 && latency > a.options.Timeout) {
+		a.limit = clamp(int(math.Floor(float64(a.limit)*a.options.BackoffRatio)), a.options.MinLimit, a.options.MaxLimit)
+		return
+	}
+	//Only grow when the limit is actually being tested, otherwise an idle balancee's limit would grow without bound
+	if inFlight*2 >= a.limit {
+		a.limit = clamp(a.limit+1, a.options.MinLimit, a.options.MaxLimit)
+	}
+}
+
+func clamp(value int, minimum int, maximum int) int {
+	if value < minimum {
+		return minimum
+	}
+	if value > maximum {
+		return maximum
+	}
+	return value
+}
@@ -0,0 +1,103 @@
+package limit
+
+import (
+	"math"
+	"time"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//GradientLimiter compares a short-term average of latency against a long-term one, in the style of Netflix's
+//Gradient2 limiter. While recent latency matches the long-term trend the limit grows by a queue allowance of
+//sqrt(limit); when recent latency rises above it the limit is scaled down by the ratio between the two, and
+//a drop backs it off by BackoffRatio.
+type GradientLimiter struct {
+	limit       float64
+	longLatency float64
+	options     GradientLimiterOptions
+}
+
+type GradientLimiterOptions struct {
+	//InitialLimit defaults to 20
+	InitialLimit int
+	//MinLimit defaults to 1
+	MinLimit int
+	//MaxLimit defaults to 200
+	MaxLimit int
+	//Tolerance is how much recent latency may exceed the long-term latency before the limit is cut. Defaults to 1.5.
+	Tolerance float64
+	//Smoothing is how far the limit moves toward its new value on each sample, between 0 and 1. Drops are not
+	//smoothed. Defaults to 0.2.
+	Smoothing float64
+	//LongWindow is the number of samples the long-term latency averages over. Defaults to 600.
+	LongWindow int
+	//BackoffRatio is what the limit is multiplied by on a drop, as for AIMDLimiter. Defaults to 0.9.
+	BackoffRatio float64
+}
+
+//NewGradientLimiter gives a new GradientLimiter back
+func NewGradientLimiter(options GradientLimiterOptions) *GradientLimiter {
+	if options.InitialLimit <= 0 {
+		options.InitialLimit = 20
+	}
+	if options.MinLimit <= 0 {
+		options.MinLimit = 1
+	}
+	if options.MaxLimit <= 0 {
+		options.MaxLimit = 200
+	}
+	if options.Tolerance < 1 {
+		options.Tolerance = 1.5
+	}
+	if options.Smoothing <= 0 || options.Smoothing > 1 {
+		options.Smoothing = 0.2
+	}
+	if options.LongWindow <= 0 {
+		options.LongWindow = 600
+	}
+	if options.BackoffRatio <= 0 || options.BackoffRatio >= 1 {
+		options.BackoffRatio = 0.9
+	}
+	return &GradientLimiter{
+		limit:   float64(clamp(options.InitialLimit, options.MinLimit, options.MaxLimit)),
+		options: options,
+	}
+}
+
+//Gradient gives back a factory for GradientLimiters, for use as a balancer's Limiter option
+func Gradient(options GradientLimiterOptions) util.LimiterFactory {
+	return func() util.Limiter {
+		return NewGradientLimiter(options)
+	}
+}
+
+func (g *GradientLimiter) Limit() int {
+	return int(g.limit)
+}
+
+func (g *GradientLimiter) OnSample(latency time.Duration, inFlight int, dropped bool) {
+	if latency <= 0 {
+		return
+	}
+	var shortLatency = float64(latency)
+	if g.longLatency == 0 {
+		g.longLatency = shortLatency
+	} else {
+		var factor = 2 / float64(g.options.LongWindow+1)
+		g.longLatency = g.longLatency*(1-factor) + shortLatency*factor
+	}
+	//Don't grow a limit which isn't being put to use
+	if !dropped && float64(inFlight)*2 < g.limit {
+		return
+	}
+	var newLimit float64
+	if dropped {
+		//A drop is a clear sign of overload, so it is acted on in full rather than smoothed
+		newLimit = g.limit * g.options.BackoffRatio
+	} else {
+		var gradient = math.Max(0.5, math.Min(1, g.options.Tolerance*g.longLatency/shortLatency))
+		newLimit = g.limit*gradient + math.Sqrt(g.limit)
+		newLimit = g.limit*(1-g.options.Smoothing) + newLimit*g.options.Smoothing
+	}
+	g.limit = math.Max(float64(g.options.MinLimit), math.Min(float64(g.options.MaxLimit), newLimit))
+}
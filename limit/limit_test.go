@@ -0,0 +1,101 @@
+package limit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+func TestLimitersImplement(t *testing.T) {
+	var limiters = []util.Limiter{
+		NewAIMDLimiter(AIMDLimiterOptions{}),
+		NewVegasLimiter(VegasLimiterOptions{}),
+		NewGradientLimiter(GradientLimiterOptions{}),
+	}
+	for _, limiter := range limiters {
+		if limiter.Limit() != 20 {
+			t.Fatalf("%T should default to an initial limit of 20, was %d", limiter, limiter.Limit())
+		}
+	}
+}
+
+func TestAIMDGrowsWhenUsedAndBacksOffOnDrop(t *testing.T) {
+	var limiter = NewAIMDLimiter(AIMDLimiterOptions{InitialLimit: 10})
+	limiter.OnSample(time.Millisecond, 1, false)
+	if limiter.Limit() != 10 {
+		t.Fatalf("An idle balancee's limit should not grow, was %d", limiter.Limit())
+	}
+	limiter.OnSample(time.Millisecond, 10, false)
+	if limiter.Limit() != 11 {
+		t.Fatalf("Expected the limit to grow by one, was %d", limiter.Limit())
+	}
+	limiter.OnSample(time.Millisecond, 11, true)
+	if limiter.Limit() != 9 {
+		t.Fatalf("Expected the limit to back off to 9, was %d", limiter.Limit())
+	}
+}
+
+func TestGradientBacksOffOnDrop(t *testing.T) {
+	var limiter = NewGradientLimiter(GradientLimiterOptions{InitialLimit: 40})
+	limiter.OnSample(time.Millisecond, 40, true)
+	if limiter.Limit() != 36 {
+		t.Fatalf("Expected a drop to back the limit off by the default ratio, was %d", limiter.Limit())
+	}
+	limiter = NewGradientLimiter(GradientLimiterOptions{InitialLimit: 40, BackoffRatio: 0.5})
+	limiter.OnSample(time.Millisecond, 40, true)
+	if limiter.Limit() != 20 {
+		t.Fatalf("Expected a drop to halve the limit, was %d", limiter.Limit())
+	}
+}
+
+func TestAIMDTreatsSlowRequestsAsDropped(t *testing.T) {
+	var limiter = NewAIMDLimiter(AIMDLimiterOptions{InitialLimit: 10, Timeout: time.Second})
+	limiter.OnSample(2*time.Second, 10, false)
+	if limiter.Limit() != 9 {
+		t.Fatalf("Expected a slow request to back the limit off, was %d", limiter.Limit())
+	}
+}
+
+func TestLimitersShrinkWhenLatencyRises(t *testing.T) {
+	var limiters = []util.Limiter{
+		NewVegasLimiter(VegasLimiterOptions{}),
+		NewGradientLimiter(GradientLimiterOptions{LongWindow: 100}),
+	}
+	for _, limiter := range limiters {
+		var i = 0
+		for ; i < 50; i++ {
+			limiter.OnSample(10*time.Millisecond, limiter.Limit(), false)
+		}
+		var healthy = limiter.Limit()
+		for i = 0; i < 50; i++ {
+			limiter.OnSample(100*time.Millisecond, limiter.Limit(), false)
+		}
+		if limiter.Limit() >= healthy {
+			t.Fatalf("%T should shrink its limit when latency rises, went from %d to %d", limiter, healthy, limiter.Limit())
+		}
+	}
+}
+
+func TestLimitersStayWithinBounds(t *testing.T) {
+	var limiters = []util.Limiter{
+		NewAIMDLimiter(AIMDLimiterOptions{MinLimit: 2, MaxLimit: 30}),
+		NewVegasLimiter(VegasLimiterOptions{MinLimit: 2, MaxLimit: 30}),
+		NewGradientLimiter(GradientLimiterOptions{MinLimit: 2, MaxLimit: 30}),
+	}
+	for _, limiter := range limiters {
+		var i = 0
+		for ; i < 500; i++ {
+			limiter.OnSample(time.Millisecond, limiter.Limit(), false)
+		}
+		if limiter.Limit() != 30 {
+			t.Fatalf("%T should grow to its max limit, was %d", limiter, limiter.Limit())
+		}
+		for i = 0; i < 500; i++ {
+			limiter.OnSample(time.Second, limiter.Limit(), true)
+		}
+		if limiter.Limit() != 2 {
+			t.Fatalf("%T should shrink to its min limit, was %d", limiter, limiter.Limit())
+		}
+	}
+}
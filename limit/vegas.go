@@ -0,0 +1,88 @@
+package limit
+
+import (
+	"math"
+	"time"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//VegasLimiter follows TCP Vegas: it estimates how many requests are queued at the balancee from how far the latency
+//has risen above the lowest latency seen, growing the limit while that queue is small and shrinking it once it grows
+type VegasLimiter struct {
+	limit      float64
+	minLatency time.Duration
+	options    VegasLimiterOptions
+}
+
+type VegasLimiterOptions struct {
+	//InitialLimit defaults to 20
+	InitialLimit int
+	//MinLimit defaults to 1
+	MinLimit int
+	//MaxLimit defaults to 200
+	MaxLimit int
+	//Alpha is the queue size, as a multiple of log10(limit), below which the limit grows. Defaults to 3.
+	Alpha float64
+	//Beta is the queue size, as a multiple of log10(limit), above which the limit shrinks. Defaults to 6.
+	Beta float64
+}
+
+//NewVegasLimiter gives a new VegasLimiter back
+func NewVegasLimiter(options VegasLimiterOptions) *VegasLimiter {
+	if options.InitialLimit <= 0 {
+		options.InitialLimit = 20
+	}
+	if options.MinLimit <= 0 {
+		options.MinLimit = 1
+	}
+	if options.MaxLimit <= 0 {
+		options.MaxLimit = 200
+	}
+	if options.Alpha <= 0 {
+		options.Alpha = 3
+	}
+	if options.Beta <= options.Alpha {
+		options.Beta = 2 * options.Alpha
+	}
+	return &VegasLimiter{
+		limit:   float64(clamp(options.InitialLimit, options.MinLimit, options.MaxLimit)),
+		options: options,
+	}
+}
+
+//Vegas gives back a factory for VegasLimiters, for use as a balancer's Limiter option
+func Vegas(options VegasLimiterOptions) util.LimiterFactory {
+	return func() util.Limiter {
+		return NewVegasLimiter(options)
+	}
+}
+
+func (v *VegasLimiter) Limit() int {
+	return int(v.limit)
+}
+
+func (v *VegasLimiter) OnSample(latency time.Duration, inFlight int, dropped bool) {
+	if latency <= 0 {
+		return
+	}
+	if v.minLatency == 0 || latency < v.minLatency {
+		v.minLatency = latency
+	}
+	//log10 of small limits is tiny or zero, so never step by less than one
+	var step = math.Max(1, math.Log10(v.limit))
+	if dropped {
+		v.limit -= step
+	} else if float64(inFlight)*2 < v.limit {
+		//The limit isn't being put to use, so latency says nothing about whether it is right
+		return
+	} else {
+		var queue = v.limit * (1 - float64(v.minLatency)/float64(latency))
+		if queue <= v.options.Alpha*step {
+			v.limit += step
+		} else if queue >= v.options.Beta*step {
+			v.limit -= step
+		}
+	}
+	v.limit = math.Max(float64(v.options.MinLimit), math.Min(float64(v.options.MaxLimit), v.limit))
+}
@@ -0,0 +1,339 @@
+//Package loadgen fires load at a balancer fronting in-process fake backends, to measure how the balancer itself
+//performs and how it spreads requests
+package loadgen
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jangie/goloadbalancers/simulate"
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//Backend is a fake backend, served in-process, which takes Latency over each request
+type Backend struct {
+	Name    string
+	Latency simulate.Distribution
+	//ErrorRate is the share of requests, between 0 and 1, the backend fails with a 500
+	ErrorRate float64
+}
+
+//Uneven gives back three backends taking 1000ms, 666ms and 334ms, as testServer.js does for /simulateUnevenServers
+func Uneven() []Backend {
+	return []Backend{
+		{Name: "a", Latency: simulate.Constant(1000 * time.Millisecond)},
+		{Name: "b", Latency: simulate.Constant(666 * time.Millisecond)},
+		{Name: "c", Latency: simulate.Constant(334 * time.Millisecond)},
+	}
+}
+
+//Even gives back three backends taking 300ms each, as testServer.js does for /simulateServers
+func Even() []Backend {
+	return []Backend{
+		{Name: "a", Latency: simulate.Constant(300 * time.Millisecond)},
+		{Name: "b", Latency: simulate.Constant(300 * time.Millisecond)},
+		{Name: "c", Latency: simulate.Constant(300 * time.Millisecond)},
+	}
+}
+
+//ParseBackends reads backends from a comma separated list of name=latency, where latency is a constant duration
+//such as 300ms, exp:<mean>, uniform:<min>-<max> or lognormal:<median>:<sigma>. "even" and "uneven" give back Even
+//and Uneven.
+func ParseBackends(spec string) ([]Backend, error) {
+	switch spec {
+	case "even":
+		return Even(), nil
+	case "uneven":
+		return Uneven(), nil
+	}
+	var backends []Backend
+	for _, part := range strings.Split(spec, ",") {
+		var nameAndLatency = strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(nameAndLatency) != 2 || nameAndLatency[0] == "" {
+			return nil, fmt.Errorf("Expected name=latency, got %q", part)
+		}
+		var latency, err = parseDistribution(nameAndLatency[1])
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read the latency of %s: %s", nameAndLatency[0], err)
+		}
+		backends = append(backends, Backend{Name: nameAndLatency[0], Latency: latency})
+	}
+	return backends, nil
+}
+
+func parseDistribution(spec string) (simulate.Distribution, error) {
+	var fields = strings.Split(spec, ":")
+	switch fields[0] {
+	case "exp":
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Expected exp:<mean>, got %q", spec)
+		}
+		var mean, err = time.ParseDuration(fields[1])
+		return simulate.Exponential(mean), err
+	case "uniform":
+		var bounds []string
+		if len(fields) == 2 {
+			bounds = strings.SplitN(fields[1], "-", 2)
+		}
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("Expected uniform:<min>-<max>, got %q", spec)
+		}
+		var min, minErr = time.ParseDuration(bounds[0])
+		if minErr != nil {
+			return nil, minErr
+		}
+		var max, maxErr = time.ParseDuration(bounds[1])
+		return simulate.Uniform{Min: min, Max: max}, maxErr
+	case "lognormal":
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Expected lognormal:<median>:<sigma>, got %q", spec)
+		}
+		var median, medianErr = time.ParseDuration(fields[1])
+		if medianErr != nil {
+			return nil, medianErr
+		}
+		var sigma, sigmaErr = strconv.ParseFloat(fields[2], 64)
+		return simulate.LogNormal{Median: median, Sigma: sigma}, sigmaErr
+	}
+	var constant, err = time.ParseDuration(spec)
+	return simulate.Constant(constant), err
+}
+
+//Config describes a load test
+type Config struct {
+	Backends    []Backend
+	NewBalancer simulate.BalancerFactory
+	//Concurrency is how many requests are sent at once. Defaults to 50.
+	Concurrency int
+	//QPS paces requests to this many a second. Zero sends them as fast as Concurrency allows.
+	QPS float64
+	//Requests stops the test once this many requests were sent
+	Requests int
+	//Duration stops the test once this much time has passed
+	Duration time.Duration
+	//Seed decides the backends' latencies and errors, and the balancer's random choices
+	Seed int64
+	//CPUProfile, when set, has a CPU profile of the test written to it
+	CPUProfile io.Writer
+	//MemProfile, when set, has an allocation profile written to it once the test is done
+	MemProfile io.Writer
+}
+
+//Result is what a load test measured
+type Result struct {
+	Requests int
+	//Errors is the number of requests which did not get a 2xx back
+	Errors  int
+	Elapsed time.Duration
+	//Throughput is requests completed a second
+	Throughput float64
+	Latency    simulate.Percentiles
+	Backends   []BackendResult
+	//AllocsPerRequest is the number of heap allocations made over the test, a request
+	AllocsPerRequest float64
+	//BytesPerRequest is the number of bytes allocated on the heap over the test, a request
+	BytesPerRequest float64
+}
+
+//BackendResult is how many requests one backend got
+type BackendResult struct {
+	Name     string
+	Requests int
+	//Share is the backend's share, between 0 and 1, of every request sent to a backend
+	Share float64
+}
+
+//fakeBackends serves each balancee's requests in-process, as the backend of the same name would
+type fakeBackends struct {
+	backends map[string]*Backend
+	requests map[string]int
+	random   *rand.Rand
+	lock     sync.Mutex
+}
+
+func (f *fakeBackends) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var backend, ok = f.backends[req.URL.Host]
+	if !ok {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	f.lock.Lock()
+	f.requests[backend.Name]++
+	var latency = backend.Latency.Sample(f.random)
+	var failed = backend.ErrorRate > 0 && f.random.Float64() < backend.ErrorRate
+	f.lock.Unlock()
+	time.Sleep(latency)
+	if failed {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+//Run fires load at the balancer config.NewBalancer builds until config.Requests were sent or config.Duration passed
+func Run(config Config) (*Result, error) {
+	if len(config.Backends) == 0 {
+		return nil, fmt.Errorf("A load test needs at least one backend")
+	}
+	if config.NewBalancer == nil {
+		return nil, fmt.Errorf("A load test needs a balancer")
+	}
+	if config.Requests <= 0 && config.Duration <= 0 {
+		return nil, fmt.Errorf("A load test needs a number of requests or a duration to stop after")
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = 50
+	}
+
+	var random = rand.New(rand.NewSource(config.Seed))
+	var next = &fakeBackends{
+		backends: make(map[string]*Backend),
+		requests: make(map[string]int),
+		random:   random,
+	}
+	var balancees []url.URL
+	for i := range config.Backends {
+		var backend = &config.Backends[i]
+		var u = url.URL{Scheme: "http", Host: backend.Name}
+		if _, ok := next.backends[u.Host]; ok {
+			return nil, fmt.Errorf("There is more than one backend named %s", backend.Name)
+		}
+		next.backends[u.Host] = backend
+		balancees = append(balancees, u)
+	}
+	var balancer = config.NewBalancer(balancees, util.NewShardedRandom(config.Seed, 0), next)
+
+	if config.CPUProfile != nil {
+		if err := pprof.StartCPUProfile(config.CPUProfile); err != nil {
+			return nil, err
+		}
+	}
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	var start = time.Now()
+	var tokens = make(chan struct{})
+	var stop = make(chan struct{})
+	go func() {
+		defer close(tokens)
+		var sent = 0
+		var deadline <-chan time.Time
+		if config.Duration > 0 {
+			var timer = time.NewTimer(config.Duration)
+			defer timer.Stop()
+			deadline = timer.C
+		}
+		for config.Requests <= 0 || sent < config.Requests {
+			if config.QPS > 0 {
+				var due = start.Add(time.Duration(float64(sent) / config.QPS * float64(time.Second)))
+				if wait := time.Until(due); wait > 0 {
+					select {
+					case <-time.After(wait):
+					case <-deadline:
+						return
+					}
+				}
+			}
+			select {
+			case tokens <- struct{}{}:
+				sent++
+			case <-deadline:
+				return
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var lock sync.Mutex
+	var latencies []time.Duration
+	var result = &Result{}
+	var workers sync.WaitGroup
+	for i := 0; i < config.Concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for range tokens {
+				var recorder = httptest.NewRecorder()
+				var sent = time.Now()
+				balancer.ServeHTTP(recorder, httptest.NewRequest("GET", "http://balancer/", nil))
+				var latency = time.Since(sent)
+				lock.Lock()
+				result.Requests++
+				if recorder.Code < 200 || recorder.Code > 299 {
+					result.Errors++
+				} else {
+					latencies = append(latencies, latency)
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+	workers.Wait()
+	close(stop)
+	result.Elapsed = time.Since(start)
+
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	if config.CPUProfile != nil {
+		pprof.StopCPUProfile()
+	}
+	if config.MemProfile != nil {
+		if err := pprof.Lookup("allocs").WriteTo(config.MemProfile, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	if result.Requests > 0 {
+		result.AllocsPerRequest = float64(after.Mallocs-before.Mallocs) / float64(result.Requests)
+		result.BytesPerRequest = float64(after.TotalAlloc-before.TotalAlloc) / float64(result.Requests)
+	}
+	if result.Elapsed > 0 {
+		result.Throughput = float64(result.Requests-result.Errors) / result.Elapsed.Seconds()
+	}
+	result.Latency = simulate.Summarize(latencies)
+	var total = 0
+	for _, count := range next.requests {
+		total += count
+	}
+	for _, backend := range config.Backends {
+		var backendResult = BackendResult{Name: backend.Name, Requests: next.requests[backend.Name]}
+		if total > 0 {
+			backendResult.Share = float64(backendResult.Requests) / float64(total)
+		}
+		result.Backends = append(result.Backends, backendResult)
+	}
+	return result, nil
+}
+
+//WriteTo writes a human readable summary of the result
+func (r *Result) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	var printf = func(format string, args ...interface{}) error {
+		var n, err = fmt.Fprintf(w, format, args...)
+		written += int64(n)
+		return err
+	}
+	var err = printf("requests: %d sent, %d errors over %s, %.1f/s\n", r.Requests, r.Errors, r.Elapsed.Round(time.Millisecond), r.Throughput)
+	if err == nil {
+		err = printf("latency: p50 %s, p90 %s, p99 %s, max %s, mean %s\n", r.Latency.P50, r.Latency.P90, r.Latency.P99, r.Latency.Max, r.Latency.Mean)
+	}
+	if err == nil {
+		err = printf("allocations: %.1f a request, %.0f bytes a request\n", r.AllocsPerRequest, r.BytesPerRequest)
+	}
+	for _, b := range r.Backends {
+		if err != nil {
+			break
+		}
+		err = printf(" - %s: %d requests, %.1f%%\n", b.Name, b.Requests, b.Share*100)
+	}
+	return written, err
+}
@@ -0,0 +1,106 @@
+package loadgen
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jangie/goloadbalancers/jsq"
+	"github.com/jangie/goloadbalancers/simulate"
+	"github.com/jangie/goloadbalancers/util"
+)
+
+func newJSQ(balancees []url.URL, randomGenerator util.RandomInt, next http.Handler) util.LoadBalancer {
+	return jsq.NewJoinShortestQueueBalancer(balancees, jsq.JoinShortestQueueBalancerOptions{}, next)
+}
+
+func TestParseBackends(t *testing.T) {
+	var backends, err = ParseBackends("a=300ms, b=exp:10ms,c=uniform:1ms-2ms,d=lognormal:5ms:0.5")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(backends) != 4 || backends[1].Name != "b" {
+		t.Fatalf("Unexpected backends %+v", backends)
+	}
+	if backends[0].Latency != simulate.Constant(300*time.Millisecond) ||
+		backends[1].Latency != simulate.Exponential(10*time.Millisecond) ||
+		backends[2].Latency != (simulate.Uniform{Min: time.Millisecond, Max: 2 * time.Millisecond}) ||
+		backends[3].Latency != (simulate.LogNormal{Median: 5 * time.Millisecond, Sigma: 0.5}) {
+		t.Fatalf("Latencies were not read as written: %+v", backends)
+	}
+	if uneven, _ := ParseBackends("uneven"); len(uneven) != 3 {
+		t.Fatalf("Expected the uneven preset")
+	}
+	for _, spec := range []string{"a", "a=fast", "a=exp", "a=uniform:1ms", "=1ms"} {
+		if _, err := ParseBackends(spec); err == nil {
+			t.Fatalf("Expected %q to be an error", spec)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	var backends = []Backend{
+		{Name: "fast", Latency: simulate.Constant(time.Millisecond)},
+		{Name: "slow", Latency: simulate.Constant(10 * time.Millisecond)},
+		{Name: "broken", Latency: simulate.Constant(time.Millisecond), ErrorRate: 1},
+	}
+	var cpu, mem bytes.Buffer
+	var result, err = Run(Config{
+		Backends:    backends,
+		NewBalancer: newJSQ,
+		Concurrency: 8,
+		Requests:    300,
+		CPUProfile:  &cpu,
+		MemProfile:  &mem,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if result.Requests != 300 {
+		t.Fatalf("Expected 300 requests, got %d", result.Requests)
+	}
+	if result.Errors != result.Backends[2].Requests {
+		t.Fatalf("Expected every request to the broken backend to be an error: %+v", result)
+	}
+	if result.Backends[0].Requests <= result.Backends[1].Requests {
+		t.Fatalf("Expected jsq to favour the fast backend: %+v", result.Backends)
+	}
+	if result.Throughput <= 0 || result.Latency.P50 < time.Millisecond {
+		t.Fatalf("Unexpected measurements: %+v", result)
+	}
+	if cpu.Len() == 0 || mem.Len() == 0 {
+		t.Fatalf("Expected profiles to be written")
+	}
+	var summary bytes.Buffer
+	result.WriteTo(&summary)
+	if !strings.Contains(summary.String(), "slow") {
+		t.Fatalf("Expected every backend in the summary:\n%s", summary.String())
+	}
+}
+
+func TestRunPacesToQPS(t *testing.T) {
+	var result, _ = Run(Config{
+		Backends:    []Backend{{Name: "a", Latency: simulate.Constant(0)}},
+		NewBalancer: newJSQ,
+		QPS:         200,
+		Duration:    250 * time.Millisecond,
+	})
+	if result.Requests < 30 || result.Requests > 60 {
+		t.Fatalf("Expected about 50 requests at 200/s over 250ms, got %d", result.Requests)
+	}
+}
+
+func TestRunNeedsAStop(t *testing.T) {
+	if _, err := Run(Config{Backends: Even(), NewBalancer: newJSQ}); err == nil {
+		t.Fatalf("A load test without a number of requests or a duration should be an error")
+	}
+}
+
+func BenchmarkRunJSQ(b *testing.B) {
+	var backends = []Backend{{Name: "a", Latency: simulate.Constant(0)}, {Name: "b", Latency: simulate.Constant(0)}}
+	b.ReportAllocs()
+	Run(Config{Backends: backends, NewBalancer: newJSQ, Concurrency: 8, Requests: b.N})
+}
@@ -0,0 +1,275 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//Mirror serves requests from a primary balancer while copying a sampled fraction of them to a shadow balancer. Only
+//the primary's response is returned to the client; the shadow's is discarded after being compared with it.
+type Mirror struct {
+	primary         util.LoadBalancer
+	shadow          util.LoadBalancer
+	sampleRate      float64
+	maxBodyBytes    int64
+	shadowTimeout   time.Duration
+	onDiff          func(Diff)
+	randomGenerator util.RandomInt
+	slots           chan struct{}
+	stats           Stats
+	lock            *sync.Mutex
+}
+
+type MirrorOptions struct {
+	//SampleRate is the fraction of requests, between 0 and 1, copied to the shadow
+	SampleRate float64
+	//MaxBodyBytes is the largest request body that will be buffered to be mirrored. Defaults to 1MiB.
+	MaxBodyBytes int64
+	//MaxConcurrency is the most shadow requests in flight at once; requests beyond it are not mirrored. Defaults to 10.
+	MaxConcurrency int
+	//ShadowTimeout bounds how long a shadow request may run. Defaults to 30 seconds.
+	ShadowTimeout time.Duration
+	//OnDiff, when set, is called from the shadow's goroutine with the comparison of every mirrored request
+	OnDiff func(Diff)
+	//RandomGenerator decides which requests are sampled. Defaults to util.GoRandom.
+	RandomGenerator util.RandomInt
+}
+
+//Diff compares how the primary and shadow handled one mirrored request
+type Diff struct {
+	Method         string
+	Path           string
+	PrimaryStatus  int
+	ShadowStatus   int
+	PrimaryLatency time.Duration
+	ShadowLatency  time.Duration
+}
+
+//StatusMatches reports whether the primary and shadow gave the same status
+func (d Diff) StatusMatches() bool {
+	return d.PrimaryStatus == d.ShadowStatus
+}
+
+//Stats are the counters a Mirror keeps
+type Stats struct {
+	//Mirrored is the number of requests sent to the shadow and compared
+	Mirrored int64
+	//StatusMismatches is the number of mirrored requests where the shadow's status differed from the primary's
+	StatusMismatches int64
+	//SkippedBusy is the number of sampled requests not mirrored because the shadow was at MaxConcurrency
+	SkippedBusy int64
+	//SkippedBody is the number of sampled requests not mirrored because their body was over MaxBodyBytes
+	SkippedBody int64
+	//TotalLatencyDiff is the sum of shadow latency minus primary latency over every mirrored request
+	TotalLatencyDiff time.Duration
+}
+
+//sampleResolution is the granularity with which requests are sampled
+const sampleResolution = 10000
+
+//NewMirror gives a new Mirror back
+func NewMirror(primary util.LoadBalancer, shadow util.LoadBalancer, options MirrorOptions) *Mirror {
+	var m = Mirror{
+		primary:       primary,
+		shadow:        shadow,
+		sampleRate:    options.SampleRate,
+		maxBodyBytes:  options.MaxBodyBytes,
+		shadowTimeout: options.ShadowTimeout,
+		onDiff:        options.OnDiff,
+		lock:          &sync.Mutex{},
+	}
+	if m.maxBodyBytes <= 0 {
+		m.maxBodyBytes = 1 << 20
+	}
+	if options.MaxConcurrency <= 0 {
+		options.MaxConcurrency = 10
+	}
+	m.slots = make(chan struct{}, options.MaxConcurrency)
+	if m.shadowTimeout <= 0 {
+		m.shadowTimeout = 30 * time.Second
+	}
+	if options.RandomGenerator == nil {
+		m.randomGenerator = &util.GoRandom{}
+	} else {
+		m.randomGenerator = options.RandomGenerator
+	}
+	return &m
+}
+
+//Stats gives back a snapshot of the mirror's counters
+func (m *Mirror) Stats() Stats {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.stats
+}
+
+func (m *Mirror) sampled() bool {
+	if m.sampleRate <= 0 {
+		return false
+	}
+	if m.sampleRate >= 1 {
+		return true
+	}
+	m.lock.Lock()
+	var roll, _ = m.randomGenerator.NextInt(0, sampleResolution)
+	m.lock.Unlock()
+	return float64(roll) < m.sampleRate*sampleResolution
+}
+
+func (m *Mirror) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if w == nil || req == nil {
+		return
+	}
+	if m.shadow == nil || !m.sampled() {
+		m.primary.ServeHTTP(w, req)
+		return
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.count(func(s *Stats) { s.SkippedBusy++ })
+		m.primary.ServeHTTP(w, req)
+		return
+	}
+	var shadowReq, ok = m.cloneRequest(req)
+	if !ok {
+		<-m.slots
+		m.count(func(s *Stats) { s.SkippedBody++ })
+		m.primary.ServeHTTP(w, req)
+		return
+	}
+	var primaryResult = make(chan result, 1)
+	go m.serveShadow(shadowReq, primaryResult)
+
+	var recorder = &util.StatusRecorder{ResponseWriter: w}
+	var start = time.Now()
+	defer func() {
+		primaryResult <- result{status: recorder.StatusCode(), latency: time.Since(start)}
+	}()
+	m.primary.ServeHTTP(recorder, req)
+}
+
+//cloneRequest copies req for the shadow, buffering its body so both can read it. It gives back false, leaving req
+//readable, if the body is too large to buffer.
+func (m *Mirror) cloneRequest(req *http.Request) (*http.Request, bool) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		var buffered, err = io.ReadAll(io.LimitReader(req.Body, m.maxBodyBytes+1))
+		if err != nil || int64(len(buffered)) > m.maxBodyBytes {
+			req.Body = readCloser{io.MultiReader(bytes.NewReader(buffered), req.Body), req.Body}
+			return nil, false
+		}
+		body = buffered
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	//The shadow must outlive the primary's request
+	var shadowReq = req.Clone(context.WithoutCancel(req.Context()))
+	if body != nil {
+		shadowReq.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	return shadowReq, true
+}
+
+type result struct {
+	status  int
+	latency time.Duration
+}
+
+func (m *Mirror) serveShadow(req *http.Request, primaryResult chan result) {
+	defer func() {
+		<-m.slots
+	}()
+	//but not forever
+	var ctx, cancel = context.WithTimeout(req.Context(), m.shadowTimeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+	var writer = &discardWriter{header: http.Header{}}
+	var start = time.Now()
+	func() {
+		//A misbehaving shadow must never take the proxy down with it
+		defer func() {
+			if recover() != nil {
+				writer.WriteHeader(http.StatusInternalServerError)
+			}
+		}()
+		m.shadow.ServeHTTP(writer, req)
+	}()
+	var shadowLatency = time.Since(start)
+	var primary = <-primaryResult
+	var diff = Diff{
+		Method:         req.Method,
+		Path:           req.URL.Path,
+		PrimaryStatus:  primary.status,
+		ShadowStatus:   writer.statusCode(),
+		PrimaryLatency: primary.latency,
+		ShadowLatency:  shadowLatency,
+	}
+	m.count(func(s *Stats) {
+		s.Mirrored++
+		if !diff.StatusMatches() {
+			s.StatusMismatches++
+		}
+		s.TotalLatencyDiff += diff.ShadowLatency - diff.PrimaryLatency
+	})
+	if m.onDiff != nil {
+		m.onDiff(diff)
+	}
+}
+
+func (m *Mirror) count(update func(s *Stats)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	update(&m.stats)
+}
+
+//Add a url to the primary loadbalancer
+func (m *Mirror) Add(u *url.URL) error {
+	return m.primary.Add(u)
+}
+
+//Remove a url from the primary loadbalancer.
+func (m *Mirror) Remove(u *url.URL) error {
+	return m.primary.Remove(u)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+//discardWriter throws away the shadow's response, keeping only its status
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (d *discardWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardWriter) Write(b []byte) (int, error) {
+	if d.status == 0 {
+		d.status = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (d *discardWriter) WriteHeader(status int) {
+	if d.status == 0 {
+		d.status = status
+	}
+}
+
+func (d *discardWriter) statusCode() int {
+	if d.status == 0 {
+		return http.StatusOK
+	}
+	return d.status
+}
@@ -0,0 +1,138 @@
+package mirror
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/jangie/goloadbalancers/jsq"
+	"github.com/jangie/goloadbalancers/util"
+)
+
+func newPool(host string, handler http.HandlerFunc) *jsq.JoinShortestQueueBalancer {
+	var u, _ = url.Parse(host)
+	return jsq.NewJoinShortestQueueBalancer([]url.URL{*u}, jsq.JoinShortestQueueBalancerOptions{}, handler)
+}
+
+func TestMirrorImplements(t *testing.T) {
+	var loadbalancer util.LoadBalancer
+	loadbalancer = NewMirror(newPool("http://primary", nil), nil, MirrorOptions{})
+	loadbalancer.ServeHTTP(nil, nil)
+}
+
+func TestMirrorCopiesRequestsToShadow(t *testing.T) {
+	var lock sync.Mutex
+	var shadowBodies []string
+	var primary = newPool("http://primary", func(w http.ResponseWriter, req *http.Request) {
+		var body, _ = io.ReadAll(req.Body)
+		w.Write([]byte("primary saw " + string(body)))
+	})
+	var shadow = newPool("http://shadow", func(w http.ResponseWriter, req *http.Request) {
+		var body, _ = io.ReadAll(req.Body)
+		lock.Lock()
+		shadowBodies = append(shadowBodies, string(body))
+		lock.Unlock()
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("shadow response"))
+	})
+	var diffs = make(chan Diff, 1)
+	var m = NewMirror(primary, shadow, MirrorOptions{
+		SampleRate: 1,
+		OnDiff: func(d Diff) {
+			diffs <- d
+		},
+	})
+	var recorder = httptest.NewRecorder()
+	m.ServeHTTP(recorder, httptest.NewRequest("POST", "/things", strings.NewReader("hello")))
+	if recorder.Body.String() != "primary saw hello" {
+		t.Fatalf("The client should only see the primary's response, got %q", recorder.Body.String())
+	}
+	var diff = <-diffs
+	if diff.PrimaryStatus != http.StatusOK || diff.ShadowStatus != http.StatusInternalServerError || diff.StatusMatches() {
+		t.Fatalf("Unexpected diff: %+v", diff)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(shadowBodies) != 1 || shadowBodies[0] != "hello" {
+		t.Fatalf("The shadow should see a copy of the request body, saw %v", shadowBodies)
+	}
+	var stats = m.Stats()
+	if stats.Mirrored != 1 || stats.StatusMismatches != 1 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestMirrorSkipsLargeBodies(t *testing.T) {
+	var primaryBody string
+	var primary = newPool("http://primary", func(w http.ResponseWriter, req *http.Request) {
+		var body, _ = io.ReadAll(req.Body)
+		primaryBody = string(body)
+	})
+	var shadow = newPool("http://shadow", func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("A request with a body over the limit should not be mirrored")
+	})
+	var m = NewMirror(primary, shadow, MirrorOptions{SampleRate: 1, MaxBodyBytes: 4})
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader("too long")))
+	if primaryBody != "too long" {
+		t.Fatalf("The primary should still see the whole body, saw %q", primaryBody)
+	}
+	if m.Stats().SkippedBody != 1 {
+		t.Fatalf("Expected the skipped body to be counted")
+	}
+}
+
+func TestMirrorBoundsShadowConcurrency(t *testing.T) {
+	var release = make(chan struct{})
+	var started = make(chan struct{})
+	var primary = newPool("http://primary", func(w http.ResponseWriter, req *http.Request) {})
+	var shadow = newPool("http://shadow", func(w http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+	})
+	var done = make(chan Diff, 1)
+	var m = NewMirror(primary, shadow, MirrorOptions{
+		SampleRate:     1,
+		MaxConcurrency: 1,
+		OnDiff: func(d Diff) {
+			done <- d
+		},
+	})
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	<-started
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	close(release)
+	<-done
+	if m.Stats().SkippedBusy != 1 {
+		t.Fatalf("Expected the second request to be skipped while the shadow was busy")
+	}
+}
+
+func TestMirrorSamples(t *testing.T) {
+	var primary = newPool("http://primary", func(w http.ResponseWriter, req *http.Request) {})
+	var shadow = newPool("http://shadow", func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("A request which wasn't sampled should not be mirrored")
+	})
+	var m = NewMirror(primary, shadow, MirrorOptions{
+		SampleRate:      0.5,
+		RandomGenerator: &util.TestingRandom{Values: []int{5000}},
+	})
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+}
+
+func TestMirrorLetsThePrimaryFlushAndHijack(t *testing.T) {
+	var flushed, hijacked bool
+	var primary = newPool("http://primary", func(w http.ResponseWriter, req *http.Request) {
+		_, flushed = w.(http.Flusher)
+		_, hijacked = w.(http.Hijacker)
+	})
+	var shadow = newPool("http://shadow", func(w http.ResponseWriter, req *http.Request) {})
+	var m = NewMirror(primary, shadow, MirrorOptions{SampleRate: 1})
+	m.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !flushed || !hijacked {
+		t.Fatalf("Expected the primary to reach flushing and hijacking through the mirror, got %v and %v", flushed, hijacked)
+	}
+}
@@ -0,0 +1,52 @@
+package random
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/jangie/goloadbalancers/lbtest"
+	"github.com/jangie/goloadbalancers/util"
+)
+
+func TestRandomImplements(t *testing.T) {
+	var loadbalancer util.LoadBalancer
+	loadbalancer = NewRandomBalancer([]url.URL{}, RandomBalancerOptions{}, nil)
+	loadbalancer.ServeHTTP(nil, nil)
+}
+
+func benchmarkParallelServeHTTP(b *testing.B, randomGenerator util.RandomInt) {
+	lbtest.BenchmarkParallelServeHTTP(b, func(balancees []url.URL, next http.Handler) util.LoadBalancer {
+		return NewRandomBalancer(balancees, RandomBalancerOptions{RandomGenerator: randomGenerator}, next)
+	}, 4)
+}
+
+func BenchmarkParallelServeHTTPGoRandom(b *testing.B) {
+	benchmarkParallelServeHTTP(b, util.GoRandom{})
+}
+
+func BenchmarkParallelServeHTTPShardedRandom(b *testing.B) {
+	benchmarkParallelServeHTTP(b, util.NewShardedRandom(1, 0))
+}
+
+func BenchmarkParallelServeHTTPCryptoRandom(b *testing.B) {
+	benchmarkParallelServeHTTP(b, util.CryptoRandom{})
+}
+
+func BenchmarkParallelServeHTTPSafeTestingRandom(b *testing.B) {
+	benchmarkParallelServeHTTP(b, &util.SafeTestingRandom{Values: []int{0, 1, 2, 3}})
+}
+
+func TestRandomConformance(t *testing.T) {
+	lbtest.Run(t, func(balancees []url.URL, next http.Handler) util.LoadBalancer {
+		return NewRandomBalancer(balancees, RandomBalancerOptions{}, next)
+	})
+}
+
+func BenchmarkRandomPick4(b *testing.B) {
+	lbtest.BenchmarkPicker(b, &RandomPicker{RandomGenerator: util.NewShardedRandom(1, 0)}, 4)
+}
+
+func BenchmarkRandomPick64(b *testing.B) {
+	lbtest.BenchmarkPicker(b, &RandomPicker{RandomGenerator: util.NewShardedRandom(1, 0)}, 64)
+}
@@ -0,0 +1,182 @@
+package ratelimit
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//KeyExtractor gives back the key a request is rate limited by. Requests for which it errors are turned away with a 400.
+type KeyExtractor func(req *http.Request) (string, error)
+
+//ClientIP keys requests by the IP address they came from
+func ClientIP(req *http.Request) (string, error) {
+	var host, _, err = net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return "", fmt.Errorf("Unable to find the client IP in %q", req.RemoteAddr)
+	}
+	return host, nil
+}
+
+//Header keys requests by the value of a header, such as an API key. Requests without the header are all limited together.
+func Header(name string) KeyExtractor {
+	return func(req *http.Request) (string, error) {
+		return req.Header.Get(name), nil
+	}
+}
+
+//RateLimiter sits in front of a balancer, turning away clients which have used up their token bucket with a 429
+//before a balancee is ever chosen
+type RateLimiter struct {
+	next    util.LoadBalancer
+	rate    float64
+	burst   int
+	maxKeys int
+	keyFunc KeyExtractor
+	now     func() time.Time
+	buckets map[string]*list.Element
+	recency *list.List
+	lock    *sync.Mutex
+}
+
+type RateLimiterOptions struct {
+	//Rate is the number of requests per second each key may sustain
+	Rate float64
+	//Burst is the most requests a key may make at once. Defaults to the rate, rounded up.
+	Burst int
+	//MaxKeys bounds memory by forgetting the least recently seen keys. Defaults to 10000.
+	MaxKeys int
+	//KeyExtractor defaults to ClientIP
+	KeyExtractor KeyExtractor
+	//Now defaults to time.Now, and exists for testing
+	Now func() time.Time
+}
+
+type bucket struct {
+	key     string
+	tokens  float64
+	updated time.Time
+}
+
+//NewRateLimiter gives a new RateLimiter back
+func NewRateLimiter(next util.LoadBalancer, options RateLimiterOptions) *RateLimiter {
+	var r = RateLimiter{
+		next:    next,
+		rate:    options.Rate,
+		burst:   options.Burst,
+		maxKeys: options.MaxKeys,
+		keyFunc: options.KeyExtractor,
+		now:     options.Now,
+		buckets: make(map[string]*list.Element),
+		recency: list.New(),
+		lock:    &sync.Mutex{},
+	}
+	if r.burst <= 0 {
+		r.burst = int(math.Ceil(r.rate))
+	}
+	if r.burst <= 0 {
+		r.burst = 1
+	}
+	if r.maxKeys <= 0 {
+		r.maxKeys = 10000
+	}
+	if r.keyFunc == nil {
+		r.keyFunc = ClientIP
+	}
+	if r.now == nil {
+		r.now = time.Now
+	}
+	return &r
+}
+
+//take tries to take a token from key's bucket, giving back whether it could, the tokens left, and how long until the
+//next token and a full bucket
+func (r *RateLimiter) take(key string) (bool, int, time.Duration, time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var now = r.now()
+	var b *bucket
+	if element, ok := r.buckets[key]; ok {
+		r.recency.MoveToFront(element)
+		b = element.Value.(*bucket)
+		b.tokens = math.Min(float64(r.burst), b.tokens+now.Sub(b.updated).Seconds()*r.rate)
+		b.updated = now
+	} else {
+		b = &bucket{key: key, tokens: float64(r.burst), updated: now}
+		r.buckets[key] = r.recency.PushFront(b)
+		for r.recency.Len() > r.maxKeys {
+			var oldest = r.recency.Back()
+			r.recency.Remove(oldest)
+			delete(r.buckets, oldest.Value.(*bucket).key)
+		}
+	}
+	var allowed = b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return allowed, int(b.tokens), r.wait(1 - b.tokens), r.wait(float64(r.burst) - b.tokens)
+}
+
+//wait gives back how long it takes to refill a number of tokens
+func (r *RateLimiter) wait(tokens float64) time.Duration {
+	if tokens <= 0 {
+		return 0
+	}
+	if r.rate <= 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(tokens / r.rate * float64(time.Second))
+}
+
+//NumberOfKeys returns the number of keys whose buckets are being remembered
+func (r *RateLimiter) NumberOfKeys() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.recency.Len()
+}
+
+func (r *RateLimiter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if w == nil || req == nil {
+		return
+	}
+	var key, err = r.keyFunc(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var allowed, remaining, untilNext, untilFull = r.take(key)
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(r.burst))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(seconds(untilFull)))
+	if !allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(seconds(untilNext)))
+		http.Error(w, "rate limit exceeded, please slow down.", http.StatusTooManyRequests)
+		return
+	}
+	if r.next != nil {
+		r.next.ServeHTTP(w, req)
+	}
+}
+
+//seconds rounds a duration up to whole seconds, as the rate limit headers want
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+//Add a url to the wrapped loadbalancer
+func (r *RateLimiter) Add(u *url.URL) error {
+	return r.next.Add(u)
+}
+
+//Remove a url from the wrapped loadbalancer.
+func (r *RateLimiter) Remove(u *url.URL) error {
+	return r.next.Remove(u)
+}
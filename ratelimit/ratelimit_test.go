@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jangie/goloadbalancers/jsq"
+	"github.com/jangie/goloadbalancers/util"
+)
+
+var urlA, _ = url.Parse("http://a")
+
+type testClock struct {
+	now time.Time
+}
+
+func (t *testClock) Now() time.Time {
+	return t.now
+}
+
+func newTestLimiter(options RateLimiterOptions) (*RateLimiter, *testClock) {
+	var clock = &testClock{now: time.Unix(0, 0)}
+	options.Now = clock.Now
+	var balancer = jsq.NewJoinShortestQueueBalancer([]url.URL{*urlA}, jsq.JoinShortestQueueBalancerOptions{}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	return NewRateLimiter(balancer, options), clock
+}
+
+func serve(r *RateLimiter, remoteAddr string) *httptest.ResponseRecorder {
+	var req = httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = remoteAddr
+	var recorder = httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestRateLimiterImplements(t *testing.T) {
+	var loadbalancer util.LoadBalancer
+	loadbalancer, _ = newTestLimiter(RateLimiterOptions{Rate: 1})
+	loadbalancer.ServeHTTP(nil, nil)
+}
+
+func TestRateLimiterAllowsBurstThenLimits(t *testing.T) {
+	var limiter, clock = newTestLimiter(RateLimiterOptions{Rate: 1, Burst: 3})
+	var i = 0
+	for ; i < 3; i++ {
+		if code := serve(limiter, "10.0.0.1:1234").Code; code != http.StatusOK {
+			t.Fatalf("Request %d within the burst was turned away with %d", i, code)
+		}
+	}
+	var recorder = serve(limiter, "10.0.0.1:1234")
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected a 429 once the burst was used up, got %d", recorder.Code)
+	}
+	if recorder.Header().Get("Retry-After") != "1" || recorder.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("Unexpected rate limit headers: %v", recorder.Header())
+	}
+	if serve(limiter, "10.0.0.2:1234").Code != http.StatusOK {
+		t.Fatalf("Another client should have its own bucket")
+	}
+	clock.now = clock.now.Add(time.Second)
+	if serve(limiter, "10.0.0.1:1234").Code != http.StatusOK {
+		t.Fatalf("The bucket should have refilled a token after a second")
+	}
+}
+
+func TestRateLimiterByHeader(t *testing.T) {
+	var limiter, _ = newTestLimiter(RateLimiterOptions{Rate: 1, KeyExtractor: Header("X-Api-Key")})
+	var req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Api-Key", "one")
+	limiter.ServeHTTP(httptest.NewRecorder(), req)
+	var recorder = httptest.NewRecorder()
+	limiter.ServeHTTP(recorder, req)
+	if recorder.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected requests with the same key to share a bucket, got %d", recorder.Code)
+	}
+}
+
+func TestRateLimiterEvictsLeastRecentlySeenKeys(t *testing.T) {
+	var limiter, _ = newTestLimiter(RateLimiterOptions{Rate: 1, MaxKeys: 2})
+	serve(limiter, "10.0.0.1:1")
+	serve(limiter, "10.0.0.2:1")
+	serve(limiter, "10.0.0.3:1")
+	if limiter.NumberOfKeys() != 2 {
+		t.Fatalf("Expected 2 keys to be remembered, had %d", limiter.NumberOfKeys())
+	}
+	if serve(limiter, "10.0.0.1:1").Code != http.StatusOK {
+		t.Fatalf("The least recently seen key should have been forgotten, and so given a fresh bucket")
+	}
+}
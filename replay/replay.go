@@ -0,0 +1,242 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jangie/goloadbalancers/bestof"
+	"github.com/jangie/goloadbalancers/jsq"
+	"github.com/jangie/goloadbalancers/random"
+	"github.com/jangie/goloadbalancers/simulate"
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//Mode is how a trace is replayed
+type Mode int
+
+const (
+	//Simulated replays the trace in simulated time with the simulate package, which is fast and deterministic
+	Simulated Mode = iota
+	//RealTime replays the trace against real httptest backends, through real HTTP, as the clock passes
+	RealTime
+)
+
+//latencyHeader tells a real-time backend how long to take over a request
+const latencyHeader = "X-Replay-Latency"
+
+//Backend describes a backend the trace is replayed against
+type Backend struct {
+	Name string
+	//Slowdown multiplies the trace's latencies for this backend. Defaults to 1.
+	Slowdown float64
+	//Workers is the number of requests the backend serves at once when Simulated. Defaults to 1. Real-time backends
+	//serve every request at once.
+	Workers int
+}
+
+//Options control how a trace is replayed
+type Options struct {
+	Mode     Mode
+	Backends []Backend
+	//Seed decides every random choice when Simulated
+	Seed int64
+	//Speed compresses time when replaying in RealTime, so 10 replays a trace ten times faster. Defaults to 1.
+	Speed float64
+	//KeyHeader is the header trace entries' keys are sent in. Defaults to X-Request-Key.
+	KeyHeader string
+}
+
+//Algorithm is a named way of building a balancer to replay a trace through
+type Algorithm struct {
+	Name        string
+	NewBalancer simulate.BalancerFactory
+}
+
+//Result is how one algorithm did
+type Result struct {
+	Algorithm string
+	Report    *simulate.Report
+}
+
+//DefaultAlgorithms gives back the random, jsq and bestof balancers, with their default options
+func DefaultAlgorithms() []Algorithm {
+	return []Algorithm{
+		{Name: "random", NewBalancer: func(balancees []url.URL, randomGenerator util.RandomInt, next http.Handler) util.LoadBalancer {
+			return random.NewRandomBalancer(balancees, random.RandomBalancerOptions{RandomGenerator: randomGenerator}, next)
+		}},
+		{Name: "jsq", NewBalancer: func(balancees []url.URL, randomGenerator util.RandomInt, next http.Handler) util.LoadBalancer {
+			return jsq.NewJoinShortestQueueBalancer(balancees, jsq.JoinShortestQueueBalancerOptions{}, next)
+		}},
+		{Name: "bestof", NewBalancer: func(balancees []url.URL, randomGenerator util.RandomInt, next http.Handler) util.LoadBalancer {
+			return bestof.NewChoiceOfBalancer(balancees, bestof.ChoiceOfBalancerOptions{RandomGenerator: randomGenerator}, next)
+		}},
+	}
+}
+
+//Compare replays the same trace through each algorithm in turn
+func Compare(entries []TraceEntry, algorithms []Algorithm, options Options) ([]Result, error) {
+	var results []Result
+	for _, algorithm := range algorithms {
+		var report, err = Replay(entries, algorithm.NewBalancer, options)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to replay the trace through %s: %s", algorithm.Name, err)
+		}
+		results = append(results, Result{Algorithm: algorithm.Name, Report: report})
+	}
+	return results, nil
+}
+
+//Replay feeds a trace through a balancer, giving back a report of how it did. Latencies in the report are in the
+//trace's time, whatever the Speed.
+func Replay(entries []TraceEntry, newBalancer simulate.BalancerFactory, options Options) (*simulate.Report, error) {
+	if len(options.Backends) == 0 {
+		return nil, fmt.Errorf("A replay needs at least one backend")
+	}
+	if options.KeyHeader == "" {
+		options.KeyHeader = "X-Request-Key"
+	}
+	if options.Mode == RealTime {
+		return replayRealTime(entries, newBalancer, options)
+	}
+	var backends []simulate.Backend
+	for _, backend := range options.Backends {
+		backends = append(backends, simulate.Backend{
+			Name:     backend.Name,
+			Slowdown: backend.Slowdown,
+			Workers:  backend.Workers,
+		})
+	}
+	var arrivals = &traceArrivals{entries: entries, keyHeader: options.KeyHeader}
+	var report, err = simulate.Run(simulate.Config{
+		Seed:        options.Seed,
+		Backends:    backends,
+		Arrivals:    arrivals,
+		NewBalancer: newBalancer,
+	})
+	if err == nil {
+		err = arrivals.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+//replayRealTime starts an httptest server per backend, which takes as long over each request as the trace says, and
+//sends the trace through the balancer to them as the clock passes
+func replayRealTime(entries []TraceEntry, newBalancer simulate.BalancerFactory, options Options) (*simulate.Report, error) {
+	if options.Speed <= 0 {
+		options.Speed = 1
+	}
+	var balancees []url.URL
+	var names = make(map[string]int)
+	var reports = make([]simulate.BackendReport, len(options.Backends))
+	for index, backend := range options.Backends {
+		var slowdown = backend.Slowdown
+		if slowdown <= 0 {
+			slowdown = 1
+		}
+		var server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			var latency, _ = strconv.ParseInt(req.Header.Get(latencyHeader), 10, 64)
+			time.Sleep(time.Duration(float64(latency) * slowdown))
+		}))
+		defer server.Close()
+		var u, _ = url.Parse(server.URL)
+		balancees = append(balancees, *u)
+		names[u.Host] = index
+		reports[index].Name = backend.Name
+	}
+
+	var lock sync.Mutex
+	var client = &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 1000}}
+	var forward = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var outgoing, err = http.NewRequestWithContext(req.Context(), req.Method, req.URL.String(), nil)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		outgoing.Header = req.Header.Clone()
+		lock.Lock()
+		var index, known = names[req.URL.Host]
+		if known {
+			reports[index].Requests++
+		}
+		lock.Unlock()
+		var resp, doErr = client.Do(outgoing)
+		if doErr != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if known && resp.StatusCode < 400 {
+			lock.Lock()
+			reports[index].Completed++
+			lock.Unlock()
+		}
+		w.WriteHeader(resp.StatusCode)
+	})
+	var balancer = newBalancer(balancees, util.NewShardedRandom(options.Seed, 0), forward)
+
+	var report = &simulate.Report{Requests: len(entries)}
+	var latencies []time.Duration
+	var wg sync.WaitGroup
+	var start = time.Now()
+	for index, entry := range entries {
+		var offset = time.Duration(float64(entry.Timestamp.Sub(entries[0].Timestamp)) / options.Speed)
+		time.Sleep(time.Until(start.Add(offset)))
+		var req, err = entryRequest(entries, index, options.KeyHeader)
+		if err != nil {
+			//Let the requests already sent finish before giving up on the replay
+			wg.Wait()
+			return nil, err
+		}
+		req.Header.Set(latencyHeader, strconv.FormatInt(int64(float64(entry.Latency())/options.Speed), 10))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var recorder = httptest.NewRecorder()
+			var sent = time.Now()
+			balancer.ServeHTTP(recorder, req)
+			var latency = time.Duration(float64(time.Since(sent)) * options.Speed)
+			lock.Lock()
+			defer lock.Unlock()
+			if recorder.Code < 400 {
+				report.Completed++
+				latencies = append(latencies, latency)
+			} else {
+				report.Rejected++
+			}
+		}()
+	}
+	wg.Wait()
+	report.Duration = time.Duration(float64(time.Since(start)) * options.Speed)
+	report.Latency = simulate.Summarize(latencies)
+	report.Backends = reports
+	var requests []float64
+	for _, backend := range reports {
+		requests = append(requests, float64(backend.Requests))
+	}
+	report.RequestFairness = simulate.JainIndex(requests)
+	return report, nil
+}
+
+//WriteComparison writes a table comparing how each algorithm did
+func WriteComparison(w io.Writer, results []Result) error {
+	var _, err = fmt.Fprintf(w, "%-12s %10s %10s %10s %10s %10s %10s %9s\n", "algorithm", "completed", "rejected", "failed", "p50", "p99", "queue p99", "fairness")
+	for _, result := range results {
+		if err != nil {
+			return err
+		}
+		var r = result.Report
+		_, err = fmt.Fprintf(w, "%-12s %10d %10d %10d %10s %10s %10s %9.3f\n", result.Algorithm, r.Completed, r.Rejected, r.Failed,
+			r.Latency.P50.Round(time.Microsecond), r.Latency.P99.Round(time.Microsecond), r.QueueDelay.P99.Round(time.Microsecond), r.RequestFairness)
+	}
+	return err
+}
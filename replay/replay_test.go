@@ -0,0 +1,135 @@
+package replay
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+const sampleTrace = `
+{"timestamp":"2016-05-01T12:00:00.100Z","method":"POST","path":"/b","latency_ms":20}
+{"timestamp":"2016-05-01T12:00:00.000Z","path":"/a?x=1","headers":{"Accept":"text/plain"},"key":"user-1","latency_ms":10}
+
+{"timestamp":"2016-05-01T12:00:00.200Z","latency_ms":5}
+`
+
+func syntheticTrace(seed int64, count int) []TraceEntry {
+	var r = rand.New(rand.NewSource(seed))
+	var entries []TraceEntry
+	var at = time.Date(2016, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < count; i++ {
+		at = at.Add(time.Duration(r.ExpFloat64() * float64(2*time.Millisecond)))
+		entries = append(entries, TraceEntry{
+			Timestamp:     at,
+			Path:          fmt.Sprintf("/item/%d", i),
+			Key:           fmt.Sprintf("user-%d", r.Intn(100)),
+			LatencyMillis: r.ExpFloat64() * 10,
+		})
+	}
+	return entries
+}
+
+func TestReadTrace(t *testing.T) {
+	var entries, err = ReadTrace(strings.NewReader(sampleTrace))
+	if err != nil {
+		t.Fatalf("Unexpected error reading trace: %s", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+	if entries[0].Path != "/a?x=1" || entries[1].Method != "POST" {
+		t.Fatalf("Expected entries to be sorted by timestamp, got %+v", entries)
+	}
+	if entries[0].Latency() != 10*time.Millisecond {
+		t.Fatalf("Unexpected latency %s", entries[0].Latency())
+	}
+	var req, _ = entries[0].request("X-Request-Key")
+	if req.Method != "GET" || req.URL.Query().Get("x") != "1" || req.Header.Get("Accept") != "text/plain" || req.Header.Get("X-Request-Key") != "user-1" {
+		t.Fatalf("The entry's request was not built as recorded: %+v", req)
+	}
+	if _, err := ReadTrace(strings.NewReader(`{"latency_ms":1}`)); err == nil {
+		t.Fatalf("An entry without a timestamp should be an error")
+	}
+	for _, line := range []string{
+		`{"timestamp":"2016-05-01T12:00:00Z","path":"/%zz"}`,
+		`{"timestamp":"2016-05-01T12:00:00Z","method":"GET IT"}`,
+	} {
+		var _, err = ReadTrace(strings.NewReader(sampleTrace + line))
+		if err == nil || !strings.Contains(err.Error(), "line 6") {
+			t.Fatalf("Expected the malformed request on line 6 to be reported, got %v", err)
+		}
+	}
+	var bad = []TraceEntry{{Timestamp: time.Now()}, {Timestamp: time.Now(), Path: "/%zz"}}
+	for _, mode := range []Mode{Simulated, RealTime} {
+		var _, err = Replay(bad, DefaultAlgorithms()[0].NewBalancer, Options{Mode: mode, Backends: []Backend{{Name: "a"}}})
+		if err == nil || !strings.Contains(err.Error(), "entry 2") {
+			t.Fatalf("Replaying a malformed entry should report it, not send a nil request, got %v", err)
+		}
+	}
+}
+
+func TestWriteTraceRoundTrips(t *testing.T) {
+	var entries = syntheticTrace(1, 10)
+	var buffer bytes.Buffer
+	WriteTrace(&buffer, entries)
+	var read, _ = ReadTrace(&buffer)
+	if len(read) != 10 || !read[9].Timestamp.Equal(entries[9].Timestamp) || read[9].Key != entries[9].Key {
+		t.Fatalf("Trace did not survive being written and read back")
+	}
+}
+
+func TestCompareSimulated(t *testing.T) {
+	var options = Options{
+		Backends: []Backend{
+			{Name: "fast", Workers: 2},
+			{Name: "slow", Workers: 2, Slowdown: 4},
+		},
+	}
+	var results, err = Compare(syntheticTrace(2, 3000), DefaultAlgorithms(), options)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected a result per algorithm")
+	}
+	var byName = make(map[string]Result)
+	for _, result := range results {
+		if result.Report.Completed != 3000 {
+			t.Fatalf("%s did not complete every request: %+v", result.Algorithm, result.Report)
+		}
+		byName[result.Algorithm] = result
+	}
+	if byName["jsq"].Report.Latency.P99 >= byName["random"].Report.Latency.P99 {
+		t.Fatalf("Expected jsq to beat random when one backend is slow")
+	}
+	var again, _ = Compare(syntheticTrace(2, 3000), DefaultAlgorithms(), options)
+	if again[2].Report.Latency != results[2].Report.Latency {
+		t.Fatalf("Simulated replays should be deterministic")
+	}
+	var buffer bytes.Buffer
+	WriteComparison(&buffer, results)
+	if !strings.Contains(buffer.String(), "bestof") {
+		t.Fatalf("Expected every algorithm in the comparison:\n%s", buffer.String())
+	}
+}
+
+func TestReplayRealTime(t *testing.T) {
+	var entries = syntheticTrace(3, 50)
+	var report, err = Replay(entries, DefaultAlgorithms()[1].NewBalancer, Options{
+		Mode:     RealTime,
+		Speed:    10,
+		Backends: []Backend{{Name: "a"}, {Name: "b"}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if report.Completed != 50 {
+		t.Fatalf("Expected every request to complete, got %+v", report)
+	}
+	if report.Backends[0].Requests+report.Backends[1].Requests != 50 {
+		t.Fatalf("Expected every request to be counted against a backend: %+v", report.Backends)
+	}
+}
@@ -0,0 +1,150 @@
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jangie/goloadbalancers/simulate"
+)
+
+//TraceEntry is one line of a JSONL trace, recording a request as it was seen in production:
+//
+//	{"timestamp":"2016-05-01T12:00:00.250Z","method":"GET","path":"/users/1","headers":{"Accept":"application/json"},"key":"user-1","latency_ms":12.5}
+type TraceEntry struct {
+	//Timestamp is when the request arrived
+	Timestamp time.Time `json:"timestamp"`
+	//Method defaults to GET
+	Method string `json:"method,omitempty"`
+	//Path, which may include a query string, defaults to /
+	Path    string            `json:"path,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	//Key identifies the client or user, for balancers which route on it. It is sent in the KeyHeader.
+	Key string `json:"key,omitempty"`
+	//LatencyMillis is how long the backend took to serve the request
+	LatencyMillis float64 `json:"latency_ms"`
+}
+
+//Latency gives back the entry's observed backend latency
+func (t TraceEntry) Latency() time.Duration {
+	return time.Duration(t.LatencyMillis * float64(time.Millisecond))
+}
+
+//request builds the http.Request the entry describes, failing if its method or path is not valid
+func (t TraceEntry) request(keyHeader string) (*http.Request, error) {
+	var method = t.Method
+	if method == "" {
+		method = "GET"
+	}
+	var path = t.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	var req, err = http.NewRequest(method, "http://example.com"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.RemoteAddr = "192.0.2.1:1234"
+	for name, value := range t.Headers {
+		req.Header.Set(name, value)
+	}
+	if t.Key != "" && keyHeader != "" {
+		req.Header.Set(keyHeader, t.Key)
+	}
+	return req, nil
+}
+
+//entryRequest builds the request for the entry at index, numbering it from 1 as trace lines are when it isn't valid
+func entryRequest(entries []TraceEntry, index int, keyHeader string) (*http.Request, error) {
+	var req, err = entries[index].request(keyHeader)
+	if err != nil {
+		return nil, fmt.Errorf("Trace entry %d is not a valid request: %s", index+1, err)
+	}
+	return req, nil
+}
+
+//ReadTrace reads a JSONL trace, one TraceEntry per line, skipping blank lines. Entries are given back in order of
+//their timestamps.
+func ReadTrace(r io.Reader) ([]TraceEntry, error) {
+	var entries []TraceEntry
+	var scanner = bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var line = 0
+	for scanner.Scan() {
+		line++
+		var text = strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var entry TraceEntry
+		if err := json.Unmarshal([]byte(text), &entry); err != nil {
+			return nil, fmt.Errorf("Unable to read trace line %d: %s", line, err)
+		}
+		if entry.Timestamp.IsZero() {
+			return nil, fmt.Errorf("Trace line %d has no timestamp", line)
+		}
+		if _, err := entry.request(""); err != nil {
+			return nil, fmt.Errorf("Trace line %d is not a valid request: %s", line, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Timestamp.Before(entries[j].Timestamp)
+	})
+	return entries, nil
+}
+
+//WriteTrace writes entries as a JSONL trace
+func WriteTrace(w io.Writer, entries []TraceEntry) error {
+	var encoder = json.NewEncoder(w)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//traceArrivals replays trace entries as simulate.RequestArrivals. They end early at an entry which isn't a valid
+//request, leaving why in err.
+type traceArrivals struct {
+	entries   []TraceEntry
+	keyHeader string
+	index     int
+	err       error
+}
+
+func (t *traceArrivals) NextArrival(r *rand.Rand) (simulate.Arrival, bool) {
+	if t.index >= len(t.entries) {
+		return simulate.Arrival{}, false
+	}
+	var entry = t.entries[t.index]
+	var req, err = entryRequest(t.entries, t.index, t.keyHeader)
+	if err != nil {
+		t.err = err
+		return simulate.Arrival{}, false
+	}
+	var arrival = simulate.Arrival{
+		Request: req,
+		Service: entry.Latency(),
+	}
+	if t.index > 0 {
+		arrival.Gap = entry.Timestamp.Sub(t.entries[t.index-1].Timestamp)
+	}
+	t.index++
+	return arrival, true
+}
+
+func (t *traceArrivals) Next(r *rand.Rand) (time.Duration, bool) {
+	var arrival, ok = t.NextArrival(r)
+	return arrival.Gap, ok
+}
@@ -0,0 +1,191 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//Rule sends matching requests to a pool. Every condition set on a rule must match; conditions left empty match
+//everything.
+type Rule struct {
+	//Name identifies the rule in errors
+	Name string
+	//Host matches the request's host, ignoring case and port. A leading "*." matches any subdomain.
+	Host string
+	//PathPrefix matches paths starting with it
+	PathPrefix string
+	//PathRegexp matches paths it finds a match in
+	PathRegexp *regexp.Regexp
+	//Methods matches any of the given methods
+	Methods []string
+	//Headers matches requests carrying each header with the given value, or with any value when the value is "*"
+	Headers map[string]string
+	//Query matches requests carrying each query parameter with the given value, or with any value when it is "*"
+	Query map[string]string
+	//Pool is where matching requests are sent
+	Pool util.LoadBalancer
+}
+
+//Matches reports whether the request meets every condition of the rule
+func (r *Rule) Matches(req *http.Request) bool {
+	if r.Host != "" && !matchHost(r.Host, req.Host) {
+		return false
+	}
+	if r.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+		return false
+	}
+	if r.PathRegexp != nil && !r.PathRegexp.MatchString(req.URL.Path) {
+		return false
+	}
+	if len(r.Methods) > 0 {
+		var matched = false
+		for _, method := range r.Methods {
+			if strings.EqualFold(method, req.Method) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	for name, value := range r.Headers {
+		var values, ok = req.Header[http.CanonicalHeaderKey(name)]
+		if !ok || !matchValue(value, values) {
+			return false
+		}
+	}
+	if len(r.Query) > 0 {
+		var query = req.URL.Query()
+		for name, value := range r.Query {
+			var values, ok = query[name]
+			if !ok || !matchValue(value, values) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func matchHost(pattern string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	pattern = strings.ToLower(pattern)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return host == pattern
+}
+
+func matchValue(want string, values []string) bool {
+	if want == "*" {
+		return true
+	}
+	for _, value := range values {
+		if value == want {
+			return true
+		}
+	}
+	return false
+}
+
+//Router dispatches each request to the pool of the first rule it matches, or to the default pool. Its rules can be
+//replaced at runtime; requests already dispatched carry on against the pool they were given.
+type Router struct {
+	rules       []Rule
+	defaultPool util.LoadBalancer
+	lock        *sync.RWMutex
+}
+
+//NewRouter gives a new Router back
+func NewRouter(rules []Rule, defaultPool util.LoadBalancer) (*Router, error) {
+	var r = Router{lock: &sync.RWMutex{}}
+	if err := r.SetRules(rules, defaultPool); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+//SetRules replaces the router's rules and default pool. The default pool may be nil, in which case unmatched requests
+//are answered with a 404.
+func (r *Router) SetRules(rules []Rule, defaultPool util.LoadBalancer) error {
+	for index, rule := range rules {
+		if rule.Pool == nil {
+			return fmt.Errorf("Rule %d (%q) has no pool", index, rule.Name)
+		}
+	}
+	var rulesCopy = make([]Rule, len(rules))
+	copy(rulesCopy, rules)
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.rules = rulesCopy
+	r.defaultPool = defaultPool
+	return nil
+}
+
+//Rules gives back a copy of the router's rules
+func (r *Router) Rules() []Rule {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	var rulesCopy = make([]Rule, len(r.rules))
+	copy(rulesCopy, r.rules)
+	return rulesCopy
+}
+
+//Route gives back the pool a request would be dispatched to, or nil if it matches nothing and there is no default
+func (r *Router) Route(req *http.Request) util.LoadBalancer {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for index := range r.rules {
+		if r.rules[index].Matches(req) {
+			return r.rules[index].Pool
+		}
+	}
+	return r.defaultPool
+}
+
+func (r *Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if w == nil || req == nil {
+		return
+	}
+	var pool = r.Route(req)
+	if pool == nil {
+		http.Error(w, "router has no rule matching this request.", http.StatusNotFound)
+		return
+	}
+	pool.ServeHTTP(w, req)
+}
+
+//Add a url to the default pool
+func (r *Router) Add(u *url.URL) error {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if r.defaultPool == nil {
+		return fmt.Errorf("There is no default pool to add %s to", u)
+	}
+	return r.defaultPool.Add(u)
+}
+
+//Remove a url from every pool.
+func (r *Router) Remove(u *url.URL) error {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, rule := range r.rules {
+		if err := rule.Pool.Remove(u); err != nil {
+			return err
+		}
+	}
+	if r.defaultPool != nil {
+		return r.defaultPool.Remove(u)
+	}
+	return nil
+}
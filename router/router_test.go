@@ -0,0 +1,107 @@
+package router
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+type namedPool struct {
+	name  string
+	added []*url.URL
+}
+
+func (n *namedPool) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte(n.name))
+}
+
+func (n *namedPool) Add(u *url.URL) error {
+	n.added = append(n.added, u)
+	return nil
+}
+
+func (n *namedPool) Remove(u *url.URL) error {
+	return nil
+}
+
+var api = &namedPool{name: "api"}
+var static = &namedPool{name: "static"}
+var admin = &namedPool{name: "admin"}
+var fallback = &namedPool{name: "default"}
+
+func route(r *Router, req *http.Request) string {
+	var recorder = httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+	return recorder.Body.String()
+}
+
+func TestRouterImplements(t *testing.T) {
+	var loadbalancer util.LoadBalancer
+	loadbalancer, _ = NewRouter(nil, nil)
+	loadbalancer.ServeHTTP(nil, nil)
+	var recorder = httptest.NewRecorder()
+	loadbalancer.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("Expected a 404 with no rules and no default pool, got %d", recorder.Code)
+	}
+}
+
+func TestRouterRejectsRulesWithoutPools(t *testing.T) {
+	if _, err := NewRouter([]Rule{{Name: "broken"}}, nil); err == nil {
+		t.Fatalf("A rule without a pool should be rejected")
+	}
+}
+
+func TestRouterMatchesRulesInOrder(t *testing.T) {
+	var r, _ = NewRouter([]Rule{
+		{Name: "admin", PathPrefix: "/api/admin", Headers: map[string]string{"X-Admin": "*"}, Pool: admin},
+		{Name: "api", Host: "*.example.com", PathPrefix: "/api", Methods: []string{"GET", "POST"}, Pool: api},
+		{Name: "static", PathRegexp: regexp.MustCompile(`\.(css|js)$`), Pool: static},
+		{Name: "debug", Query: map[string]string{"debug": "1"}, Pool: admin},
+	}, fallback)
+
+	var req = httptest.NewRequest("GET", "http://www.example.com:8080/api/admin/users", nil)
+	req.Header.Set("X-Admin", "yes")
+	if got := route(r, req); got != "admin" {
+		t.Fatalf("Expected the first matching rule to win, got %s", got)
+	}
+	if got := route(r, httptest.NewRequest("GET", "http://www.example.com/api/admin/users", nil)); got != "api" {
+		t.Fatalf("Expected a request missing a header to fall through to the next rule, got %s", got)
+	}
+	if got := route(r, httptest.NewRequest("DELETE", "http://www.example.com/api/things", nil)); got != "default" {
+		t.Fatalf("Expected a request with an unmatched method to go to the default pool, got %s", got)
+	}
+	if got := route(r, httptest.NewRequest("GET", "http://other.org/app.js", nil)); got != "static" {
+		t.Fatalf("Expected a regexp match, got %s", got)
+	}
+	if got := route(r, httptest.NewRequest("GET", "http://other.org/?debug=1", nil)); got != "admin" {
+		t.Fatalf("Expected a query match, got %s", got)
+	}
+}
+
+func TestRouterRulesAreReplaceable(t *testing.T) {
+	var r, _ = NewRouter([]Rule{{PathPrefix: "/api", Pool: api}}, fallback)
+	r.SetRules([]Rule{{PathPrefix: "/api", Pool: static}}, nil)
+	if got := route(r, httptest.NewRequest("GET", "/api", nil)); got != "static" {
+		t.Fatalf("Expected the new rules to be used, got %s", got)
+	}
+	var recorder = httptest.NewRecorder()
+	r.ServeHTTP(recorder, httptest.NewRequest("GET", "/other", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("Expected a 404 once the default pool is gone, got %d", recorder.Code)
+	}
+}
+
+func TestRouterAddsToDefaultPool(t *testing.T) {
+	var pool = &namedPool{name: "default"}
+	var r, _ = NewRouter([]Rule{{PathPrefix: "/api", Pool: api}}, pool)
+	var u, _ = url.Parse("http://a")
+	r.Add(u)
+	if len(pool.added) != 1 || len(api.added) != 0 {
+		t.Fatalf("Add should put urls into the default pool")
+	}
+}
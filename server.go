@@ -8,10 +8,10 @@ import (
 	_ "net/http/pprof"
 
 	"github.com/jangie/goloadbalancers/bestof"
+	"github.com/jangie/goloadbalancers/forward"
 	"github.com/jangie/goloadbalancers/jsq"
 	"github.com/jangie/goloadbalancers/random"
 	"github.com/jangie/goloadbalancers/util"
-	"github.com/vulcand/oxy/forward"
 	"github.com/vulcand/oxy/roundrobin"
 )
 
@@ -92,7 +92,7 @@ func getJSQHarness(balancees []url.URL, fwd http.Handler) *testHarness {
 }
 
 func main() {
-	var fwd, _ = forward.New()
+	var fwd = forward.New(forward.Options{})
 	var balanceesStrings = []string{"http://testa:8080", "http://testb:8080", "http://testc:8080"}
 	var balancees = []url.URL{}
 	for _, u := range balanceesStrings {
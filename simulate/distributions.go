@@ -0,0 +1,143 @@
+package simulate
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+//Distribution gives back random durations, such as how long a backend takes to serve a request
+type Distribution interface {
+	Sample(r *rand.Rand) time.Duration
+}
+
+//Constant always gives back the same duration
+type Constant time.Duration
+
+func (c Constant) Sample(r *rand.Rand) time.Duration {
+	return time.Duration(c)
+}
+
+//Exponential gives back durations exponentially distributed around a mean
+type Exponential time.Duration
+
+func (e Exponential) Sample(r *rand.Rand) time.Duration {
+	return time.Duration(r.ExpFloat64() * float64(e))
+}
+
+//Uniform gives back durations evenly spread between Min and Max
+type Uniform struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+func (u Uniform) Sample(r *rand.Rand) time.Duration {
+	if u.Max <= u.Min {
+		return u.Min
+	}
+	return u.Min + time.Duration(r.Int63n(int64(u.Max-u.Min)))
+}
+
+//LogNormal gives back long-tailed durations around a median, with Sigma controlling how long the tail is
+type LogNormal struct {
+	Median time.Duration
+	Sigma  float64
+}
+
+func (l LogNormal) Sample(r *rand.Rand) time.Duration {
+	return time.Duration(float64(l.Median) * math.Exp(r.NormFloat64()*l.Sigma))
+}
+
+//Arrivals gives back the gap before each request arrives, and false once there are no more
+type Arrivals interface {
+	Next(r *rand.Rand) (time.Duration, bool)
+}
+
+//Arrival is one request from a RequestArrivals
+type Arrival struct {
+	//Gap is the time since the previous arrival
+	Gap time.Duration
+	//Request, when set, is sent through the balancer in place of a plain GET /
+	Request *http.Request
+	//Service, when above zero, is how long the request takes to serve, in place of the backend's Service distribution.
+	//It is multiplied by the backend's Slowdown.
+	Service time.Duration
+}
+
+//RequestArrivals are Arrivals which also decide what each request looks like and how long it takes to serve, such as
+//when replaying recorded traffic. The simulator calls NextArrival in place of Next.
+type RequestArrivals interface {
+	Arrivals
+	NextArrival(r *rand.Rand) (Arrival, bool)
+}
+
+//Poisson arrivals come at an average Rate per second, independently of each other
+type Poisson struct {
+	Rate float64
+}
+
+func (p Poisson) Next(r *rand.Rand) (time.Duration, bool) {
+	if p.Rate <= 0 {
+		return 0, false
+	}
+	return time.Duration(r.ExpFloat64() / p.Rate * float64(time.Second)), true
+}
+
+//Bursty arrivals alternate between bursts, arriving as a Poisson process at BurstRate for BurstLength, and quiet
+//spells at QuietRate for QuietLength
+type Bursty struct {
+	BurstRate   float64
+	BurstLength time.Duration
+	QuietRate   float64
+	QuietLength time.Duration
+	elapsed     time.Duration
+}
+
+func (b *Bursty) Next(r *rand.Rand) (time.Duration, bool) {
+	var period = b.BurstLength + b.QuietLength
+	if period <= 0 {
+		return 0, false
+	}
+	var gap time.Duration
+	for {
+		var offset = b.elapsed % period
+		var rate, remaining = b.BurstRate, b.BurstLength - offset
+		if offset >= b.BurstLength {
+			rate, remaining = b.QuietRate, period-offset
+		}
+		if rate > 0 {
+			var next = time.Duration(r.ExpFloat64() / rate * float64(time.Second))
+			if next < remaining {
+				b.elapsed += next
+				return gap + next, true
+			}
+		}
+		//Nothing arrived before the phase changed; carry on from the start of the next phase
+		gap += remaining
+		b.elapsed += remaining
+		if b.BurstRate <= 0 && b.QuietRate <= 0 {
+			return 0, false
+		}
+	}
+}
+
+//Trace replays arrivals at fixed offsets from the start of the simulation, which must be in order
+type Trace struct {
+	Offsets []time.Duration
+	index   int
+	last    time.Duration
+}
+
+func (t *Trace) Next(r *rand.Rand) (time.Duration, bool) {
+	if t.index >= len(t.Offsets) {
+		return 0, false
+	}
+	var gap = t.Offsets[t.index] - t.last
+	if gap < 0 {
+		gap = 0
+	}
+	t.last = t.Offsets[t.index]
+	t.index++
+	return gap, true
+}
@@ -0,0 +1,127 @@
+package simulate
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+//Report is what a simulation found
+type Report struct {
+	//Requests is the number of requests that arrived
+	Requests int
+	//Completed is the number of requests a backend finished serving
+	Completed int
+	//Rejected is the number of requests the balancer turned away without choosing a backend
+	Rejected int
+	//Failed is the number of requests lost to a backend failing
+	Failed int
+	//Duration is the simulated time until the last request finished
+	Duration time.Duration
+	//QueueDelay is how long requests waited at a backend for a free worker
+	QueueDelay Percentiles
+	//Latency is how long completed requests took from arrival to completion
+	Latency  Percentiles
+	Backends []BackendReport
+	//RequestFairness is Jain's fairness index, between 1/n and 1, over the requests each backend got per worker
+	RequestFairness float64
+	//UtilizationFairness is Jain's fairness index, between 1/n and 1, over how busy each backend's workers were
+	UtilizationFairness float64
+}
+
+//BackendReport is what a simulation found about one backend
+type BackendReport struct {
+	Name      string
+	Workers   int
+	Requests  int
+	Completed int
+	Failed    int
+	//MaxQueue is the most requests that waited for a worker at once
+	MaxQueue int
+	//MeanInFlight is the time-averaged number of requests being served or queued
+	MeanInFlight float64
+	//Utilization is the share of time, between 0 and 1, the backend's workers were busy
+	Utilization float64
+
+	inFlightArea float64
+	busyArea     float64
+}
+
+//Percentiles summarize a set of durations
+type Percentiles struct {
+	P50  time.Duration
+	P90  time.Duration
+	P99  time.Duration
+	Max  time.Duration
+	Mean time.Duration
+}
+
+//Summarize gives back the percentiles of a set of durations
+func Summarize(durations []time.Duration) Percentiles {
+	if len(durations) == 0 {
+		return Percentiles{}
+	}
+	var sorted = make([]time.Duration, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	var rank = func(p float64) time.Duration {
+		var index = int(p*float64(len(sorted))+0.999999) - 1
+		if index < 0 {
+			index = 0
+		}
+		return sorted[index]
+	}
+	return Percentiles{
+		P50:  rank(0.5),
+		P90:  rank(0.9),
+		P99:  rank(0.99),
+		Max:  sorted[len(sorted)-1],
+		Mean: total / time.Duration(len(sorted)),
+	}
+}
+
+//JainIndex is Jain's fairness index, (sum x)^2 / (n * sum x^2), which is 1 when every value is the same and 1/n when
+//one value has everything
+func JainIndex(values []float64) float64 {
+	var sum, squares = 0.0, 0.0
+	for _, x := range values {
+		sum += x
+		squares += x * x
+	}
+	if squares == 0 {
+		return 1
+	}
+	return sum * sum / (float64(len(values)) * squares)
+}
+
+//WriteTo writes a human readable summary of the report
+func (r *Report) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	var printf = func(format string, args ...interface{}) error {
+		var n, err = fmt.Fprintf(w, format, args...)
+		written += int64(n)
+		return err
+	}
+	var err = printf("requests: %d completed, %d rejected, %d failed of %d over %s\n", r.Completed, r.Rejected, r.Failed, r.Requests, r.Duration)
+	if err == nil {
+		err = printf("queue delay: p50 %s, p90 %s, p99 %s, max %s\n", r.QueueDelay.P50, r.QueueDelay.P90, r.QueueDelay.P99, r.QueueDelay.Max)
+	}
+	if err == nil {
+		err = printf("latency: p50 %s, p90 %s, p99 %s, max %s\n", r.Latency.P50, r.Latency.P90, r.Latency.P99, r.Latency.Max)
+	}
+	if err == nil {
+		err = printf("fairness: requests %.3f, utilization %.3f\n", r.RequestFairness, r.UtilizationFairness)
+	}
+	for _, b := range r.Backends {
+		if err != nil {
+			break
+		}
+		err = printf(" - %s: %d requests, %.1f%% utilized, %.2f mean in flight, %d max queued\n", b.Name, b.Requests, b.Utilization*100, b.MeanInFlight, b.MaxQueue)
+	}
+	return written, err
+}
@@ -0,0 +1,424 @@
+package simulate
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//Backend describes a simulated backend server
+type Backend struct {
+	//Name is used as the backend's host, so balancees are http://<name>
+	Name string
+	//Service is how long the backend takes to serve each request, once one of its workers is free. It may be nil when
+	//the arrivals give every request's service time.
+	Service Distribution
+	//Slowdown multiplies service times given by the arrivals, to model a backend slower or faster than the one they
+	//were recorded against. Defaults to 1.
+	Slowdown float64
+	//Workers is the number of requests the backend serves at once; any more queue up in order. Defaults to 1.
+	Workers int
+	//StartDown leaves the backend out of the balancer until a Join event
+	StartDown bool
+}
+
+//EventKind is what happens to a backend during a simulation
+type EventKind int
+
+const (
+	//Fail takes a backend out of the balancer, failing every request it was serving or had queued
+	Fail EventKind = iota
+	//Join adds a backend to the balancer
+	Join
+)
+
+//Event changes a backend partway through a simulation
+type Event struct {
+	At      time.Duration
+	Kind    EventKind
+	Backend string
+}
+
+//BalancerFactory builds the balancer under test. It must forward to next, and should use random for any random
+//choices so that the simulation is reproducible.
+type BalancerFactory func(balancees []url.URL, random util.RandomInt, next http.Handler) util.LoadBalancer
+
+//Config describes a simulation. Everything about it is decided by Seed, so the same Config always gives back the
+//same Report.
+//
+//Balancers are driven one request at a time through their real ServeHTTP, so a balancer must either forward a
+//request or turn it away straight away; balancers which make requests wait, such as those with a wait queue, are
+//not supported.
+type Config struct {
+	Seed        int64
+	Backends    []Backend
+	Arrivals    Arrivals
+	NewBalancer BalancerFactory
+	//Requests stops arrivals after this many. Zero means no limit.
+	Requests int
+	//Duration stops arrivals after this much simulated time. Zero means no limit.
+	Duration time.Duration
+	Events   []Event
+}
+
+type simRequest struct {
+	id       int
+	request  *http.Request
+	service  time.Duration
+	arrived  time.Duration
+	queued   time.Duration
+	started  time.Duration
+	backend  *simBackend
+	wake     chan struct{}
+	done     chan struct{}
+	finished bool
+}
+
+type simBackend struct {
+	config   Backend
+	url      url.URL
+	up       bool
+	serving  []*simRequest
+	queue    []*simRequest
+	report   *BackendReport
+	lastTick time.Duration
+}
+
+type simulation struct {
+	config   Config
+	random   *rand.Rand
+	now      time.Duration
+	events   eventQueue
+	seq      int
+	balancer util.LoadBalancer
+	backends map[string]*simBackend
+	order    []*simBackend
+	arrivals chan arrival
+	report   *Report
+	delays   []time.Duration
+	latency  []time.Duration
+}
+
+type arrival struct {
+	id   int
+	host string
+	wake chan struct{}
+}
+
+//Run simulates the config, giving back a report of how the balancer did
+func Run(config Config) (*Report, error) {
+	if config.NewBalancer == nil {
+		return nil, fmt.Errorf("A simulation needs a NewBalancer")
+	}
+	if config.Arrivals == nil {
+		return nil, fmt.Errorf("A simulation needs Arrivals")
+	}
+	if config.Requests <= 0 && config.Duration <= 0 {
+		var _, isTrace = config.Arrivals.(*Trace)
+		var _, isRequestArrivals = config.Arrivals.(RequestArrivals)
+		if !isTrace && !isRequestArrivals {
+			return nil, fmt.Errorf("A simulation needs Requests or a Duration to know when to stop")
+		}
+	}
+	var s = simulation{
+		config:   config,
+		random:   rand.New(rand.NewSource(config.Seed)),
+		backends: make(map[string]*simBackend),
+		arrivals: make(chan arrival),
+		report:   &Report{},
+	}
+	var balancees []url.URL
+	for _, backend := range config.Backends {
+		if _, ok := s.backends[backend.Name]; ok {
+			return nil, fmt.Errorf("Backend %q is configured twice", backend.Name)
+		}
+		if backend.Workers <= 0 {
+			backend.Workers = 1
+		}
+		if backend.Service == nil {
+			if _, ok := config.Arrivals.(RequestArrivals); !ok {
+				return nil, fmt.Errorf("Backend %q has no Service distribution", backend.Name)
+			}
+		}
+		if backend.Slowdown <= 0 {
+			backend.Slowdown = 1
+		}
+		var b = &simBackend{
+			config: backend,
+			url:    url.URL{Scheme: "http", Host: backend.Name},
+			up:     !backend.StartDown,
+			report: &BackendReport{Name: backend.Name, Workers: backend.Workers},
+		}
+		s.backends[backend.Name] = b
+		s.order = append(s.order, b)
+		if b.up {
+			balancees = append(balancees, b.url)
+		}
+	}
+	s.balancer = config.NewBalancer(balancees, util.NewShardedRandom(config.Seed+1, 1), http.HandlerFunc(s.serveBackend))
+	for _, event := range config.Events {
+		var e = event
+		if _, ok := s.backends[e.Backend]; !ok {
+			return nil, fmt.Errorf("Event for unknown backend %q", e.Backend)
+		}
+		s.schedule(e.At, func() { s.backendEvent(e) })
+	}
+	s.scheduleArrival()
+	for s.events.Len() > 0 {
+		var e = heap.Pop(&s.events).(*event)
+		s.now = e.at
+		e.action()
+	}
+	s.finish()
+	return s.report, nil
+}
+
+//serveBackend is the balancer's next handler. It tells the simulator which backend was chosen, then waits until the
+//simulator decides the backend is done with the request.
+func (s *simulation) serveBackend(w http.ResponseWriter, req *http.Request) {
+	var wake = make(chan struct{})
+	s.arrivals <- arrival{host: req.URL.Host, wake: wake}
+	<-wake
+}
+
+func (s *simulation) schedule(at time.Duration, action func()) {
+	s.seq++
+	heap.Push(&s.events, &event{at: at, seq: s.seq, action: action})
+}
+
+func (s *simulation) scheduleArrival() {
+	if s.config.Requests > 0 && s.report.Requests >= s.config.Requests {
+		return
+	}
+	var next Arrival
+	var ok bool
+	if requestArrivals, isRequestArrivals := s.config.Arrivals.(RequestArrivals); isRequestArrivals {
+		next, ok = requestArrivals.NextArrival(s.random)
+	} else {
+		next.Gap, ok = s.config.Arrivals.Next(s.random)
+	}
+	if !ok {
+		return
+	}
+	var at = s.now + next.Gap
+	if s.config.Duration > 0 && at > s.config.Duration {
+		return
+	}
+	s.schedule(at, func() { s.arrive(next) })
+}
+
+//arrive sends a new request through the balancer, and waits to see whether it reaches a backend
+func (s *simulation) arrive(next Arrival) {
+	s.report.Requests++
+	var r = &simRequest{
+		id:      s.report.Requests,
+		request: next.Request,
+		service: next.Service,
+		arrived: s.now,
+		done:    make(chan struct{}),
+	}
+	if r.request == nil {
+		r.request = &http.Request{
+			Method:     "GET",
+			URL:        &url.URL{Path: "/"},
+			Header:     http.Header{},
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+		}
+	}
+	var writer = &discardWriter{header: http.Header{}}
+	go func() {
+		defer close(r.done)
+		s.balancer.ServeHTTP(writer, r.request)
+	}()
+	select {
+	case a := <-s.arrivals:
+		r.wake = a.wake
+		var backend, ok = s.backends[a.host]
+		if !ok || !backend.up {
+			//The balancer chose something that isn't a live backend; fail the request
+			s.report.Failed++
+			s.complete(r)
+		} else {
+			s.enqueue(backend, r)
+		}
+	case <-r.done:
+		s.report.Rejected++
+	}
+	s.scheduleArrival()
+}
+
+func (s *simulation) enqueue(b *simBackend, r *simRequest) {
+	s.tick(b)
+	r.backend = b
+	r.queued = s.now
+	b.report.Requests++
+	if len(b.serving) < b.config.Workers {
+		s.start(b, r)
+		return
+	}
+	b.queue = append(b.queue, r)
+	if len(b.queue) > b.report.MaxQueue {
+		b.report.MaxQueue = len(b.queue)
+	}
+}
+
+//start hands a request to one of the backend's free workers
+func (s *simulation) start(b *simBackend, r *simRequest) {
+	r.started = s.now
+	b.serving = append(b.serving, r)
+	s.delays = append(s.delays, r.started-r.queued)
+	var service time.Duration
+	if r.service > 0 {
+		service = time.Duration(float64(r.service) * b.config.Slowdown)
+	} else if b.config.Service != nil {
+		service = b.config.Service.Sample(s.random)
+	}
+	s.schedule(s.now+service, func() { s.finishService(b, r) })
+}
+
+//finishService completes a request, and starts the next one queued at the backend
+func (s *simulation) finishService(b *simBackend, r *simRequest) {
+	if r.finished {
+		//The backend failed while serving it
+		return
+	}
+	s.tick(b)
+	for index, x := range b.serving {
+		if x == r {
+			b.serving = append(b.serving[:index], b.serving[index+1:]...)
+			break
+		}
+	}
+	s.latency = append(s.latency, s.now-r.arrived)
+	s.report.Completed++
+	b.report.Completed++
+	s.complete(r)
+	if len(b.queue) > 0 && len(b.serving) < b.config.Workers {
+		var next = b.queue[0]
+		b.queue = b.queue[1:]
+		s.start(b, next)
+	}
+}
+
+//complete lets the balancer's ServeHTTP return for a request, and waits for it to do so
+func (s *simulation) complete(r *simRequest) {
+	r.finished = true
+	close(r.wake)
+	<-r.done
+}
+
+func (s *simulation) backendEvent(e Event) {
+	var b = s.backends[e.Backend]
+	var u = b.url
+	switch e.Kind {
+	case Fail:
+		if !b.up {
+			return
+		}
+		s.tick(b)
+		b.up = false
+		s.balancer.Remove(&u)
+		var lost = append(b.serving, b.queue...)
+		b.serving, b.queue = nil, nil
+		for _, r := range lost {
+			s.report.Failed++
+			b.report.Failed++
+			s.complete(r)
+		}
+	case Join:
+		if b.up {
+			return
+		}
+		s.tick(b)
+		b.up = true
+		s.balancer.Add(&u)
+	}
+}
+
+//tick accumulates how busy a backend has been since it last changed
+func (s *simulation) tick(b *simBackend) {
+	var elapsed = s.now - b.lastTick
+	b.report.inFlightArea += float64(len(b.serving)+len(b.queue)) * float64(elapsed)
+	b.report.busyArea += float64(len(b.serving)) * float64(elapsed)
+	b.lastTick = s.now
+}
+
+func (s *simulation) finish() {
+	s.report.Duration = s.now
+	for _, b := range s.order {
+		s.tick(b)
+		if s.now > 0 {
+			b.report.MeanInFlight = b.report.inFlightArea / float64(s.now)
+			b.report.Utilization = b.report.busyArea / float64(s.now) / float64(b.config.Workers)
+		}
+		s.report.Backends = append(s.report.Backends, *b.report)
+	}
+	s.report.QueueDelay = Summarize(s.delays)
+	s.report.Latency = Summarize(s.latency)
+	var requests, utilization []float64
+	for _, b := range s.report.Backends {
+		requests = append(requests, float64(b.Requests)/float64(b.Workers))
+		utilization = append(utilization, b.Utilization)
+	}
+	s.report.RequestFairness = JainIndex(requests)
+	s.report.UtilizationFairness = JainIndex(utilization)
+}
+
+//discardWriter throws away whatever the balancer writes back
+type discardWriter struct {
+	header http.Header
+}
+
+func (d *discardWriter) Header() http.Header {
+	return d.header
+}
+
+func (d *discardWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (d *discardWriter) WriteHeader(int) {
+}
+
+type event struct {
+	at     time.Duration
+	seq    int
+	action func()
+}
+
+//eventQueue orders events by time, then by when they were scheduled, so that simultaneous events always run in the
+//same order
+type eventQueue []*event
+
+func (q eventQueue) Len() int {
+	return len(q)
+}
+
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].at != q[j].at {
+		return q[i].at < q[j].at
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q eventQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+}
+
+func (q *eventQueue) Push(x interface{}) {
+	*q = append(*q, x.(*event))
+}
+
+func (q *eventQueue) Pop() interface{} {
+	var old = *q
+	var e = old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
@@ -0,0 +1,134 @@
+package simulate
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jangie/goloadbalancers/bestof"
+	"github.com/jangie/goloadbalancers/jsq"
+	"github.com/jangie/goloadbalancers/random"
+	"github.com/jangie/goloadbalancers/util"
+)
+
+func newRandom(balancees []url.URL, randomGenerator util.RandomInt, next http.Handler) util.LoadBalancer {
+	return random.NewRandomBalancer(balancees, random.RandomBalancerOptions{RandomGenerator: randomGenerator}, next)
+}
+
+func newJSQ(balancees []url.URL, randomGenerator util.RandomInt, next http.Handler) util.LoadBalancer {
+	return jsq.NewJoinShortestQueueBalancer(balancees, jsq.JoinShortestQueueBalancerOptions{}, next)
+}
+
+func newBestOf(balancees []url.URL, randomGenerator util.RandomInt, next http.Handler) util.LoadBalancer {
+	return bestof.NewChoiceOfBalancer(balancees, bestof.ChoiceOfBalancerOptions{RandomGenerator: randomGenerator}, next)
+}
+
+func unevenConfig(factory BalancerFactory) Config {
+	return Config{
+		Seed: 7,
+		Backends: []Backend{
+			{Name: "a", Service: Exponential(10 * time.Millisecond), Workers: 4},
+			{Name: "b", Service: Exponential(20 * time.Millisecond), Workers: 4},
+			{Name: "c", Service: Exponential(40 * time.Millisecond), Workers: 4},
+		},
+		Arrivals:    Poisson{Rate: 300},
+		Requests:    5000,
+		NewBalancer: factory,
+	}
+}
+
+func TestSimulationIsDeterministic(t *testing.T) {
+	for _, factory := range []BalancerFactory{newRandom, newJSQ, newBestOf} {
+		var first, err = Run(unevenConfig(factory))
+		if err != nil {
+			t.Fatalf("Unexpected error: %s", err)
+		}
+		var second, _ = Run(unevenConfig(factory))
+		if !reflect.DeepEqual(first, second) {
+			t.Fatalf("Two simulations with the same seed gave different reports")
+		}
+		if first.Completed != 5000 || first.Requests != 5000 {
+			t.Fatalf("Expected every request to complete, got %+v", first)
+		}
+	}
+}
+
+func TestSimulationFavorsQueueAwareAlgorithms(t *testing.T) {
+	var randomReport, _ = Run(unevenConfig(newRandom))
+	var jsqReport, _ = Run(unevenConfig(newJSQ))
+	var bestofReport, _ = Run(unevenConfig(newBestOf))
+	if jsqReport.QueueDelay.P99 >= randomReport.QueueDelay.P99 {
+		t.Fatalf("Expected JSQ to queue less than random on uneven backends, %s vs %s", jsqReport.QueueDelay.P99, randomReport.QueueDelay.P99)
+	}
+	if bestofReport.QueueDelay.P99 >= randomReport.QueueDelay.P99 {
+		t.Fatalf("Expected best-of to queue less than random on uneven backends, %s vs %s", bestofReport.QueueDelay.P99, randomReport.QueueDelay.P99)
+	}
+}
+
+func TestSimulationFailuresAndJoins(t *testing.T) {
+	var config = Config{
+		Seed: 1,
+		Backends: []Backend{
+			{Name: "a", Service: Constant(50 * time.Millisecond)},
+			{Name: "b", Service: Constant(50 * time.Millisecond)},
+			{Name: "c", Service: Constant(50 * time.Millisecond), StartDown: true},
+		},
+		Arrivals:    Poisson{Rate: 30},
+		Duration:    10 * time.Second,
+		NewBalancer: newJSQ,
+		Events: []Event{
+			{At: 2 * time.Second, Kind: Fail, Backend: "a"},
+			{At: 5 * time.Second, Kind: Join, Backend: "c"},
+		},
+	}
+	var report, err = Run(config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err)
+	}
+	if report.Completed+report.Failed+report.Rejected != report.Requests {
+		t.Fatalf("Every request should be accounted for: %+v", report)
+	}
+	if report.Backends[2].Requests == 0 {
+		t.Fatalf("A joined backend should be sent requests")
+	}
+	if report.Backends[0].Requests >= report.Backends[1].Requests {
+		t.Fatalf("A failed backend should stop getting requests")
+	}
+}
+
+func TestSimulationCountsRejections(t *testing.T) {
+	var report, _ = Run(Config{
+		Backends:    []Backend{{Name: "a", Service: Constant(time.Millisecond), StartDown: true}},
+		Arrivals:    &Trace{Offsets: []time.Duration{0, time.Second}},
+		NewBalancer: newJSQ,
+	})
+	if report.Rejected != 2 {
+		t.Fatalf("Expected requests to an empty balancer to be rejected, got %+v", report)
+	}
+}
+
+func TestBurstyArrivals(t *testing.T) {
+	var report, _ = Run(Config{
+		Seed:        3,
+		Backends:    []Backend{{Name: "a", Service: Constant(time.Millisecond), Workers: 100}},
+		Arrivals:    &Bursty{BurstRate: 1000, BurstLength: 100 * time.Millisecond, QuietLength: 900 * time.Millisecond},
+		Duration:    10 * time.Second,
+		NewBalancer: newJSQ,
+	})
+	//100 requests per burst, 10 bursts
+	if report.Requests < 800 || report.Requests > 1200 {
+		t.Fatalf("Expected around 1000 bursty arrivals, got %d", report.Requests)
+	}
+}
+
+func TestReportWritesSummary(t *testing.T) {
+	var report, _ = Run(unevenConfig(newJSQ))
+	var buffer bytes.Buffer
+	report.WriteTo(&buffer)
+	if !bytes.Contains(buffer.Bytes(), []byte(" - c: ")) {
+		t.Fatalf("Expected a line per backend in the summary:\n%s", buffer.String())
+	}
+}
@@ -0,0 +1,202 @@
+package split
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//Splitter routes requests across named sub-balancers in proportion to their weights, for example sending 5% of
+//traffic to a canary. With a sticky key, requests sharing a key always land in the same split while the weights
+//stay the same, and splits earlier in the order keep their existing keys as their weight grows.
+type Splitter struct {
+	splits          []*split
+	byName          map[string]*split
+	stickyKey       func(req *http.Request) string
+	defaultSplit    string
+	randomGenerator util.RandomInt
+	lock            *sync.RWMutex
+}
+
+type SplitterOptions struct {
+	//StickyKey, when set, gives back the key (such as a user id or cookie) used to keep a client in one split.
+	//Requests for which it gives back "" are split randomly.
+	StickyKey func(req *http.Request) string
+	//DefaultSplit names the split that Add puts new urls into
+	DefaultSplit string
+	//RandomGenerator splits requests without a sticky key. Defaults to util.GoRandom.
+	RandomGenerator util.RandomInt
+}
+
+//SplitStats are the counters kept for each split
+type SplitStats struct {
+	Weight      int
+	Requests    int64
+	Outstanding int64
+}
+
+type split struct {
+	name        string
+	balancer    util.LoadBalancer
+	weight      int
+	requests    int64
+	outstanding int64
+}
+
+//hashBuckets is the number of buckets sticky keys are hashed into
+const hashBuckets = 10000
+
+//NewSplitter gives a new Splitter back
+func NewSplitter(options SplitterOptions) *Splitter {
+	var s = Splitter{
+		byName:       make(map[string]*split),
+		stickyKey:    options.StickyKey,
+		defaultSplit: options.DefaultSplit,
+		lock:         &sync.RWMutex{},
+	}
+	if options.RandomGenerator == nil {
+		s.randomGenerator = &util.GoRandom{}
+	} else {
+		s.randomGenerator = options.RandomGenerator
+	}
+	return &s
+}
+
+//AddSplit adds a named sub-balancer with a weight. Splits are ordered by when they were added.
+func (s *Splitter) AddSplit(name string, balancer util.LoadBalancer, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("Weight must not be negative, was %d", weight)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.byName[name]; ok {
+		return fmt.Errorf("There is already a split named %q", name)
+	}
+	var sp = &split{name: name, balancer: balancer, weight: weight}
+	s.splits = append(s.splits, sp)
+	s.byName[name] = sp
+	return nil
+}
+
+//RemoveSplit removes a named sub-balancer. Requests already sent to it are unaffected.
+func (s *Splitter) RemoveSplit(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.byName[name]; !ok {
+		return fmt.Errorf("There is no split named %q", name)
+	}
+	delete(s.byName, name)
+	var newsplits = make([]*split, 0, len(s.splits))
+	for _, sp := range s.splits {
+		if sp.name != name {
+			newsplits = append(newsplits, sp)
+		}
+	}
+	s.splits = newsplits
+	return nil
+}
+
+//SetWeight changes the weight of a named split, taking effect for the next request
+func (s *Splitter) SetWeight(name string, weight int) error {
+	if weight < 0 {
+		return fmt.Errorf("Weight must not be negative, was %d", weight)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var sp, ok = s.byName[name]
+	if !ok {
+		return fmt.Errorf("There is no split named %q", name)
+	}
+	sp.weight = weight
+	return nil
+}
+
+//Stats gives back the counters for a named split
+func (s *Splitter) Stats(name string) (SplitStats, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var sp, ok = s.byName[name]
+	if !ok {
+		return SplitStats{}, fmt.Errorf("There is no split named %q", name)
+	}
+	return SplitStats{
+		Weight:      sp.weight,
+		Requests:    atomic.LoadInt64(&sp.requests),
+		Outstanding: atomic.LoadInt64(&sp.outstanding),
+	}, nil
+}
+
+//choose gives back the split a request should go to, or nil if no split has any weight
+func (s *Splitter) choose(req *http.Request) *split {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var total = 0
+	for _, sp := range s.splits {
+		total += sp.weight
+	}
+	if total == 0 {
+		return nil
+	}
+	var point int
+	var key string
+	if s.stickyKey != nil {
+		key = s.stickyKey(req)
+	}
+	if key != "" {
+		var hash = fnv.New32a()
+		hash.Write([]byte(key))
+		point = int(uint64(hash.Sum32()%hashBuckets) * uint64(total) / hashBuckets)
+	} else {
+		point, _ = s.randomGenerator.NextInt(0, total)
+	}
+	for _, sp := range s.splits {
+		if point < sp.weight {
+			return sp
+		}
+		point -= sp.weight
+	}
+	return s.splits[len(s.splits)-1]
+}
+
+func (s *Splitter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if w == nil || req == nil {
+		return
+	}
+	var sp = s.choose(req)
+	if sp == nil {
+		http.Error(w, "splitter has no weighted splits. no backend server available to fulfill this request.", http.StatusBadGateway)
+		return
+	}
+	atomic.AddInt64(&sp.requests, 1)
+	atomic.AddInt64(&sp.outstanding, 1)
+	defer atomic.AddInt64(&sp.outstanding, -1)
+	sp.balancer.ServeHTTP(w, req)
+}
+
+//Add a url to the default split
+func (s *Splitter) Add(u *url.URL) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var sp, ok = s.byName[s.defaultSplit]
+	if !ok {
+		return fmt.Errorf("There is no default split to add %s to", u)
+	}
+	return sp.balancer.Add(u)
+}
+
+//Remove a url from every split.
+func (s *Splitter) Remove(u *url.URL) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for _, sp := range s.splits {
+		if err := sp.balancer.Remove(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
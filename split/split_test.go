@@ -0,0 +1,109 @@
+package split
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/jangie/goloadbalancers/jsq"
+	"github.com/jangie/goloadbalancers/util"
+)
+
+func newPool(host string) *jsq.JoinShortestQueueBalancer {
+	var u, _ = url.Parse(host)
+	return jsq.NewJoinShortestQueueBalancer([]url.URL{*u}, jsq.JoinShortestQueueBalancerOptions{}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+}
+
+func newTestSplitter(options SplitterOptions) *Splitter {
+	var s = NewSplitter(options)
+	s.AddSplit("canary", newPool("http://canary"), 5)
+	s.AddSplit("stable", newPool("http://stable"), 95)
+	return s
+}
+
+func serve(s *Splitter, user string) {
+	var req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-User", user)
+	s.ServeHTTP(httptest.NewRecorder(), req)
+}
+
+func TestSplitterImplements(t *testing.T) {
+	var loadbalancer util.LoadBalancer
+	loadbalancer = NewSplitter(SplitterOptions{})
+	loadbalancer.ServeHTTP(nil, nil)
+	var recorder = httptest.NewRecorder()
+	loadbalancer.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusBadGateway {
+		t.Fatalf("Expected a 502 with no splits, got %d", recorder.Code)
+	}
+}
+
+func TestSplitterSplitsByWeight(t *testing.T) {
+	var values = make([]int, 100)
+	for index := range values {
+		values[index] = index
+	}
+	var s = newTestSplitter(SplitterOptions{RandomGenerator: &util.TestingRandom{Values: values}})
+	var i = 0
+	for ; i < 100; i++ {
+		serve(s, "")
+	}
+	var canary, _ = s.Stats("canary")
+	var stable, _ = s.Stats("stable")
+	if canary.Requests != 5 || stable.Requests != 95 {
+		t.Fatalf("Expected a 5/95 split, got %d/%d", canary.Requests, stable.Requests)
+	}
+}
+
+func TestSplitterWeightsAreAdjustable(t *testing.T) {
+	var s = newTestSplitter(SplitterOptions{})
+	s.SetWeight("canary", 0)
+	var i = 0
+	for ; i < 100; i++ {
+		serve(s, "")
+	}
+	if stats, _ := s.Stats("canary"); stats.Requests != 0 {
+		t.Fatalf("A split with no weight should receive no requests, got %d", stats.Requests)
+	}
+}
+
+func TestSplitterIsSticky(t *testing.T) {
+	var s = newTestSplitter(SplitterOptions{
+		StickyKey: func(req *http.Request) string {
+			return req.Header.Get("X-User")
+		},
+	})
+	var i = 0
+	for ; i < 200; i++ {
+		var user = fmt.Sprintf("user-%d", i)
+		var before, _ = s.Stats("canary")
+		serve(s, user)
+		var after, _ = s.Stats("canary")
+		var inCanary = after.Requests > before.Requests
+		var j = 0
+		for ; j < 5; j++ {
+			before, _ = s.Stats("canary")
+			serve(s, user)
+			after, _ = s.Stats("canary")
+			if (after.Requests > before.Requests) != inCanary {
+				t.Fatalf("%s moved between cohorts", user)
+			}
+		}
+	}
+}
+
+func TestSplitterAddsToDefaultSplit(t *testing.T) {
+	var s = newTestSplitter(SplitterOptions{DefaultSplit: "stable"})
+	var u, _ = url.Parse("http://stable2")
+	if err := s.Add(u); err != nil {
+		t.Fatalf("Unexpected error adding to the default split: %s", err)
+	}
+	if s.byName["stable"].balancer.(*jsq.JoinShortestQueueBalancer).NumberOfBalancees() != 2 {
+		t.Fatalf("Add should put urls into the default split")
+	}
+	if err := NewSplitter(SplitterOptions{}).Add(u); err == nil {
+		t.Fatalf("Add without a default split should be an error")
+	}
+}
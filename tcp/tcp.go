@@ -0,0 +1,343 @@
+//Package tcp balances TCP connections, such as to database replicas, between backends. Each connection accepted is
+//spliced to a backend chosen by a util.Picker, so the same algorithms balance connections as balance HTTP requests.
+package tcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jangie/goloadbalancers/jsq"
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//ErrBalancerClosed is returned by Serve once the Balancer has been closed
+var ErrBalancerClosed = errors.New("tcp: Balancer closed")
+
+//BalancerOptions holds the optional configuration for a Balancer
+type BalancerOptions struct {
+	//Picker chooses the backend for each connection. Defaults to jsq.JoinShortestQueuePicker, which picks the backend
+	//with the fewest open connections. random.RandomPicker and bestof.ChoiceOfPicker work just as well.
+	Picker util.Picker
+	//DialTimeout limits how long connecting to a backend may take. Defaults to 5s.
+	DialTimeout time.Duration
+	//DialAttempts is how many different backends are tried before a connection is given up on. Defaults to 3.
+	DialAttempts int
+	//IdleTimeout closes connections which have seen no traffic either way for this long. Zero means never.
+	IdleTimeout time.Duration
+	//MaxConnections is the most connections open to any one backend. Zero means no limit. Connections arriving
+	//when every backend is full are closed.
+	MaxConnections int
+	//Dial, when set, connects to backends in place of net.Dialer
+	Dial func(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+//Balancer accepts connections and splices each to a backend. Backends are URLs whose host is the address to dial,
+//such as tcp://replica-1:5432.
+type Balancer struct {
+	pool    *util.Pool
+	picker  util.Picker
+	options BalancerOptions
+
+	lock      sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+//NewBalancer gives a new Balancer back
+func NewBalancer(balancees []url.URL, options BalancerOptions) *Balancer {
+	var b = Balancer{
+		pool:      util.NewPool(balancees, util.PoolOptions{MaxInFlight: options.MaxConnections}),
+		picker:    options.Picker,
+		options:   options,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+	if b.picker == nil {
+		b.picker = jsq.JoinShortestQueuePicker{}
+	}
+	if b.options.DialTimeout <= 0 {
+		b.options.DialTimeout = 5 * time.Second
+	}
+	if b.options.DialAttempts <= 0 {
+		b.options.DialAttempts = 3
+	}
+	if b.options.Dial == nil {
+		b.options.Dial = (&net.Dialer{}).DialContext
+	}
+	return &b
+}
+
+//Serve accepts connections on listener until it fails or the Balancer is closed, handling each in its own goroutine.
+//It always gives back a non-nil error, ErrBalancerClosed after Close.
+func (b *Balancer) Serve(listener net.Listener) error {
+	if !b.trackListener(listener, true) {
+		return ErrBalancerClosed
+	}
+	defer b.trackListener(listener, false)
+	var backoff time.Duration
+	for {
+		var conn, err = listener.Accept()
+		if err != nil {
+			if b.isClosed() {
+				return ErrBalancerClosed
+			}
+			if temporary(err) {
+				//Temporary failures, such as running out of file descriptors, are waited out, backing off as
+				//net/http's Server does
+				if backoff == 0 {
+					backoff = 5 * time.Millisecond
+				} else if backoff *= 2; backoff > time.Second {
+					backoff = time.Second
+				}
+				time.Sleep(backoff)
+				continue
+			}
+			return err
+		}
+		backoff = 0
+		//Close may have run since Accept returned, and must not be waiting on a goroutine it never saw start
+		b.lock.Lock()
+		if b.closed {
+			b.lock.Unlock()
+			conn.Close()
+			return ErrBalancerClosed
+		}
+		b.wg.Add(1)
+		b.lock.Unlock()
+		go func() {
+			defer b.wg.Done()
+			b.ServeConn(conn)
+		}()
+	}
+}
+
+//temporary reports whether an Accept error will likely pass if waited out
+func temporary(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) || errors.Is(err, syscall.ECONNABORTED)
+}
+
+//ServeConn splices one client connection to a backend, returning once either side has closed. The client connection
+//is always closed.
+func (b *Balancer) ServeConn(client net.Conn) {
+	defer client.Close()
+	if !b.trackConn(client, true) {
+		return
+	}
+	defer b.trackConn(client, false)
+
+	var backend, u, err = b.dial()
+	if err != nil {
+		return
+	}
+	defer b.pool.Release(u)
+	defer backend.Close()
+	if !b.trackConn(backend, true) {
+		return
+	}
+	defer b.trackConn(backend, false)
+	splice(client, backend, b.options.IdleTimeout)
+}
+
+//dial connects to a backend, trying others when one can't be connected to
+func (b *Balancer) dial() (net.Conn, *url.URL, error) {
+	var tried = make(map[url.URL]bool)
+	var picker = util.PickerFunc(func(balancees []util.Balancee, req *http.Request) (*url.URL, error) {
+		var untried []util.Balancee
+		for _, balancee := range balancees {
+			if !tried[*balancee.URL] {
+				untried = append(untried, balancee)
+			}
+		}
+		if len(untried) == 0 {
+			return nil, fmt.Errorf("every backend has already been tried")
+		}
+		return b.picker.Pick(untried, req)
+	})
+	var lastErr error
+	for attempt := 0; attempt < b.options.DialAttempts; attempt++ {
+		var u, err = b.pool.Acquire(picker, nil)
+		if err != nil {
+			break
+		}
+		if tried[*u] {
+			//The only backend left to choose from has already failed
+			b.pool.Release(u)
+			break
+		}
+		tried[*u] = true
+		var ctx, cancel = context.WithTimeout(context.Background(), b.options.DialTimeout)
+		var conn, dialErr = b.options.Dial(ctx, "tcp", u.Host)
+		cancel()
+		if dialErr == nil {
+			return conn, u, nil
+		}
+		b.pool.RecordError(u, util.Classify(dialErr))
+		b.pool.Release(u)
+		lastErr = dialErr
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no backend available")
+	}
+	return nil, nil, lastErr
+}
+
+//Close stops every Serve and closes every connection, waiting for their goroutines to finish
+func (b *Balancer) Close() error {
+	b.lock.Lock()
+	b.closed = true
+	for listener := range b.listeners {
+		listener.Close()
+	}
+	for conn := range b.conns {
+		conn.Close()
+	}
+	b.lock.Unlock()
+	b.wg.Wait()
+	return nil
+}
+
+func (b *Balancer) isClosed() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.closed
+}
+
+func (b *Balancer) trackListener(listener net.Listener, add bool) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if add {
+		if b.closed {
+			return false
+		}
+		b.listeners[listener] = struct{}{}
+	} else {
+		delete(b.listeners, listener)
+	}
+	return true
+}
+
+func (b *Balancer) trackConn(conn net.Conn, add bool) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if add {
+		if b.closed {
+			return false
+		}
+		b.conns[conn] = struct{}{}
+	} else {
+		delete(b.conns, conn)
+	}
+	return true
+}
+
+//Add a backend to the balancer
+func (b *Balancer) Add(u *url.URL) error {
+	return b.pool.Add(u)
+}
+
+//Remove a backend from the balancer. Connections already open to it are left open.
+func (b *Balancer) Remove(u *url.URL) error {
+	return b.pool.Remove(u)
+}
+
+//SetHealthy marks a backend as healthy or unhealthy. Unhealthy backends get no new connections.
+func (b *Balancer) SetHealthy(u *url.URL, healthy bool) error {
+	return b.pool.SetHealthy(u, healthy)
+}
+
+//Pool gives back the pool of backends behind this balancer
+func (b *Balancer) Pool() *util.Pool {
+	return b.pool
+}
+
+//NumberOfBalancees returns the number of backends that this balancer knows about
+func (b *Balancer) NumberOfBalancees() int {
+	return b.pool.NumberOfBalancees()
+}
+
+//OpenConnections returns the number of connections open to a particular backend
+func (b *Balancer) OpenConnections(u *url.URL) int {
+	return b.pool.OutstandingRequests(u)
+}
+
+//Errors gives back how many connections to a backend could not be made, by how they failed
+func (b *Balancer) Errors(u *url.URL) util.ErrorCounts {
+	return b.pool.Errors(u)
+}
+
+//splice copies between two connections until both directions are done, or neither has seen traffic for idleTimeout
+func splice(client net.Conn, backend net.Conn, idleTimeout time.Duration) {
+	var activity = &idleTracker{conns: []net.Conn{client, backend}, timeout: idleTimeout}
+	activity.touch()
+	var done = make(chan struct{}, 2)
+	var copyOneWay = func(dst net.Conn, src net.Conn) {
+		io.Copy(&idleWriter{dst, activity}, &idleReader{src, activity})
+		//Pass the end of the stream on, so the other side can finish what it is sending
+		if closer, ok := dst.(interface{ CloseWrite() error }); ok {
+			closer.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		done <- struct{}{}
+	}
+	go copyOneWay(backend, client)
+	go copyOneWay(client, backend)
+	<-done
+	<-done
+}
+
+//idleTracker pushes back the deadlines of a pair of connections whenever either sees traffic
+type idleTracker struct {
+	conns   []net.Conn
+	timeout time.Duration
+}
+
+func (t *idleTracker) touch() {
+	if t.timeout <= 0 {
+		return
+	}
+	var deadline = time.Now().Add(t.timeout)
+	for _, conn := range t.conns {
+		conn.SetDeadline(deadline)
+	}
+}
+
+type idleReader struct {
+	net.Conn
+	activity *idleTracker
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	var n, err = r.Conn.Read(p)
+	if n > 0 {
+		r.activity.touch()
+	}
+	return n, err
+}
+
+type idleWriter struct {
+	net.Conn
+	activity *idleTracker
+}
+
+func (w *idleWriter) Write(p []byte) (int, error) {
+	var n, err = w.Conn.Write(p)
+	if n > 0 {
+		w.activity.touch()
+	}
+	return n, err
+}
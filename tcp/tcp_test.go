@@ -0,0 +1,284 @@
+package tcp
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jangie/goloadbalancers/random"
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//echoBackend echoes lines back, prefixed with its name, until the connection closes
+func echoBackend(t *testing.T, name string) (*url.URL, func()) {
+	var listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	go func() {
+		for {
+			var conn, err = listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var reader = bufio.NewReader(conn)
+				for {
+					var line, err = reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					io.WriteString(conn, name+":"+line)
+				}
+			}()
+		}
+	}()
+	var u, _ = url.Parse("tcp://" + listener.Addr().String())
+	return u, func() { listener.Close() }
+}
+
+//closedAddress gives back a backend nothing is listening on
+func closedAddress() *url.URL {
+	var listener, _ = net.Listen("tcp", "127.0.0.1:0")
+	var u, _ = url.Parse("tcp://" + listener.Addr().String())
+	listener.Close()
+	return u
+}
+
+func startBalancer(t *testing.T, balancer *Balancer) string {
+	var listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	go balancer.Serve(listener)
+	return listener.Addr().String()
+}
+
+func dialAndSay(t *testing.T, address string, message string) (net.Conn, string) {
+	var conn, err = net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Unable to dial the balancer: %s", err)
+	}
+	io.WriteString(conn, message+"\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var reply, _ = bufio.NewReader(conn).ReadString('\n')
+	return conn, strings.TrimSpace(reply)
+}
+
+func TestSplicesConnections(t *testing.T) {
+	var a, closeA = echoBackend(t, "a")
+	defer closeA()
+	var balancer = NewBalancer([]url.URL{*a}, BalancerOptions{})
+	defer balancer.Close()
+	var conn, reply = dialAndSay(t, startBalancer(t, balancer), "hello")
+	defer conn.Close()
+	if reply != "a:hello" {
+		t.Fatalf("Expected the backend's echo, got %q", reply)
+	}
+	if balancer.OpenConnections(a) != 1 {
+		t.Fatalf("Expected one open connection, got %d", balancer.OpenConnections(a))
+	}
+	conn.Close()
+	var deadline = time.Now().Add(2 * time.Second)
+	for balancer.OpenConnections(a) != 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if balancer.OpenConnections(a) != 0 {
+		t.Fatalf("Expected the connection to be released once the client closed it")
+	}
+}
+
+func TestJoinsShortestQueueByOpenConnections(t *testing.T) {
+	var a, closeA = echoBackend(t, "a")
+	defer closeA()
+	var b, closeB = echoBackend(t, "b")
+	defer closeB()
+	var balancer = NewBalancer([]url.URL{*a, *b}, BalancerOptions{})
+	defer balancer.Close()
+	var address = startBalancer(t, balancer)
+	var seen = make(map[string]int)
+	for i := 0; i < 4; i++ {
+		var conn, reply = dialAndSay(t, address, "hi")
+		defer conn.Close()
+		seen[strings.SplitN(reply, ":", 2)[0]]++
+	}
+	if seen["a"] != 2 || seen["b"] != 2 {
+		t.Fatalf("Expected open connections to be spread evenly, got %v", seen)
+	}
+}
+
+func TestRetriesAnotherBackendOnDialFailure(t *testing.T) {
+	var down = closedAddress()
+	var a, closeA = echoBackend(t, "a")
+	defer closeA()
+	var balancer = NewBalancer([]url.URL{*down, *a}, BalancerOptions{
+		Picker: &random.RandomPicker{RandomGenerator: &util.TestingRandom{Values: []int{0}}},
+	})
+	defer balancer.Close()
+	var conn, reply = dialAndSay(t, startBalancer(t, balancer), "hello")
+	defer conn.Close()
+	if reply != "a:hello" {
+		t.Fatalf("Expected to be retried against the live backend, got %q", reply)
+	}
+	if balancer.Errors(down).Dial != 1 {
+		t.Fatalf("Expected the dial failure to be counted, got %+v", balancer.Errors(down))
+	}
+	if balancer.OpenConnections(down) != 0 {
+		t.Fatalf("A failed dial should not hold a connection")
+	}
+}
+
+func TestGivesUpWhenNoBackendAnswers(t *testing.T) {
+	var balancer = NewBalancer([]url.URL{*closedAddress(), *closedAddress()}, BalancerOptions{})
+	defer balancer.Close()
+	var conn, reply = dialAndSay(t, startBalancer(t, balancer), "hello")
+	defer conn.Close()
+	if reply != "" {
+		t.Fatalf("Expected the connection to be closed, got %q", reply)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	var a, closeA = echoBackend(t, "a")
+	defer closeA()
+	var balancer = NewBalancer([]url.URL{*a}, BalancerOptions{IdleTimeout: 50 * time.Millisecond})
+	defer balancer.Close()
+	var conn, _ = dialAndSay(t, startBalancer(t, balancer), "hello")
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var started = time.Now()
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("Expected an idle connection to be closed")
+	}
+	if time.Since(started) > time.Second {
+		t.Fatalf("The idle connection was closed by the read deadline, not the idle timeout")
+	}
+}
+
+func TestMembershipAndClose(t *testing.T) {
+	var a, closeA = echoBackend(t, "a")
+	defer closeA()
+	var b, closeB = echoBackend(t, "b")
+	defer closeB()
+	var balancer = NewBalancer([]url.URL{*a}, BalancerOptions{})
+	var address = startBalancer(t, balancer)
+	balancer.Add(b)
+	balancer.Remove(a)
+	var conn, reply = dialAndSay(t, address, "hello")
+	defer conn.Close()
+	if reply != "b:hello" {
+		t.Fatalf("Expected only the added backend to be used, got %q", reply)
+	}
+	balancer.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("Expected Close to close open connections")
+	}
+	if _, err := net.Dial("tcp", address); err == nil {
+		t.Fatalf("Expected Close to stop listening")
+	}
+}
+
+//flakyListener fails its first Accepts as a process out of file descriptors would
+type flakyListener struct {
+	net.Listener
+	failures int
+}
+
+func (f *flakyListener) Accept() (net.Conn, error) {
+	if f.failures > 0 {
+		f.failures--
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept4", syscall.EMFILE)}
+	}
+	return f.Listener.Accept()
+}
+
+func TestServeWaitsOutRunningOutOfFileDescriptors(t *testing.T) {
+	var a, closeA = echoBackend(t, "a")
+	defer closeA()
+	var balancer = NewBalancer([]url.URL{*a}, BalancerOptions{})
+	defer balancer.Close()
+	var listener, _ = net.Listen("tcp", "127.0.0.1:0")
+	go balancer.Serve(&flakyListener{Listener: listener, failures: 3})
+	var conn, reply = dialAndSay(t, listener.Addr().String(), "hello")
+	defer conn.Close()
+	if reply != "a:hello" {
+		t.Fatalf("Expected Serve to keep accepting after EMFILE, got %q", reply)
+	}
+
+	var broken, _ = net.Listen("tcp", "127.0.0.1:0")
+	broken.Close()
+	if err := balancer.Serve(broken); err == nil || err == ErrBalancerClosed {
+		t.Fatalf("Expected a permanent Accept failure to stop Serve, got %v", err)
+	}
+}
+
+//pausedListener hands out one end of a pipe, but only once let go of, so that Close can run in the meantime
+type pausedListener struct {
+	net.Listener
+	accepted chan struct{}
+	release  chan struct{}
+	client   net.Conn
+	accepts  int
+}
+
+func (p *pausedListener) Accept() (net.Conn, error) {
+	p.accepts++
+	if p.accepts > 1 {
+		return nil, net.ErrClosed
+	}
+	close(p.accepted)
+	<-p.release
+	var server, client = net.Pipe()
+	p.client = client
+	return server, nil
+}
+
+func TestCloseWhileServeIsAccepting(t *testing.T) {
+	var a, closeA = echoBackend(t, "a")
+	defer closeA()
+	var balancer = NewBalancer([]url.URL{*a}, BalancerOptions{})
+	var listener, _ = net.Listen("tcp", "127.0.0.1:0")
+	var paused = &pausedListener{Listener: listener, accepted: make(chan struct{}), release: make(chan struct{})}
+	var served = make(chan error)
+	go func() {
+		served <- balancer.Serve(paused)
+	}()
+	<-paused.accepted
+	balancer.Close()
+	close(paused.release)
+	if err := <-served; err != ErrBalancerClosed {
+		t.Fatalf("Expected a connection accepted after Close to end Serve, got %v", err)
+	}
+	if paused.accepts != 1 {
+		t.Fatalf("Expected Serve to stop accepting once closed, accepted %d times", paused.accepts)
+	}
+	paused.client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := paused.client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the connection accepted after Close to be closed, got %v", err)
+	}
+
+	//Closing while connections keep arriving must not race with Serve
+	for i := 0; i < 20; i++ {
+		var balancer = NewBalancer([]url.URL{*a}, BalancerOptions{})
+		var address = startBalancer(t, balancer)
+		var done = make(chan struct{})
+		go func() {
+			defer close(done)
+			for j := 0; j < 5; j++ {
+				if conn, err := net.Dial("tcp", address); err == nil {
+					conn.Close()
+				}
+			}
+		}()
+		balancer.Close()
+		<-done
+	}
+}
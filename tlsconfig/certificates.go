@@ -0,0 +1,203 @@
+//Package tlsconfig builds the TLS configuration for terminating TLS in front of a balancer, choosing between
+//certificates by SNI, and for connecting to https balancees, with their own CAs, client certificates and server name.
+//Certificates are read from disk and reloaded when their files change, so they can be renewed without a restart.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"weak"
+)
+
+//KeyPair names the PEM files holding a certificate, with any intermediates after it, and its private key
+type KeyPair struct {
+	CertFile string
+	KeyFile  string
+}
+
+//CertificatesOptions holds the optional configuration for Certificates
+type CertificatesOptions struct {
+	//ReloadInterval is how often the files are checked for changes, in the background. Zero or less means they are
+	//only read again by Reload.
+	ReloadInterval time.Duration
+	//OnReloadError, when set, is told when changed files could not be loaded. The certificates already loaded are
+	//kept until they can be.
+	OnReloadError func(err error)
+}
+
+//Certificates holds certificates loaded from disk, and chooses between them by the server name a client asks for
+type Certificates struct {
+	pairs   []KeyPair
+	options CertificatesOptions
+
+	lock     sync.RWMutex
+	certs    []*tls.Certificate
+	byName   map[string]*tls.Certificate
+	modTimes []time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+//NewCertificates loads the key pairs given. The first is the default, given to clients asking for a name none of
+//them is for, or for no name at all. With a ReloadInterval, their files are watched until Close is called or the
+//Certificates are no longer used.
+func NewCertificates(pairs []KeyPair, options CertificatesOptions) (*Certificates, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("tlsconfig: no certificates given")
+	}
+	var c = &Certificates{
+		pairs:   pairs,
+		options: options,
+		stop:    make(chan struct{}),
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	if options.ReloadInterval > 0 {
+		go watch(weak.Make(c), options.ReloadInterval, c.stop)
+	}
+	return c, nil
+}
+
+//watch checks for changed files every interval until stopped. It only holds a weak pointer, so that Certificates
+//dropped without being closed, along with the tls.Config using them, can still be collected and stop it.
+func watch(certs weak.Pointer[Certificates], interval time.Duration, stop <-chan struct{}) {
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		var c = certs.Value()
+		if c == nil {
+			return
+		}
+		c.reloadIfChanged()
+	}
+}
+
+//Close stops watching the files for changes. The certificates already loaded are still given out. Closing nil
+//Certificates, as NewClientConfig gives back without a client certificate, does nothing.
+func (c *Certificates) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+	return nil
+}
+
+//Reload reads every key pair from disk again. If any can't be loaded, the certificates already loaded are kept.
+func (c *Certificates) Reload() error {
+	var certs = make([]*tls.Certificate, 0, len(c.pairs))
+	var byName = make(map[string]*tls.Certificate)
+	var modTimes = c.stat()
+	for _, pair := range c.pairs {
+		var cert, err = tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return fmt.Errorf("tlsconfig: loading %s: %w", pair.CertFile, err)
+		}
+		certs = append(certs, &cert)
+		for _, name := range names(cert.Leaf) {
+			if _, ok := byName[name]; !ok {
+				byName[name] = &cert
+			}
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.certs = certs
+	c.byName = byName
+	c.modTimes = modTimes
+	return nil
+}
+
+//names gives back the lower-cased names a certificate is for
+func names(leaf *x509.Certificate) []string {
+	var names = leaf.DNSNames
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = []string{leaf.Subject.CommonName}
+	}
+	var lowered = make([]string, len(names))
+	for i, name := range names {
+		lowered[i] = strings.ToLower(name)
+	}
+	return lowered
+}
+
+//stat gives back when each file was last changed
+func (c *Certificates) stat() []time.Time {
+	var modTimes = make([]time.Time, 0, 2*len(c.pairs))
+	for _, pair := range c.pairs {
+		for _, file := range []string{pair.CertFile, pair.KeyFile} {
+			var modTime time.Time
+			if info, err := os.Stat(file); err == nil {
+				modTime = info.ModTime()
+			}
+			modTimes = append(modTimes, modTime)
+		}
+	}
+	return modTimes
+}
+
+//reloadIfChanged reloads the key pairs when their files have changed
+func (c *Certificates) reloadIfChanged() {
+	c.lock.RLock()
+	var previous = c.modTimes
+	c.lock.RUnlock()
+	var modTimes = c.stat()
+	var changed = false
+	for i, modTime := range modTimes {
+		if !modTime.Equal(previous[i]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := c.Reload(); err != nil {
+		//Wait for the files to change again rather than failing the same way every time
+		c.lock.Lock()
+		c.modTimes = modTimes
+		c.lock.Unlock()
+		if c.options.OnReloadError != nil {
+			c.options.OnReloadError(err)
+		}
+	}
+}
+
+//Certificate gives back the certificate for a server name, falling back on a wildcard for it and then on the default
+func (c *Certificates) Certificate(serverName string) *tls.Certificate {
+	var name = strings.ToLower(strings.TrimSuffix(serverName, "."))
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if cert, ok := c.byName[name]; ok {
+		return cert
+	}
+	if dot := strings.IndexByte(name, '.'); dot > 0 {
+		if cert, ok := c.byName["*"+name[dot:]]; ok {
+			return cert
+		}
+	}
+	return c.certs[0]
+}
+
+//GetCertificate chooses a certificate by SNI, for tls.Config.GetCertificate
+func (c *Certificates) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.Certificate(hello.ServerName), nil
+}
+
+//GetClientCertificate gives back the default certificate, for tls.Config.GetClientCertificate
+func (c *Certificates) GetClientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.Certificate(""), nil
+}
@@ -0,0 +1,198 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//testCA signs certificates for tests, and writes them out as PEM files
+type testCA struct {
+	t      *testing.T
+	dir    string
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	var ca = &testCA{t: t, dir: t.TempDir()}
+	ca.cert, ca.key = ca.sign(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	})
+	ca.write("ca.pem", "CERTIFICATE", ca.cert.Raw)
+	return ca
+}
+
+//sign signs template with the CA's key, or with its own if there is no CA yet
+func (ca *testCA) sign(template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	var key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca.serial++
+	template.SerialNumber = big.NewInt(ca.serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	var parent, signer = template, key
+	if ca.cert != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	var der, err = x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		ca.t.Fatalf("Unable to create certificate: %s", err)
+	}
+	var cert, _ = x509.ParseCertificate(der)
+	return cert, key
+}
+
+func (ca *testCA) write(name string, blockType string, der []byte) string {
+	var path = filepath.Join(ca.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		ca.t.Fatalf("Unable to write %s: %s", path, err)
+	}
+	return path
+}
+
+//issue writes out a certificate for names, usable by servers and clients, under file names starting with prefix
+func (ca *testCA) issue(prefix string, names ...string) KeyPair {
+	var cert, key = ca.sign(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: names[0]},
+		DNSNames:    names,
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	})
+	var keyDER, _ = x509.MarshalECPrivateKey(key)
+	return KeyPair{
+		CertFile: ca.write(prefix+".crt", "CERTIFICATE", cert.Raw),
+		KeyFile:  ca.write(prefix+".key", "EC PRIVATE KEY", keyDER),
+	}
+}
+
+func TestCertificatesAreChosenBySNI(t *testing.T) {
+	var ca = newTestCA(t)
+	var certs, err = NewCertificates([]KeyPair{
+		ca.issue("default", "default.example"),
+		ca.issue("api", "api.example", "API2.example"),
+		ca.issue("wildcard", "*.apps.example"),
+	}, CertificatesOptions{})
+	if err != nil {
+		t.Fatalf("Unable to load certificates: %s", err)
+	}
+	for _, c := range []struct {
+		serverName string
+		expected   string
+	}{
+		{"api.example", "api.example"},
+		{"api2.example", "api.example"},
+		{"Shop.Apps.Example.", "*.apps.example"},
+		{"deep.shop.apps.example", "default.example"},
+		{"", "default.example"},
+		{"unknown.example", "default.example"},
+	} {
+		var cert, _ = certs.GetCertificate(&tls.ClientHelloInfo{ServerName: c.serverName})
+		if cert.Leaf.DNSNames[0] != c.expected {
+			t.Fatalf("Expected %q to be served %s, got %s", c.serverName, c.expected, cert.Leaf.DNSNames[0])
+		}
+	}
+}
+
+//eventually waits up to a second for condition to hold
+func eventually(condition func() bool) bool {
+	var deadline = time.Now().Add(time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+func TestCertificatesAreReloadedWhenChanged(t *testing.T) {
+	var ca = newTestCA(t)
+	var pair = ca.issue("site", "site.example")
+	var reloadErrors = make(chan error, 10)
+	var certs, err = NewCertificates([]KeyPair{pair}, CertificatesOptions{
+		ReloadInterval: time.Millisecond,
+		OnReloadError: func(err error) {
+			reloadErrors <- err
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to load certificates: %s", err)
+	}
+	defer certs.Close()
+	var before = certs.Certificate("site.example").Leaf.SerialNumber
+
+	//Renew the certificate in place, making sure its files look newer
+	ca.issue("site", "site.example")
+	var later = time.Now().Add(time.Minute)
+	os.Chtimes(pair.CertFile, later, later)
+	os.Chtimes(pair.KeyFile, later, later)
+	if !eventually(func() bool { return certs.Certificate("site.example").Leaf.SerialNumber.Cmp(before) != 0 }) {
+		t.Fatalf("Expected the renewed certificate to be picked up")
+	}
+	var after = certs.Certificate("site.example").Leaf.SerialNumber
+
+	//A broken renewal keeps the certificate already loaded, and is reported once
+	os.WriteFile(pair.KeyFile, []byte("not a key"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(pair.KeyFile, later, later)
+	select {
+	case <-reloadErrors:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the broken renewal to be reported")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if len(reloadErrors) != 0 {
+		t.Fatalf("Expected the broken renewal to be reported only once")
+	}
+	if certs.Certificate("site.example").Leaf.SerialNumber.Cmp(after) != 0 {
+		t.Fatalf("Expected the loaded certificate to be kept when its renewal is broken")
+	}
+}
+
+func TestClosedCertificatesAreNotReloaded(t *testing.T) {
+	var ca = newTestCA(t)
+	var pair = ca.issue("site", "site.example")
+	var certs, err = NewCertificates([]KeyPair{pair}, CertificatesOptions{ReloadInterval: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Unable to load certificates: %s", err)
+	}
+	var before = certs.Certificate("site.example").Leaf.SerialNumber
+	certs.Close()
+	time.Sleep(5 * time.Millisecond)
+
+	ca.issue("site", "site.example")
+	var later = time.Now().Add(time.Minute)
+	os.Chtimes(pair.CertFile, later, later)
+	os.Chtimes(pair.KeyFile, later, later)
+	time.Sleep(20 * time.Millisecond)
+	if certs.Certificate("site.example").Leaf.SerialNumber.Cmp(before) != 0 {
+		t.Fatalf("Expected closed certificates to stop watching their files")
+	}
+	if err := certs.Reload(); err != nil || certs.Certificate("site.example").Leaf.SerialNumber.Cmp(before) == 0 {
+		t.Fatalf("Expected Reload to still pick up the renewal, got %v", err)
+	}
+}
+
+func TestNewCertificatesNeedsAValidPair(t *testing.T) {
+	if _, err := NewCertificates(nil, CertificatesOptions{}); err == nil {
+		t.Fatalf("Expected an error with no certificates")
+	}
+	if _, err := NewCertificates([]KeyPair{{CertFile: "missing.crt", KeyFile: "missing.key"}}, CertificatesOptions{}); err == nil {
+		t.Fatalf("Expected an error with missing files")
+	}
+}
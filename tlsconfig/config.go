@@ -0,0 +1,97 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"time"
+)
+
+//defaultReloadInterval is how often certificate files are checked for changes unless told otherwise
+const defaultReloadInterval = time.Minute
+
+//ServerOptions holds the configuration for terminating TLS
+type ServerOptions struct {
+	//Certificates are chosen between by the server name each client asks for. The first is the default.
+	Certificates []KeyPair
+	//MinVersion is the oldest TLS version clients may use. Defaults to TLS 1.2.
+	MinVersion uint16
+	//Reload configures picking up renewed certificates from disk. Their files are checked every minute by default; a
+	//negative ReloadInterval turns the checks off.
+	Reload CertificatesOptions
+}
+
+//NewServerConfig gives back a tls.Config for a listener in front of a balancer. HTTP/2 is offered as well as HTTP/1.1.
+//The Certificates it serves are given back too, to be closed once the listener is done with them.
+func NewServerConfig(options ServerOptions) (*tls.Config, *Certificates, error) {
+	var certs, err = NewCertificates(options.Certificates, withDefaultInterval(options.Reload))
+	if err != nil {
+		return nil, nil, err
+	}
+	var config = &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     options.MinVersion,
+		NextProtos:     []string{"h2", "http/1.1"},
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	return config, certs, nil
+}
+
+//ClientOptions holds the configuration for connecting to the https balancees of one pool
+type ClientOptions struct {
+	//CAFiles are PEM bundles of the CAs trusted to sign balancees' certificates. Without any, the system's are used.
+	CAFiles []string
+	//Certificate, when its files are given, is presented to balancees which ask for a client certificate (mTLS)
+	Certificate KeyPair
+	//ServerName, when set, is sent as SNI and checked against balancees' certificates in place of their host
+	ServerName string
+	//MinVersion is the oldest TLS version balancees may use. Defaults to TLS 1.2.
+	MinVersion uint16
+	//Reload configures picking up a renewed client certificate from disk. Its files are checked every minute by
+	//default; a negative ReloadInterval turns the checks off.
+	Reload CertificatesOptions
+}
+
+//NewClientConfig gives back a tls.Config for connecting to balancees, for forward.TransportOptions.TLSClientConfig,
+//with the Certificates holding its client certificate to be closed once it is done with. They are nil without one.
+func NewClientConfig(options ClientOptions) (*tls.Config, *Certificates, error) {
+	var config = &tls.Config{
+		ServerName: options.ServerName,
+		MinVersion: options.MinVersion,
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	if len(options.CAFiles) > 0 {
+		config.RootCAs = x509.NewCertPool()
+		for _, file := range options.CAFiles {
+			var pem, err = os.ReadFile(file)
+			if err != nil {
+				return nil, nil, fmt.Errorf("tlsconfig: reading %s: %w", file, err)
+			}
+			if !config.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, nil, fmt.Errorf("tlsconfig: no certificates found in %s", file)
+			}
+		}
+	}
+	var certs *Certificates
+	if options.Certificate.CertFile != "" || options.Certificate.KeyFile != "" {
+		var err error
+		certs, err = NewCertificates([]KeyPair{options.Certificate}, withDefaultInterval(options.Reload))
+		if err != nil {
+			return nil, nil, err
+		}
+		config.GetClientCertificate = certs.GetClientCertificate
+	}
+	return config, certs, nil
+}
+
+func withDefaultInterval(options CertificatesOptions) CertificatesOptions {
+	if options.ReloadInterval == 0 {
+		options.ReloadInterval = defaultReloadInterval
+	}
+	return options
+}
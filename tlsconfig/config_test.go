@@ -0,0 +1,112 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jangie/goloadbalancers/forward"
+)
+
+func TestTerminatesTLSAndConnectsToBalanceesWithMTLS(t *testing.T) {
+	var ca = newTestCA(t)
+	var backendConfig, backendCerts, err = NewServerConfig(ServerOptions{
+		Certificates: []KeyPair{ca.issue("backend", "backend.internal")},
+		MinVersion:   tls.VersionTLS13,
+	})
+	if err != nil {
+		t.Fatalf("Unable to configure the balancee: %s", err)
+	}
+	defer backendCerts.Close()
+	//The balancee only takes connections with a client certificate from the test CA
+	var clientCAs, _, _ = NewClientConfig(ClientOptions{CAFiles: []string{ca.dir + "/ca.pem"}})
+	backendConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	backendConfig.ClientCAs = clientCAs.RootCAs
+	var backend = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		io.WriteString(w, req.TLS.PeerCertificates[0].Subject.CommonName+" "+req.TLS.ServerName)
+	}))
+	backend.TLS = backendConfig
+	backend.StartTLS()
+	defer backend.Close()
+
+	var upstream, upstreamCerts, _ = NewClientConfig(ClientOptions{
+		CAFiles:     []string{ca.dir + "/ca.pem"},
+		Certificate: ca.issue("client", "balancer.internal"),
+		ServerName:  "backend.internal",
+		MinVersion:  tls.VersionTLS13,
+	})
+	defer upstreamCerts.Close()
+	var forwarder = forward.New(forward.Options{Transport: forward.TransportOptions{TLSClientConfig: upstream}})
+	var frontConfig, frontCerts, _ = NewServerConfig(ServerOptions{Certificates: []KeyPair{
+		ca.issue("default", "default.example"),
+		ca.issue("public", "public.example"),
+	}})
+	defer frontCerts.Close()
+	var front = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var target = *req
+		target.URL, _ = req.URL.Parse(backend.URL + req.URL.Path)
+		forwarder.ServeHTTP(w, &target)
+	}))
+	front.TLS = frontConfig
+	front.StartTLS()
+	defer front.Close()
+
+	var client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:    clientCAs.RootCAs,
+		ServerName: "public.example",
+	}}}
+	var resp, getErr = client.Get(front.URL + "/")
+	if getErr != nil {
+		t.Fatalf("Request failed: %s", getErr)
+	}
+	defer resp.Body.Close()
+	var body, _ = io.ReadAll(resp.Body)
+	if resp.TLS.PeerCertificates[0].DNSNames[0] != "public.example" {
+		t.Fatalf("Expected the certificate for the name asked for, got %v", resp.TLS.PeerCertificates[0].DNSNames)
+	}
+	if string(body) != "balancer.internal backend.internal" {
+		t.Fatalf("Expected the balancee to see the client certificate and the overridden SNI, got %d %q", resp.StatusCode, body)
+	}
+
+	//Without a client certificate the balancee turns the balancer away
+	var noCert, noCerts, _ = NewClientConfig(ClientOptions{CAFiles: []string{ca.dir + "/ca.pem"}, ServerName: "backend.internal"})
+	if noCerts != nil {
+		t.Fatalf("Expected no Certificates without a client certificate")
+	}
+	noCerts.Close()
+	forwarder = forward.New(forward.Options{Transport: forward.TransportOptions{TLSClientConfig: noCert}})
+	resp, getErr = client.Get(front.URL + "/")
+	if getErr != nil {
+		t.Fatalf("Request failed: %s", getErr)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Expected a 502 without a client certificate, got %d", resp.StatusCode)
+	}
+}
+
+func TestMinVersionIsEnforced(t *testing.T) {
+	var ca = newTestCA(t)
+	var config, certs, _ = NewServerConfig(ServerOptions{Certificates: []KeyPair{ca.issue("site", "site.example")}})
+	defer certs.Close()
+	if config.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("Expected TLS 1.2 to be the default minimum, got %x", config.MinVersion)
+	}
+	config.MinVersion = tls.VersionTLS13
+	var server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	var old, _, _ = NewClientConfig(ClientOptions{CAFiles: []string{ca.dir + "/ca.pem"}})
+	old.MaxVersion = tls.VersionTLS12
+	var client = &http.Client{Transport: &http.Transport{TLSClientConfig: old}}
+	if _, err := client.Get(server.URL); err == nil {
+		t.Fatalf("Expected a TLS 1.2 client to be refused")
+	}
+	if _, _, err := NewClientConfig(ClientOptions{CAFiles: []string{ca.dir + "/missing.pem"}}); err == nil {
+		t.Fatalf("Expected an error for a missing CA bundle")
+	}
+}
@@ -0,0 +1,100 @@
+package udp
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//HashPicker chooses balancees by consistent hashing, so that the same key keeps going to the same balancee, and only
+//the keys of a balancee which leaves or joins move. It can balance HTTP requests as well as datagrams.
+type HashPicker struct {
+	//Replicas is the number of points each balancee has on the ring. Defaults to 100.
+	Replicas int
+	//Key gives back what to hash for a request. Defaults to the request's RemoteAddr, which for datagrams is the
+	//client's address and port.
+	Key func(req *http.Request) string
+
+	lock    sync.Mutex
+	members string
+	ring    []ringPoint
+}
+
+type ringPoint struct {
+	hash uint64
+	url  *url.URL
+}
+
+//hashString hashes with FNV, then mixes the bits, as FNV alone spreads similar keys such as addresses poorly
+func hashString(s string) uint64 {
+	var h = fnv.New64a()
+	h.Write([]byte(s))
+	var x = h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (p *HashPicker) Pick(balancees []util.Balancee, req *http.Request) (*url.URL, error) {
+	var key = ""
+	if req != nil {
+		if p.Key != nil {
+			key = p.Key(req)
+		} else {
+			key = req.RemoteAddr
+		}
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.build(balancees)
+	var hash = hashString(key)
+	var index = sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= hash
+	})
+	if index == len(p.ring) {
+		index = 0
+	}
+	//The ring's urls may be stale copies, so hand back the pool's own
+	for _, balancee := range balancees {
+		if *balancee.URL == *p.ring[index].url {
+			return balancee.URL, nil
+		}
+	}
+	return nil, fmt.Errorf("consistent hash chose %s, which is not a balancee", p.ring[index].url)
+}
+
+//build rebuilds the ring when the balancees have changed. The picker must be locked.
+func (p *HashPicker) build(balancees []util.Balancee) {
+	var names = make([]string, len(balancees))
+	for i, balancee := range balancees {
+		names[i] = balancee.URL.String()
+	}
+	var members = strings.Join(names, "\n")
+	if members == p.members && p.ring != nil {
+		return
+	}
+	var replicas = p.Replicas
+	if replicas <= 0 {
+		replicas = 100
+	}
+	p.ring = p.ring[:0]
+	for i, balancee := range balancees {
+		var u = *balancee.URL
+		for replica := 0; replica < replicas; replica++ {
+			p.ring = append(p.ring, ringPoint{hash: hashString(fmt.Sprintf("%s#%d", names[i], replica)), url: &u})
+		}
+	}
+	sort.Slice(p.ring, func(i int, j int) bool {
+		return p.ring[i].hash < p.ring[j].hash
+	})
+	p.members = members
+}
@@ -0,0 +1,234 @@
+//Package udp balances datagrams, such as DNS queries or syslog messages, between backends. Each client address
+//keeps going to the same backend while it stays active, and replies from the backend are sent back to the client.
+package udp
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jangie/goloadbalancers/random"
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//ErrBalancerClosed is returned by Serve once the Balancer has been closed
+var ErrBalancerClosed = errors.New("udp: Balancer closed")
+
+//maxDatagram is the largest datagram that can be received
+const maxDatagram = 65535
+
+//BalancerOptions holds the optional configuration for a Balancer
+type BalancerOptions struct {
+	//Picker chooses the backend for each new client. Defaults to random.RandomPicker. Use a HashPicker to send each
+	//client to the same backend even after its session expires.
+	Picker util.Picker
+	//SessionTimeout is how long a client's session, and so its choice of backend, lasts without any datagrams
+	//either way. Defaults to 30s.
+	SessionTimeout time.Duration
+}
+
+//Balancer receives datagrams and forwards each to the backend its client's session is bound to. Backends are URLs
+//whose host is the address to send to, such as udp://resolver-1:53.
+type Balancer struct {
+	pool    *util.Pool
+	picker  util.Picker
+	timeout time.Duration
+
+	lock     sync.Mutex
+	sessions map[string]*session
+	conns    map[net.PacketConn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+//session binds a client to a backend, through a socket of its own so that the backend's replies can be told apart
+type session struct {
+	client     net.Addr
+	key        string
+	backend    *url.URL
+	upstream   net.Conn
+	lastActive int64
+}
+
+func (s *session) touch() {
+	atomic.StoreInt64(&s.lastActive, time.Now().UnixNano())
+}
+
+func (s *session) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastActive))
+}
+
+//NewBalancer gives a new Balancer back
+func NewBalancer(balancees []url.URL, options BalancerOptions) *Balancer {
+	var b = Balancer{
+		pool:     util.NewPool(balancees, util.PoolOptions{}),
+		picker:   options.Picker,
+		timeout:  options.SessionTimeout,
+		sessions: make(map[string]*session),
+		conns:    make(map[net.PacketConn]struct{}),
+	}
+	if b.picker == nil {
+		b.picker = &random.RandomPicker{RandomGenerator: &util.GoRandom{}}
+	}
+	if b.timeout <= 0 {
+		b.timeout = 30 * time.Second
+	}
+	return &b
+}
+
+//Serve receives datagrams on conn until it fails or the Balancer is closed. It always gives back a non-nil error,
+//ErrBalancerClosed after Close.
+func (b *Balancer) Serve(conn net.PacketConn) error {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return ErrBalancerClosed
+	}
+	b.conns[conn] = struct{}{}
+	b.lock.Unlock()
+
+	var buffer = make([]byte, maxDatagram)
+	for {
+		var n, client, err = conn.ReadFrom(buffer)
+		if err != nil {
+			b.lock.Lock()
+			delete(b.conns, conn)
+			var closed = b.closed
+			b.lock.Unlock()
+			if closed {
+				return ErrBalancerClosed
+			}
+			return err
+		}
+		var s = b.session(conn, client)
+		if s == nil {
+			//No backend could take the client, so its datagram is dropped, as the network may drop any datagram
+			continue
+		}
+		s.touch()
+		s.upstream.Write(buffer[:n])
+	}
+}
+
+//session gives back the client's session, starting one with a newly chosen backend if it has none
+func (b *Balancer) session(conn net.PacketConn, client net.Addr) *session {
+	var key = client.Network() + "|" + client.String() + "|" + conn.LocalAddr().String()
+	b.lock.Lock()
+	var s, ok = b.sessions[key]
+	b.lock.Unlock()
+	if ok {
+		return s
+	}
+
+	var backend, err = b.pool.Acquire(b.picker, &http.Request{RemoteAddr: client.String()})
+	if err != nil {
+		return nil
+	}
+	var upstream, dialErr = net.Dial("udp", backend.Host)
+	if dialErr != nil {
+		b.pool.RecordError(backend, util.Classify(dialErr))
+		b.pool.Release(backend)
+		return nil
+	}
+	s = &session{client: client, key: key, backend: backend, upstream: upstream}
+	s.touch()
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		upstream.Close()
+		b.pool.Release(backend)
+		return nil
+	}
+	b.sessions[key] = s
+	b.wg.Add(1)
+	b.lock.Unlock()
+	go b.relayReplies(conn, s)
+	return s
+}
+
+//relayReplies sends the backend's replies back to the client until the session expires
+func (b *Balancer) relayReplies(conn net.PacketConn, s *session) {
+	defer b.wg.Done()
+	defer b.expire(s)
+	var buffer = make([]byte, maxDatagram)
+	for {
+		s.upstream.SetReadDeadline(s.idleSince().Add(b.timeout))
+		var n, err = s.upstream.Read(buffer)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && time.Since(s.idleSince()) < b.timeout {
+				//The client sent more since the deadline was set
+				continue
+			}
+			return
+		}
+		s.touch()
+		conn.WriteTo(buffer[:n], s.client)
+	}
+}
+
+func (b *Balancer) expire(s *session) {
+	b.lock.Lock()
+	if b.sessions[s.key] == s {
+		delete(b.sessions, s.key)
+	}
+	b.lock.Unlock()
+	s.upstream.Close()
+	b.pool.Release(s.backend)
+}
+
+//Close stops every Serve and ends every session, waiting for them to finish
+func (b *Balancer) Close() error {
+	b.lock.Lock()
+	b.closed = true
+	for conn := range b.conns {
+		conn.Close()
+	}
+	for _, s := range b.sessions {
+		s.upstream.Close()
+	}
+	b.lock.Unlock()
+	b.wg.Wait()
+	return nil
+}
+
+//Add a backend to the balancer
+func (b *Balancer) Add(u *url.URL) error {
+	return b.pool.Add(u)
+}
+
+//Remove a backend from the balancer. Sessions already bound to it last until they expire.
+func (b *Balancer) Remove(u *url.URL) error {
+	return b.pool.Remove(u)
+}
+
+//SetHealthy marks a backend as healthy or unhealthy. Unhealthy backends get no new sessions.
+func (b *Balancer) SetHealthy(u *url.URL, healthy bool) error {
+	return b.pool.SetHealthy(u, healthy)
+}
+
+//Pool gives back the pool of backends behind this balancer
+func (b *Balancer) Pool() *util.Pool {
+	return b.pool
+}
+
+//NumberOfBalancees returns the number of backends that this balancer knows about
+func (b *Balancer) NumberOfBalancees() int {
+	return b.pool.NumberOfBalancees()
+}
+
+//Sessions returns the number of client sessions currently open
+func (b *Balancer) Sessions() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.sessions)
+}
+
+//SessionsFor returns the number of client sessions bound to a particular backend
+func (b *Balancer) SessionsFor(u *url.URL) int {
+	return b.pool.OutstandingRequests(u)
+}
@@ -0,0 +1,174 @@
+package udp
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//echoBackend replies to each datagram with it, prefixed with its name
+func echoBackend(t *testing.T, name string) (*url.URL, func()) {
+	var conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	go func() {
+		var buffer = make([]byte, 1024)
+		for {
+			var n, addr, err = conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteTo([]byte(name+":"+string(buffer[:n])), addr)
+		}
+	}()
+	var u, _ = url.Parse("udp://" + conn.LocalAddr().String())
+	return u, func() { conn.Close() }
+}
+
+func startBalancer(t *testing.T, balancer *Balancer) string {
+	var conn, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen: %s", err)
+	}
+	go balancer.Serve(conn)
+	return conn.LocalAddr().String()
+}
+
+//ask sends a datagram through the balancer from client, giving back the reply
+func ask(t *testing.T, client net.Conn, message string) string {
+	client.Write([]byte(message))
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var buffer = make([]byte, 1024)
+	var n, err = client.Read(buffer)
+	if err != nil {
+		t.Fatalf("Expected a reply to %q: %s", message, err)
+	}
+	return string(buffer[:n])
+}
+
+func TestSessionsKeepTheirBackend(t *testing.T) {
+	var a, closeA = echoBackend(t, "a")
+	defer closeA()
+	var b, closeB = echoBackend(t, "b")
+	defer closeB()
+	var balancer = NewBalancer([]url.URL{*a, *b}, BalancerOptions{})
+	defer balancer.Close()
+	var address = startBalancer(t, balancer)
+
+	var backends = make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		var client, _ = net.Dial("udp", address)
+		defer client.Close()
+		var first = strings.SplitN(ask(t, client, "hello"), ":", 2)
+		for j := 0; j < 5; j++ {
+			var reply = ask(t, client, fmt.Sprintf("again %d", j))
+			if reply != first[0]+fmt.Sprintf(":again %d", j) {
+				t.Fatalf("Expected every datagram from a client to go to %s, got %q", first[0], reply)
+			}
+		}
+		backends[first[0]] = true
+	}
+	if balancer.Sessions() != 10 || balancer.SessionsFor(a)+balancer.SessionsFor(b) != 10 {
+		t.Fatalf("Expected a session per client, got %d", balancer.Sessions())
+	}
+	if !backends["a"] || !backends["b"] {
+		t.Fatalf("Expected clients to be spread between backends, got %v", backends)
+	}
+}
+
+func TestSessionsExpire(t *testing.T) {
+	var a, closeA = echoBackend(t, "a")
+	defer closeA()
+	var balancer = NewBalancer([]url.URL{*a}, BalancerOptions{SessionTimeout: 50 * time.Millisecond})
+	defer balancer.Close()
+	var client, _ = net.Dial("udp", startBalancer(t, balancer))
+	defer client.Close()
+	ask(t, client, "hello")
+	//Traffic keeps the session alive past its timeout
+	for i := 0; i < 4; i++ {
+		time.Sleep(20 * time.Millisecond)
+		ask(t, client, "still here")
+	}
+	if balancer.Sessions() != 1 {
+		t.Fatalf("Expected an active session to live on")
+	}
+	var deadline = time.Now().Add(2 * time.Second)
+	for balancer.Sessions() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if balancer.Sessions() != 0 || balancer.SessionsFor(a) != 0 {
+		t.Fatalf("Expected an idle session to expire")
+	}
+	if ask(t, client, "back") != "a:back" {
+		t.Fatalf("Expected a new session once the old one expired")
+	}
+}
+
+func TestHashPickerIsConsistent(t *testing.T) {
+	var balancees []util.Balancee
+	for i := 0; i < 4; i++ {
+		var u, _ = url.Parse(fmt.Sprintf("udp://backend-%d:53", i))
+		balancees = append(balancees, util.Balancee{URL: u, Healthy: true})
+	}
+	var picker = &HashPicker{}
+	var before = make(map[string]string)
+	var counts = make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		var key = fmt.Sprintf("10.0.%d.%d:5353", i/256, i%256)
+		var chosen, _ = picker.Pick(balancees, &http.Request{RemoteAddr: key})
+		before[key] = chosen.Host
+		counts[chosen.Host]++
+	}
+	for host, count := range counts {
+		if count < 300 {
+			t.Fatalf("Expected keys to be spread evenly, %s got %d of 2000", host, count)
+		}
+	}
+	var remaining = balancees[1:]
+	for key, host := range before {
+		var chosen, _ = picker.Pick(remaining, &http.Request{RemoteAddr: key})
+		if host != "backend-0:53" && chosen.Host != host {
+			t.Fatalf("Removing a backend moved %s from %s to %s", key, host, chosen.Host)
+		}
+		if chosen.Host == "backend-0:53" {
+			t.Fatalf("A removed backend was chosen")
+		}
+	}
+}
+
+func TestHashPickerThroughBalancer(t *testing.T) {
+	var a, closeA = echoBackend(t, "a")
+	defer closeA()
+	var b, closeB = echoBackend(t, "b")
+	defer closeB()
+	var balancer = NewBalancer([]url.URL{*a, *b}, BalancerOptions{Picker: &HashPicker{}, SessionTimeout: 20 * time.Millisecond})
+	defer balancer.Close()
+	var client, _ = net.Dial("udp", startBalancer(t, balancer))
+	defer client.Close()
+	var first = strings.SplitN(ask(t, client, "hello"), ":", 2)[0]
+	//Even once its session has expired, the client hashes to the same backend
+	time.Sleep(100 * time.Millisecond)
+	if reply := ask(t, client, "hello"); !strings.HasPrefix(reply, first+":") {
+		t.Fatalf("Expected the client to hash to %s again, got %q", first, reply)
+	}
+}
+
+func TestCloseEndsSessions(t *testing.T) {
+	var a, closeA = echoBackend(t, "a")
+	defer closeA()
+	var balancer = NewBalancer([]url.URL{*a}, BalancerOptions{})
+	var client, _ = net.Dial("udp", startBalancer(t, balancer))
+	defer client.Close()
+	ask(t, client, "hello")
+	balancer.Close()
+	if balancer.Sessions() != 0 || balancer.SessionsFor(a) != 0 {
+		t.Fatalf("Expected Close to end every session")
+	}
+}
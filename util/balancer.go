@@ -0,0 +1,369 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Balancer is a LoadBalancer which delegates the choice of balancee to a Picker, and handles membership, in-flight
+//accounting and forwarding itself
+type Balancer struct {
+	pool    *Pool
+	picker  Picker
+	name    string
+	next    http.Handler
+	rewrite URLRewriter
+
+	streamAfter time.Duration
+
+	upgrades    map[url.URL]map[uint64]context.CancelFunc
+	upgradeID   uint64
+	upgradeLock sync.Mutex
+}
+
+//BalancerOptions holds the optional configuration for a Balancer
+type BalancerOptions struct {
+	//Name is used to identify the balancer in error responses. Defaults to "balancer".
+	Name      string
+	IsTesting bool
+	//MaxInFlight is the most outstanding requests any one balancee may have. Zero means no limit.
+	MaxInFlight int
+	//Limiter, when set, learns each balancee's in-flight limit from request latency instead of using MaxInFlight
+	Limiter LimiterFactory
+	//Queue configures waiting for a slot when every balancee is at its in-flight limit
+	Queue QueueOptions
+	//Rewrite builds the URL each request is forwarded to. Defaults to JoinURL.
+	Rewrite URLRewriter
+	//ConnectionWeight is how much each long-lived connection, such as a WebSocket, counts towards a balancee's Load,
+	//compared to an outstanding request. Zero or less defaults to 1, counting a connection as one more request.
+	ConnectionWeight float64
+	//IgnoreConnections leaves long-lived connections out of load altogether, whatever ConnectionWeight says
+	IgnoreConnections bool
+	//Ejection configures taking balancees which keep failing out of rotation for a while
+	Ejection EjectionOptions
+	//StreamAfter is how long a gRPC call may stay in flight before it is counted as a long-lived connection, as its
+	//stream may stay open for hours, rather than as an outstanding request. Defaults to 5s. A negative value means calls
+	//are never counted as connections. Other requests are always counted as outstanding requests.
+	StreamAfter time.Duration
+}
+
+//NewBalancer gives a new Balancer back. The next handler sends requests on to the balancee chosen, which their URL
+//points at. forward.Forwarder is one, reporting failed requests back to the balancer.
+func NewBalancer(balancees []url.URL, picker Picker, options BalancerOptions, next http.Handler) *Balancer {
+	var b = Balancer{
+		pool: NewPool(balancees, PoolOptions{
+			IsTesting:         options.IsTesting,
+			MaxInFlight:       options.MaxInFlight,
+			Limiter:           options.Limiter,
+			Queue:             options.Queue,
+			ConnectionWeight:  options.ConnectionWeight,
+			IgnoreConnections: options.IgnoreConnections,
+			Ejection:          options.Ejection,
+		}),
+		picker:      picker,
+		name:        options.Name,
+		rewrite:     options.Rewrite,
+		streamAfter: options.StreamAfter,
+		upgrades:    make(map[url.URL]map[uint64]context.CancelFunc),
+	}
+	if b.name == "" {
+		b.name = "balancer"
+	}
+	if b.rewrite == nil {
+		b.rewrite = JoinURL
+	}
+	if b.streamAfter == 0 {
+		b.streamAfter = 5 * time.Second
+	}
+	if next == nil {
+		next = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			fmt.Fprintf(w, "%s does not have a next middleware and is unable to forward to the balancee.", b.name)
+		})
+	}
+	b.next = next
+	return &b
+}
+
+func (b *Balancer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if w == nil || req == nil {
+		return
+	}
+	if IsUpgrade(req) {
+		b.serveUpgrade(w, req)
+		return
+	}
+	var ctx = req.Context()
+	var next, err = b.pool.Acquire(b.picker, req)
+	if err != nil {
+		b.writeError(w, ctx, err)
+		return
+	}
+	//Release as soon as the client goes away rather than waiting on next, but only ever once, even if next panics
+	var flight = &inFlight{pool: b.pool, u: next}
+	var stop = context.AfterFunc(ctx, flight.release)
+	defer func() {
+		stop()
+		flight.release()
+	}()
+	if b.streamAfter > 0 && IsGRPC(req) {
+		var timer = time.AfterFunc(b.streamAfter, flight.promote)
+		defer timer.Stop()
+	}
+	var newReq, failed = b.forwardedRequest(ctx, req, next)
+	if b.pool.Adaptive() {
+		var recorder = &StatusRecorder{ResponseWriter: w}
+		var start = time.Now()
+		b.next.ServeHTTP(recorder, newReq)
+		//A client going away says nothing about how the balancee is coping, and nor does how long a stream stayed open
+		if ctx.Err() == nil && !flight.promoted() {
+			b.pool.Observe(next, time.Since(start), recorder.dropped())
+		}
+	} else {
+		b.next.ServeHTTP(w, newReq)
+	}
+	b.recordSuccess(ctx, next, failed)
+}
+
+//inFlight tracks a request acquired from a pool, which is counted as a connection instead once promoted
+type inFlight struct {
+	pool *Pool
+	u    *url.URL
+
+	lock        sync.Mutex
+	isPromoted  bool
+	hasReleased bool
+}
+
+func (f *inFlight) promote() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.isPromoted || f.hasReleased {
+		return
+	}
+	f.isPromoted = true
+	f.pool.Promote(f.u)
+}
+
+func (f *inFlight) promoted() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.isPromoted
+}
+
+func (f *inFlight) release() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.hasReleased {
+		return
+	}
+	f.hasReleased = true
+	if f.isPromoted {
+		f.pool.ReleaseConnection(f.u)
+	} else {
+		f.pool.Release(f.u)
+	}
+}
+
+//serveUpgrade forwards a request to switch protocols, such as to a WebSocket, counting the connection it opens apart
+//from ordinary requests until it closes or its balancee is drained
+func (b *Balancer) serveUpgrade(w http.ResponseWriter, req *http.Request) {
+	var next, err = b.pool.AcquireConnection(b.picker, req)
+	if err != nil {
+		b.writeError(w, req.Context(), err)
+		return
+	}
+	defer b.pool.ReleaseConnection(next)
+	var ctx, cancel = context.WithCancel(req.Context())
+	defer cancel()
+	var id = b.track(next, cancel)
+	defer b.untrack(next, id)
+	var newReq, failed = b.forwardedRequest(ctx, req, next)
+	b.next.ServeHTTP(w, newReq)
+	b.recordSuccess(req.Context(), next, failed)
+}
+
+//forwardedRequest gives back the request to hand to next, pointed at the balancee, and whether next has reported
+//that it failed
+func (b *Balancer) forwardedRequest(ctx context.Context, req *http.Request, next *url.URL) (*http.Request, *atomic.Bool) {
+	//Handlers further on only ever see copies of the balancee, so they cannot change the pool's own
+	var balancee = *next
+	var failed = &atomic.Bool{}
+	newReq := req.WithContext(WithErrorReporter(WithBalancee(ctx, &balancee), func(kind ErrorKind, err error) {
+		failed.Store(true)
+		b.pool.RecordError(next, kind)
+	}))
+	newReq.URL = b.rewrite(&balancee, req)
+	return newReq, failed
+}
+
+//recordSuccess tells the pool about a request next served without reporting a failure. A client going away says
+//nothing about the balancee either way.
+func (b *Balancer) recordSuccess(ctx context.Context, next *url.URL, failed *atomic.Bool) {
+	if ctx.Err() == nil && !failed.Load() {
+		b.pool.RecordSuccess(next)
+	}
+}
+
+//writeError answers a request no balancee could be acquired for
+func (b *Balancer) writeError(w http.ResponseWriter, ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		//The client has gone away, nobody is left to read a response
+		w.WriteHeader(StatusClientClosedRequest)
+		return
+	}
+	switch err {
+	case ErrNoBalancees:
+		http.Error(w, fmt.Sprintf("%s has no balancees. no backend server available to fulfill this request.", b.name), http.StatusBadGateway)
+	case ErrNoHealthyBalancees:
+		http.Error(w, fmt.Sprintf("%s has no healthy balancees. no backend server available to fulfill this request.", b.name), http.StatusBadGateway)
+	case ErrSaturated, ErrQueueTimeout:
+		var retryAfter = int(math.Ceil(b.pool.RetryAfter().Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		http.Error(w, fmt.Sprintf("%s has no balancee with capacity to fulfill this request.", b.name), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, fmt.Sprintf("%s was unable to choose a balancee: %s", b.name, err), http.StatusBadGateway)
+	}
+}
+
+//track remembers how to close a connection open to a balancee, should it be drained
+func (b *Balancer) track(u *url.URL, cancel context.CancelFunc) uint64 {
+	b.upgradeLock.Lock()
+	defer b.upgradeLock.Unlock()
+	b.upgradeID++
+	if b.upgrades[*u] == nil {
+		b.upgrades[*u] = make(map[uint64]context.CancelFunc)
+	}
+	b.upgrades[*u][b.upgradeID] = cancel
+	return b.upgradeID
+}
+
+func (b *Balancer) untrack(u *url.URL, id uint64) {
+	b.upgradeLock.Lock()
+	defer b.upgradeLock.Unlock()
+	delete(b.upgrades[*u], id)
+	if len(b.upgrades[*u]) == 0 {
+		delete(b.upgrades, *u)
+	}
+}
+
+//Drain removes a balancee, so that it gets no new requests or connections, and closes the long-lived connections
+//still open to it once grace has passed, so that their clients reconnect to another balancee. Ordinary requests
+//already in flight are left to finish.
+func (b *Balancer) Drain(u *url.URL, grace time.Duration) error {
+	if err := b.pool.Remove(u); err != nil {
+		return err
+	}
+	b.upgradeLock.Lock()
+	var cancels []context.CancelFunc
+	for _, cancel := range b.upgrades[*u] {
+		cancels = append(cancels, cancel)
+	}
+	b.upgradeLock.Unlock()
+	var closeAll = func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}
+	if grace <= 0 {
+		closeAll()
+	} else {
+		time.AfterFunc(grace, closeAll)
+	}
+	return nil
+}
+
+//IsUpgrade reports whether req asks to switch protocols, as WebSocket handshakes do
+func IsUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Add a url to the loadbalancer
+func (b *Balancer) Add(u *url.URL) error {
+	return b.pool.Add(u)
+}
+
+//Remove a url from the loadbalancer.
+func (b *Balancer) Remove(u *url.URL) error {
+	return b.pool.Remove(u)
+}
+
+//AddWithLabels adds a url to the loadbalancer along with metadata about it, such as the zone it runs in
+func (b *Balancer) AddWithLabels(u *url.URL, labels Labels) error {
+	if err := b.pool.Add(u); err != nil {
+		return err
+	}
+	return b.pool.SetLabels(u, labels)
+}
+
+//SetLabels attaches metadata to a balancee already in the loadbalancer
+func (b *Balancer) SetLabels(u *url.URL, labels Labels) error {
+	return b.pool.SetLabels(u, labels)
+}
+
+//SetHealthy marks a balancee as healthy or unhealthy. Unhealthy balancees receive no requests.
+func (b *Balancer) SetHealthy(u *url.URL, healthy bool) error {
+	return b.pool.SetHealthy(u, healthy)
+}
+
+//HealthyCount gives back how many balancees are healthy, and how many there are in all
+func (b *Balancer) HealthyCount() (int, int) {
+	return b.pool.HealthyCount()
+}
+
+//Pool gives back the pool of balancees backing this balancer
+func (b *Balancer) Pool() *Pool {
+	return b.pool
+}
+
+//NumberOfBalancees returns the number of balancees that this balancer knows about
+func (b *Balancer) NumberOfBalancees() int {
+	return b.pool.NumberOfBalancees()
+}
+
+//OutstandingRequests returns the number of outstanding requests for a particular balancee
+func (b *Balancer) OutstandingRequests(u *url.URL) int {
+	return b.pool.OutstandingRequests(u)
+}
+
+//Outstanding returns the number of outstanding requests across every balancee
+func (b *Balancer) Outstanding() int {
+	return b.pool.TotalOutstanding()
+}
+
+//HighWatermark returns the most outstanding requests for a particular balancee
+func (b *Balancer) HighWatermark(u *url.URL) int {
+	return b.pool.HighWatermark(u)
+}
+
+//RequestCount gives back the number of requests that have come into a particular URL
+func (b *Balancer) RequestCount(u *url.URL) int {
+	return b.pool.RequestCount(u)
+}
+
+//Connections returns the number of long-lived connections open to a particular balancee
+func (b *Balancer) Connections(u *url.URL) int {
+	return b.pool.Connections(u)
+}
+
+//Errors gives back how many requests to a balancee have failed, by how they failed, as reported by the forwarder
+func (b *Balancer) Errors(u *url.URL) ErrorCounts {
+	return b.pool.Errors(u)
+}
@@ -0,0 +1,227 @@
+package util
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type recordingHandler struct {
+	hosts []string
+}
+
+func (r *recordingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.hosts = append(r.hosts, req.URL.Host)
+}
+
+func TestBalancerImplements(t *testing.T) {
+	var loadbalancer LoadBalancer
+	loadbalancer = NewBalancer([]url.URL{}, pickFirst, BalancerOptions{}, nil)
+	loadbalancer.ServeHTTP(nil, nil)
+}
+
+func TestBalancerUsesPicker(t *testing.T) {
+	var next = &recordingHandler{}
+	var picker = PickerFunc(func(balancees []Balancee, req *http.Request) (*url.URL, error) {
+		for _, balancee := range balancees {
+			if balancee.URL.Host == req.Header.Get("X-Backend") {
+				return balancee.URL, nil
+			}
+		}
+		return balancees[0].URL, nil
+	})
+	var balancer = NewBalancer([]url.URL{*urlA, *urlB, *urlC}, picker, BalancerOptions{}, next)
+	var req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Backend", "c")
+	balancer.ServeHTTP(httptest.NewRecorder(), req)
+	if len(next.hosts) != 1 || next.hosts[0] != "c" {
+		t.Fatalf("Balancer did not forward to the picked balancee: %v", next.hosts)
+	}
+	if balancer.OutstandingRequests(urlC) != 0 {
+		t.Fatalf("Balancer did not release its balancee after forwarding")
+	}
+}
+
+func TestBalancerWithoutNextSaysSo(t *testing.T) {
+	var balancer = NewBalancer([]url.URL{*urlA}, pickFirst, BalancerOptions{Name: "lb"}, nil)
+	var recorder = httptest.NewRecorder()
+	balancer.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Body.String() != "lb does not have a next middleware and is unable to forward to the balancee." {
+		t.Fatalf("Unexpected response without a next handler %q", recorder.Body.String())
+	}
+}
+
+func TestBalancerWithNoBalanceesReturns502(t *testing.T) {
+	var balancer = NewBalancer([]url.URL{}, pickFirst, BalancerOptions{}, nil)
+	var recorder = httptest.NewRecorder()
+	balancer.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusBadGateway {
+		t.Fatalf("Expected a 502 with no balancees, got %d", recorder.Code)
+	}
+}
+
+type panickingHandler struct{}
+
+func (p panickingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	panic("boom")
+}
+
+type blockingHandler struct {
+	started chan struct{}
+}
+
+func (b *blockingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	close(b.started)
+	<-req.Context().Done()
+}
+
+func TestBalancerAbortsCancelledRequests(t *testing.T) {
+	var next = &recordingHandler{}
+	var balancer = NewBalancer([]url.URL{*urlA, *urlB}, pickFirst, BalancerOptions{IsTesting: true}, next)
+	var ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	var recorder = httptest.NewRecorder()
+	balancer.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	if len(next.hosts) != 0 || balancer.RequestCount(urlA) != 0 {
+		t.Fatalf("A cancelled request should not be balanced")
+	}
+	if recorder.Code != StatusClientClosedRequest {
+		t.Fatalf("Expected %d for a cancelled request, got %d", StatusClientClosedRequest, recorder.Code)
+	}
+}
+
+func TestBalancerAttachesBalanceeToContext(t *testing.T) {
+	var chosen *url.URL
+	var next = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		chosen, _ = BalanceeFromContext(req.Context())
+	})
+	var balancer = NewBalancer([]url.URL{*urlA, *urlB}, pickFirst, BalancerOptions{}, next)
+	balancer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if chosen == nil || *chosen != *urlA {
+		t.Fatalf("Expected the chosen balancee on the request context, got %v", chosen)
+	}
+}
+
+func TestBalancerReleasesWhenNextPanics(t *testing.T) {
+	var balancer = NewBalancer([]url.URL{*urlA, *urlB}, pickFirst, BalancerOptions{}, panickingHandler{})
+	func() {
+		defer func() {
+			recover()
+		}()
+		balancer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	if balancer.OutstandingRequests(urlA) != 0 {
+		t.Fatalf("A panicking next handler leaked an outstanding request")
+	}
+}
+
+func TestBalancerReleasesWhenClientGoesAway(t *testing.T) {
+	var next = &blockingHandler{started: make(chan struct{})}
+	var balancer = NewBalancer([]url.URL{*urlA, *urlB}, pickFirst, BalancerOptions{}, next)
+	var ctx, cancel = context.WithCancel(context.Background())
+	var done = make(chan struct{})
+	go func() {
+		balancer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+		close(done)
+	}()
+	<-next.started
+	if balancer.OutstandingRequests(urlA) != 1 {
+		t.Fatalf("Expected one outstanding request while next is serving")
+	}
+	cancel()
+	<-done
+	if balancer.OutstandingRequests(urlA) != 0 {
+		t.Fatalf("Expected the request to be released exactly once, had %d outstanding", balancer.OutstandingRequests(urlA))
+	}
+}
+
+func TestBalancerSheds503WhenSaturated(t *testing.T) {
+	var next = &blockingHandler{started: make(chan struct{})}
+	var balancer = NewBalancer([]url.URL{*urlA}, pickFirst, BalancerOptions{
+		MaxInFlight: 1,
+		Queue:       QueueOptions{RetryAfter: 1500 * time.Millisecond},
+	}, next)
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	go balancer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	<-next.started
+	var recorder = httptest.NewRecorder()
+	balancer.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a 503 when saturated, got %d", recorder.Code)
+	}
+	if recorder.Header().Get("Retry-After") != "2" {
+		t.Fatalf("Expected Retry-After to be rounded up to 2, got %s", recorder.Header().Get("Retry-After"))
+	}
+}
+
+func TestConnectionWeight(t *testing.T) {
+	var picked *url.URL
+	var pickLowestLoad = PickerFunc(func(balancees []Balancee, req *http.Request) (*url.URL, error) {
+		var best = balancees[0]
+		for _, balancee := range balancees[1:] {
+			if balancee.Load() < best.Load() {
+				best = balancee
+			}
+		}
+		picked = best.URL
+		return best.URL, nil
+	})
+	var upgrade = httptest.NewRequest("GET", "/", nil)
+	upgrade.Header.Set("Connection", "keep-alive, Upgrade")
+	upgrade.Header.Set("Upgrade", "websocket")
+
+	for _, c := range []struct {
+		options  PoolOptions
+		expected string
+	}{
+		{PoolOptions{IgnoreConnections: true}, "a"},
+		{PoolOptions{}, "b"},
+		{PoolOptions{ConnectionWeight: 0.5}, "b"},
+		{PoolOptions{ConnectionWeight: 0.2}, "a"},
+	} {
+		var pool = NewPool([]url.URL{*urlA, *urlB}, c.options)
+		for i := 0; i < 3; i++ {
+			pool.AcquireConnection(PickerFunc(func(balancees []Balancee, req *http.Request) (*url.URL, error) {
+				return urlA, nil
+			}), upgrade)
+		}
+		pool.Acquire(PickerFunc(func(balancees []Balancee, req *http.Request) (*url.URL, error) {
+			return urlB, nil
+		}), nil)
+		pool.Acquire(pickLowestLoad, nil)
+		if picked.Host != c.expected {
+			t.Fatalf("With %+v, expected %s to be picked, got %s", c.options, c.expected, picked.Host)
+		}
+	}
+}
+
+func TestBalancerOnlyPromotesGRPCCalls(t *testing.T) {
+	var next = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-req.Context().Done()
+	})
+	var balancer = NewBalancer([]url.URL{*urlA}, pickFirst, BalancerOptions{StreamAfter: 10 * time.Millisecond}, next)
+	for _, c := range []struct {
+		contentType string
+		connections int
+	}{{"application/json", 0}, {"application/grpc+proto", 1}} {
+		var ctx, cancel = context.WithCancel(context.Background())
+		var req = httptest.NewRequest("POST", "/", nil).WithContext(ctx)
+		req.Header.Set("Content-Type", c.contentType)
+		var done = make(chan struct{})
+		go func() {
+			balancer.ServeHTTP(httptest.NewRecorder(), req)
+			close(done)
+		}()
+		time.Sleep(50 * time.Millisecond)
+		if balancer.Connections(urlA) != c.connections || balancer.OutstandingRequests(urlA) != 1-c.connections {
+			t.Fatalf("Expected a long %s request to count as %d connections, got %d connections and %d requests",
+				c.contentType, c.connections, balancer.Connections(urlA), balancer.OutstandingRequests(urlA))
+		}
+		cancel()
+		<-done
+	}
+}
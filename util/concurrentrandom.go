@@ -0,0 +1,119 @@
+package util
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	mathrand "math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//ShardedRandom spreads calls across several independently locked PRNGs so that concurrent callers rarely
+//contend on the same lock. Given the same seed and shard count, a single caller sees the same sequence every run.
+type ShardedRandom struct {
+	shards  []randomShard
+	counter uint32
+}
+
+type randomShard struct {
+	lock   sync.Mutex
+	source *mathrand.Rand
+	//pad each shard out to its own cache line so neighbouring shards don't falsely share
+	_ [48]byte
+}
+
+//NewShardedRandom gives a new ShardedRandom back. A shard count <= 0 defaults to 8.
+func NewShardedRandom(seed int64, shards int) *ShardedRandom {
+	if shards <= 0 {
+		shards = 8
+	}
+	var r = ShardedRandom{
+		shards: make([]randomShard, shards),
+	}
+	for index := range r.shards {
+		r.shards[index].source = mathrand.New(mathrand.NewSource(seed + int64(index)))
+	}
+	return &r
+}
+
+//NewTimeSeededShardedRandom gives a new ShardedRandom seeded from the current time, for when reproducibility doesn't matter
+func NewTimeSeededShardedRandom(shards int) *ShardedRandom {
+	return NewShardedRandom(time.Now().UnixNano(), shards)
+}
+
+func (s *ShardedRandom) NextInt(minimum int, maximum int) (int, error) {
+	if err := validateRange(minimum, maximum); err != nil {
+		return 0, err
+	}
+	var index = atomic.AddUint32(&s.counter, 1) % uint32(len(s.shards))
+	var shard = &s.shards[index]
+	shard.lock.Lock()
+	var value = shard.source.Intn(maximum-minimum) + minimum
+	shard.lock.Unlock()
+	return value, nil
+}
+
+//SafeTestingRandom behaves like TestingRandom, but may be shared between goroutines
+type SafeTestingRandom struct {
+	lock      sync.Mutex
+	Values    []int
+	index     int
+	callCount int
+}
+
+func (t *SafeTestingRandom) NextInt(minimum int, maximum int) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.callCount++
+
+	if len(t.Values) == 0 {
+		return 0, nil
+	}
+
+	if t.index > len(t.Values)-1 {
+		t.index = 0
+	}
+
+	var value = t.Values[t.index]
+	t.index++
+
+	return value, nil
+}
+
+//CallCount gives back the number of times NextInt has been called
+func (t *SafeTestingRandom) CallCount() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.callCount
+}
+
+//CryptoRandom uses crypto/rand to return a random number between minimum and maximum. It is much slower than the
+//math/rand backed generators, but is safe for concurrent use and unpredictable.
+type CryptoRandom struct {
+}
+
+func (c CryptoRandom) NextInt(minimum int, maximum int) (int, error) {
+	if err := validateRange(minimum, maximum); err != nil {
+		return 0, err
+	}
+	var n, err = rand.Int(rand.Reader, big.NewInt(int64(maximum-minimum)))
+	if err != nil {
+		return 0, err
+	}
+	return int(n.Int64()) + minimum, nil
+}
+
+func validateRange(minimum int, maximum int) error {
+	if maximum < minimum {
+		return errors.New("Illegal state: Minimum is greater than maximum")
+	}
+	if maximum < 0 || minimum < 0 {
+		return errors.New("Illegal state: Minimum and maximum must both be above zero")
+	}
+	if maximum == minimum {
+		return errors.New("Illegal state: Minimum and maximum must not be equal")
+	}
+	return nil
+}
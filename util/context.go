@@ -0,0 +1,23 @@
+package util
+
+import (
+	"context"
+	"net/url"
+)
+
+//StatusClientClosedRequest is returned when a client goes away before a balancee could be chosen for it. It is not
+//a standard status, but is the one nginx uses for the same situation.
+const StatusClientClosedRequest = 499
+
+type balanceeContextKey struct{}
+
+//WithBalancee gives back a copy of ctx carrying the balancee chosen for a request
+func WithBalancee(ctx context.Context, u *url.URL) context.Context {
+	return context.WithValue(ctx, balanceeContextKey{}, u)
+}
+
+//BalanceeFromContext gives back the balancee chosen for a request, if one has been chosen
+func BalanceeFromContext(ctx context.Context) (*url.URL, bool) {
+	var u, ok = ctx.Value(balanceeContextKey{}).(*url.URL)
+	return u, ok
+}
@@ -0,0 +1,71 @@
+package util
+
+import (
+	"net/url"
+	"time"
+)
+
+//EjectionOptions configures taking balancees which keep failing out of rotation for a while, as outlier detection
+//does, without waiting on a health check to notice
+type EjectionOptions struct {
+	//ConsecutiveFailures is how many requests to a balancee in a row must fail, as reported to RecordError, before it
+	//is ejected. Zero means balancees are never ejected.
+	ConsecutiveFailures int
+	//Duration is how long an ejected balancee is left unhealthy before it is offered requests again. Defaults to 30s.
+	Duration time.Duration
+}
+
+//ejection is a balancee's time out of rotation, ended early by SetHealthy or Remove
+type ejection struct {
+	timer *time.Timer
+}
+
+//RecordSuccess notes a request to a balancee which did not fail, ending any run of failures towards its ejection
+func (p *Pool) RecordSuccess(u *url.URL) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.retired[u] != nil {
+		return
+	}
+	delete(p.failures, *u)
+}
+
+//recordFailure counts a failure towards a balancee's ejection, ejecting it once enough have happened in a row. The
+//pool's lock must be held.
+func (p *Pool) recordFailure(u *url.URL) {
+	if p.ejection.ConsecutiveFailures <= 0 {
+		return
+	}
+	p.failures[*u]++
+	if p.failures[*u] < p.ejection.ConsecutiveFailures || p.unhealthy[*u] {
+		return
+	}
+	p.unhealthy[*u] = true
+	var key = *u
+	var e = &ejection{}
+	p.ejections[key] = e
+	e.timer = time.AfterFunc(p.ejection.Duration, func() {
+		p.readmit(key, e)
+	})
+}
+
+//readmit puts an ejected balancee back into rotation, unless its ejection has already been ended
+func (p *Pool) readmit(u url.URL, e *ejection) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.ejections[u] != e {
+		return
+	}
+	p.endEjection(&u)
+	delete(p.unhealthy, u)
+	p.queue.signal(p.limit(&u))
+}
+
+//endEjection forgets a balancee's failures and any ejection still running. The pool's lock must be held.
+func (p *Pool) endEjection(u *url.URL) {
+	if e, ok := p.ejections[*u]; ok {
+		e.timer.Stop()
+		delete(p.ejections, *u)
+	}
+	delete(p.failures, *u)
+}
@@ -0,0 +1,71 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+//ErrorKind classifies why a request to a balancee failed
+type ErrorKind int
+
+const (
+	//DialError means the balancee could not be connected to, so it never saw the request
+	DialError ErrorKind = iota
+	//TimeoutError means the balancee was connected to but took too long to answer
+	TimeoutError
+	//ResponseError means the balancee's answer could not be read, or the connection to it broke
+	ResponseError
+	//GRPCError means the balancee answered a gRPC call with a status saying it is failing, such as UNAVAILABLE
+	GRPCError
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case DialError:
+		return "dial"
+	case TimeoutError:
+		return "timeout"
+	case ResponseError:
+		return "response"
+	case GRPCError:
+		return "grpc"
+	}
+	return "unknown"
+}
+
+//Classify decides what kind of failure err, from sending a request to a balancee, was
+func Classify(err error) ErrorKind {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return DialError
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return DialError
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return TimeoutError
+	}
+	return ResponseError
+}
+
+//ErrorReporter is told about each failed request to a balancee
+type ErrorReporter func(kind ErrorKind, err error)
+
+type errorReporterContextKey struct{}
+
+//WithErrorReporter gives back a copy of ctx whose requests report their failures to reporter. Balancers use it to
+//hear how their balancees are failing.
+func WithErrorReporter(ctx context.Context, reporter ErrorReporter) context.Context {
+	return context.WithValue(ctx, errorReporterContextKey{}, reporter)
+}
+
+//ReportError tells the ErrorReporter carried by ctx, if any, about a failed request. Handlers which send requests on
+//to balancees call it, as forward.Forwarder does.
+func ReportError(ctx context.Context, kind ErrorKind, err error) {
+	if reporter, ok := ctx.Value(errorReporterContextKey{}).(ErrorReporter); ok {
+		reporter(kind, err)
+	}
+}
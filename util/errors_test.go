@@ -0,0 +1,23 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	if Classify(&net.OpError{Op: "dial", Err: errors.New("refused")}) != DialError {
+		t.Fatalf("Expected a dial error")
+	}
+	if Classify(&net.DNSError{Err: "no such host", Name: "nowhere"}) != DialError {
+		t.Fatalf("Expected a DNS failure to be a dial error")
+	}
+	if Classify(context.DeadlineExceeded) != TimeoutError {
+		t.Fatalf("Expected a timeout")
+	}
+	if Classify(errors.New("malformed")) != ResponseError {
+		t.Fatalf("Expected a response error")
+	}
+}
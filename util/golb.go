@@ -11,3 +11,9 @@ type LoadBalancer interface {
 	Add(u *url.URL) (err error)
 	Remove(u *url.URL) (err error)
 }
+
+//LoadReporter is implemented by load balancers which can report their total outstanding requests, so that balancers
+//built on top of them can see how loaded they are
+type LoadReporter interface {
+	Outstanding() int
+}
@@ -0,0 +1,49 @@
+package util
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//gRPC status codes which say something about the balancee rather than the call
+const (
+	grpcDeadlineExceeded  = 4
+	grpcResourceExhausted = 8
+	grpcInternal          = 13
+	grpcUnavailable       = 14
+	grpcDataLoss          = 15
+)
+
+//IsGRPC reports whether req is a gRPC call
+func IsGRPC(req *http.Request) bool {
+	return strings.HasPrefix(req.Header.Get("Content-Type"), "application/grpc")
+}
+
+//GRPCStatus gives back the gRPC status code in header, which may be a response's headers, for calls which fail
+//straight away, or its trailers. Trailers written through a ResponseWriter without being announced are found too.
+func GRPCStatus(header http.Header) (int, bool) {
+	var value = header.Get("Grpc-Status")
+	if value == "" {
+		value = header.Get(http.TrailerPrefix + "Grpc-Status")
+	}
+	if value == "" {
+		return 0, false
+	}
+	var code, err = strconv.Atoi(value)
+	return code, err == nil
+}
+
+//GRPCFailure reports whether a gRPC status code means the balancee is failing, rather than that the call was bad
+func GRPCFailure(code int) bool {
+	switch code {
+	case grpcDeadlineExceeded, grpcResourceExhausted, grpcInternal, grpcUnavailable, grpcDataLoss:
+		return true
+	}
+	return false
+}
+
+//GRPCOverloaded reports whether a gRPC status code means the balancee is overloaded, as a 503 would
+func GRPCOverloaded(code int) bool {
+	return code == grpcResourceExhausted || code == grpcUnavailable
+}
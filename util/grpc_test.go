@@ -0,0 +1,20 @@
+package util
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestGRPCStatus(t *testing.T) {
+	var header = http.Header{}
+	if _, ok := GRPCStatus(header); ok {
+		t.Fatalf("Expected no status in an empty header")
+	}
+	header.Set(http.TrailerPrefix+"Grpc-Status", "14")
+	if code, ok := GRPCStatus(header); !ok || code != 14 || !GRPCFailure(code) || !GRPCOverloaded(code) {
+		t.Fatalf("Expected UNAVAILABLE to be found behind the trailer prefix, got %d", code)
+	}
+	if GRPCFailure(5) || GRPCFailure(0) {
+		t.Fatalf("NOT_FOUND and OK are the caller's business, not failures of the balancee")
+	}
+}
@@ -0,0 +1,16 @@
+package util
+
+import "time"
+
+//Limiter learns how many requests a single balancee can sustain in flight from how its requests go. Limiters are
+//only ever called with their pool locked, so need no locking of their own.
+type Limiter interface {
+	//Limit gives back the number of requests the balancee may currently have in flight
+	Limit() int
+	//OnSample is told how long a request took, how many requests were in flight when it finished, and whether the
+	//balancee dropped it (timed out, or answered with a 502, 503 or 504)
+	OnSample(latency time.Duration, inFlight int, dropped bool)
+}
+
+//LimiterFactory gives back a new Limiter for each balancee added to a pool
+type LimiterFactory func() Limiter
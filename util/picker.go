@@ -0,0 +1,54 @@
+package util
+
+import (
+	"net/http"
+	"net/url"
+)
+
+//Balancee is a point-in-time, read-only view of a balancee and its stats, handed to a Picker
+type Balancee struct {
+	URL         *url.URL
+	Outstanding int
+	//Limit is the most requests the balancee may have in flight, zero meaning no limit. Pickers are only ever handed
+	//balancees below their limit.
+	Limit int
+	//Labels is metadata about the balancee, such as the zone it runs in. It may be nil.
+	Labels Labels
+	//Healthy is false for balancees marked unhealthy. Pickers are only ever handed healthy balancees to choose from.
+	Healthy bool
+	//Connections is the number of long-lived connections, such as WebSockets, open to the balancee. They are counted
+	//apart from Outstanding, so that they don't crowd out short requests.
+	Connections int
+	//ConnectionWeight is how much each connection counts towards Load, compared to an outstanding request
+	ConnectionWeight float64
+}
+
+//Load is how busy the balancee is, counting its outstanding requests and its connections at their weight
+func (b Balancee) Load() float64 {
+	return float64(b.Outstanding) + b.ConnectionWeight*float64(b.Connections)
+}
+
+//Labels are metadata attached to a balancee, keyed by name
+type Labels map[string]string
+
+//Picker chooses one of the given balancees for a request. It is called with the pool locked, the slice is never
+//empty, and neither the slice nor its contents may be modified or retained after returning.
+type Picker interface {
+	Pick(balancees []Balancee, req *http.Request) (*url.URL, error)
+}
+
+//MembershipPicker is a Picker which also wants to see the balancees it can't currently choose, because they are
+//unhealthy or at their in-flight limit. Pools call PickWithMembership in place of Pick, with available being a subset
+//of all.
+type MembershipPicker interface {
+	Picker
+	PickWithMembership(available []Balancee, all []Balancee, req *http.Request) (*url.URL, error)
+}
+
+//PickerFunc allows an ordinary function to be used as a Picker
+type PickerFunc func(balancees []Balancee, req *http.Request) (*url.URL, error)
+
+//Pick calls f(balancees, req)
+func (f PickerFunc) Pick(balancees []Balancee, req *http.Request) (*url.URL, error) {
+	return f(balancees, req)
+}
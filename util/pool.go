@@ -0,0 +1,546 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+//Pool owns balancee membership, in-flight accounting and stats, so that an algorithm only needs to supply a Picker
+type Pool struct {
+	keys           []*url.URL
+	outstanding    map[url.URL]int
+	highWatermark  map[url.URL]int
+	requestCounter map[url.URL]int
+	isTesting      bool
+	maxInFlight    int
+	newLimiter     LimiterFactory
+	limiters       map[url.URL]Limiter
+	labels         map[url.URL]Labels
+	unhealthy      map[url.URL]bool
+	errorCounts    map[url.URL]ErrorCounts
+	ejection       EjectionOptions
+	failures       map[url.URL]int
+	ejections      map[url.URL]*ejection
+	connections    map[url.URL]int
+	retired        map[*url.URL]*retiredCounts
+	connWeight     float64
+	all            []Balancee
+	queue          waitQueue
+	view           []Balancee
+	lock           *sync.Mutex
+}
+
+//retiredCounts are the requests and connections still in flight against a balancee which has been removed. Each Add
+//hands out a fresh URL for the balancee, so those acquired against an earlier generation can be told apart and never
+//touch the counts of one re-added since.
+type retiredCounts struct {
+	outstanding int
+	connections int
+}
+
+//ErrorCounts are how many requests to a balancee failed, by how they failed
+type ErrorCounts struct {
+	Dial     int
+	Timeout  int
+	Response int
+	GRPC     int
+}
+
+//PoolOptions holds the optional configuration for a Pool
+type PoolOptions struct {
+	IsTesting bool
+	//MaxInFlight is the most outstanding requests any one balancee may have. Zero means no limit.
+	MaxInFlight int
+	//Limiter, when set, learns each balancee's in-flight limit instead of using the static MaxInFlight
+	Limiter LimiterFactory
+	//Queue configures waiting for a slot when every balancee is at its in-flight limit
+	Queue QueueOptions
+	//ConnectionWeight is how much each long-lived connection counts towards a balancee's Load, compared to an
+	//outstanding request. Zero or less defaults to 1, counting a connection as one more request.
+	ConnectionWeight float64
+	//IgnoreConnections leaves long-lived connections out of load altogether, whatever ConnectionWeight says
+	IgnoreConnections bool
+	//Ejection configures taking balancees which keep failing out of rotation for a while
+	Ejection EjectionOptions
+}
+
+//NewPool gives a new Pool back
+func NewPool(balancees []url.URL, options PoolOptions) *Pool {
+	var p = Pool{
+		outstanding: make(map[url.URL]int),
+		maxInFlight: options.MaxInFlight,
+		newLimiter:  options.Limiter,
+		limiters:    make(map[url.URL]Limiter),
+		labels:      make(map[url.URL]Labels),
+		unhealthy:   make(map[url.URL]bool),
+		errorCounts: make(map[url.URL]ErrorCounts),
+		ejection:    options.Ejection,
+		failures:    make(map[url.URL]int),
+		ejections:   make(map[url.URL]*ejection),
+		connections: make(map[url.URL]int),
+		retired:     make(map[*url.URL]*retiredCounts),
+		connWeight:  options.ConnectionWeight,
+		queue:       waitQueue{options: options.Queue},
+		lock:        &sync.Mutex{},
+	}
+	if options.IgnoreConnections {
+		p.connWeight = 0
+	} else if p.connWeight <= 0 {
+		p.connWeight = 1
+	}
+	if p.ejection.Duration <= 0 {
+		p.ejection.Duration = 30 * time.Second
+	}
+	if options.IsTesting {
+		p.isTesting = true
+		p.requestCounter = make(map[url.URL]int)
+		p.highWatermark = make(map[url.URL]int)
+	}
+	for index := range balancees {
+		p.add(&balancees[index])
+	}
+	return &p
+}
+
+//Acquire chooses a balancee for req with picker and counts a request against it. Every successful Acquire must be
+//paired with a Release. If req's context is done before a balancee is chosen, its error is returned instead.
+//
+//When every balancee is at its in-flight limit the request waits in the queue for one to be released, and
+//ErrSaturated or ErrQueueTimeout is returned if it can't.
+func (p *Pool) Acquire(picker Picker, req *http.Request) (*url.URL, error) {
+	var ctx = context.Background()
+	if req != nil {
+		ctx = req.Context()
+	}
+	var w *waiter
+	var deadline <-chan time.Time
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for {
+		if err := ctx.Err(); err != nil {
+			p.abandon(w)
+			return nil, err
+		}
+		var chosen, err = p.tryAcquire(picker, req, false)
+		if err != ErrSaturated {
+			return chosen, err
+		}
+		if w == nil {
+			if p.queue.full() {
+				return nil, ErrSaturated
+			}
+			w = &waiter{}
+			if p.queue.options.MaxWait > 0 {
+				var timer = time.NewTimer(p.queue.options.MaxWait)
+				defer timer.Stop()
+				deadline = timer.C
+			}
+			w.ready = make(chan struct{})
+			p.queue.push(w)
+		} else {
+			w.ready = make(chan struct{})
+			w.signaled = false
+			p.queue.pushNext(w)
+		}
+		p.lock.Unlock()
+		select {
+		case <-w.ready:
+		case <-deadline:
+			p.lock.Lock()
+			p.abandon(w)
+			return nil, ErrQueueTimeout
+		case <-ctx.Done():
+		}
+		p.lock.Lock()
+	}
+}
+
+//AcquireConnection chooses a balancee for req, which will hold a long-lived connection such as a WebSocket, and counts
+//the connection against it. Connections are counted apart from requests and are not held to in-flight limits, so
+//they never wait in the queue. Every successful AcquireConnection must be paired with a ReleaseConnection.
+func (p *Pool) AcquireConnection(picker Picker, req *http.Request) (*url.URL, error) {
+	if req != nil {
+		if err := req.Context().Err(); err != nil {
+			return nil, err
+		}
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.tryAcquire(picker, req, true)
+}
+
+//abandon gives up w's place in the queue, passing on any slot it was signaled for. The pool must be locked.
+func (p *Pool) abandon(w *waiter) {
+	if w == nil {
+		return
+	}
+	if !p.queue.remove(w) && w.signaled {
+		p.queue.signal(1)
+	}
+}
+
+//tryAcquire makes one attempt at choosing a balancee below its in-flight limit, or any balancee at all for a
+//connection. The pool must be locked.
+func (p *Pool) tryAcquire(picker Picker, req *http.Request, connection bool) (*url.URL, error) {
+	//Special case: If balancees are nil or empty, return an error.
+	if len(p.keys) == 0 {
+		return nil, ErrNoBalancees
+	}
+	var membershipPicker, wantsMembership = picker.(MembershipPicker)
+	var healthy = 0
+	p.view = p.view[:0]
+	p.all = p.all[:0]
+	for _, key := range p.keys {
+		var balancee = Balancee{
+			URL:              key,
+			Outstanding:      p.outstanding[*key],
+			Limit:            p.limit(key),
+			Labels:           p.labels[*key],
+			Healthy:          !p.unhealthy[*key],
+			Connections:      p.connections[*key],
+			ConnectionWeight: p.connWeight,
+		}
+		if wantsMembership {
+			p.all = append(p.all, balancee)
+		}
+		if !balancee.Healthy {
+			continue
+		}
+		healthy++
+		if !connection && balancee.Limit > 0 && balancee.Outstanding >= balancee.Limit {
+			continue
+		}
+		p.view = append(p.view, balancee)
+	}
+	if healthy == 0 {
+		return nil, ErrNoHealthyBalancees
+	}
+	if len(p.view) == 0 {
+		return nil, ErrSaturated
+	}
+	var chosen *url.URL
+	//Special case: If balancees is 1, there is no need to balance
+	if len(p.view) == 1 {
+		chosen = p.view[0].URL
+	} else {
+		var err error
+		if wantsMembership {
+			chosen, err = membershipPicker.PickWithMembership(p.view, p.all, req)
+		} else {
+			chosen, err = picker.Pick(p.view, req)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var offered = false
+		for _, balancee := range p.view {
+			if *balancee.URL == *chosen {
+				//Hand out the pool's own URL, which identifies this generation of the balancee
+				chosen = balancee.URL
+				offered = true
+				break
+			}
+		}
+		if !offered {
+			return nil, fmt.Errorf("Picker chose %s, which is not an available balancee", chosen)
+		}
+	}
+	if connection {
+		p.connections[*chosen]++
+		return chosen, nil
+	}
+	p.outstanding[*chosen]++
+	if p.isTesting {
+		if p.outstanding[*chosen] > p.highWatermark[*chosen] {
+			p.highWatermark[*chosen] = p.outstanding[*chosen]
+		}
+		p.requestCounter[*chosen]++
+	}
+	return chosen, nil
+}
+
+//limit gives back the in-flight limit for a balancee, zero meaning no limit. The pool must be locked.
+func (p *Pool) limit(u *url.URL) int {
+	if limiter, ok := p.limiters[*u]; ok {
+		return limiter.Limit()
+	}
+	return p.maxInFlight
+}
+
+//Observe feeds how a request to u went into its Limiter, if the pool has one. It should be called before the request
+//is released.
+func (p *Pool) Observe(u *url.URL, latency time.Duration, dropped bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var limiter, ok = p.limiters[*u]
+	if !ok || p.retired[u] != nil {
+		return
+	}
+	var before = limiter.Limit()
+	limiter.OnSample(latency, p.outstanding[*u], dropped)
+	//A raised limit makes room for waiting requests
+	if after := limiter.Limit(); after > before {
+		p.queue.signal(after - before)
+	}
+}
+
+//Adaptive reports whether the pool learns its in-flight limits, and so wants to Observe requests
+func (p *Pool) Adaptive() bool {
+	return p.newLimiter != nil
+}
+
+//Limit gives back the current in-flight limit for a particular balancee, zero meaning no limit
+func (p *Pool) Limit(u *url.URL) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.limit(u)
+}
+
+//RetryAfter gives back how long clients turned away by a saturated pool should be told to wait before retrying
+func (p *Pool) RetryAfter() time.Duration {
+	return p.queue.retryAfter()
+}
+
+//Release marks a request acquired against u as finished. Releasing a balancee that has since been removed only
+//settles its own accounting, even if it has been added again.
+func (p *Pool) Release(u *url.URL) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if retired, ok := p.retired[u]; ok {
+		retired.outstanding--
+		p.settle(u, retired)
+		return
+	}
+	if count, ok := p.outstanding[*u]; ok && count > 0 {
+		p.outstanding[*u]--
+		p.queue.signal(1)
+	}
+}
+
+//Promote turns a request acquired against u into a long-lived connection, such as a gRPC stream, freeing its slot
+//for other requests. It must then be released with ReleaseConnection rather than Release.
+func (p *Pool) Promote(u *url.URL) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if retired, ok := p.retired[u]; ok {
+		retired.outstanding--
+		retired.connections++
+		return
+	}
+	if count, ok := p.outstanding[*u]; ok && count > 0 {
+		p.outstanding[*u]--
+		p.connections[*u]++
+		p.queue.signal(1)
+	}
+}
+
+//ReleaseConnection marks a connection acquired against u as closed
+func (p *Pool) ReleaseConnection(u *url.URL) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if retired, ok := p.retired[u]; ok {
+		retired.connections--
+		p.settle(u, retired)
+		return
+	}
+	if count, ok := p.connections[*u]; ok && count > 0 {
+		p.connections[*u]--
+	}
+}
+
+//settle forgets a removed balancee once nothing is in flight against it any more. The pool must be locked.
+func (p *Pool) settle(u *url.URL, retired *retiredCounts) {
+	if retired.outstanding <= 0 && retired.connections <= 0 {
+		delete(p.retired, u)
+	}
+}
+
+//Connections returns the number of long-lived connections open to a particular balancee
+func (p *Pool) Connections(u *url.URL) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.connections[*u]
+}
+
+//Add a url to the pool
+func (p *Pool) Add(u *url.URL) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.add(u)
+	//A new balancee has room for up to its limit of the waiting requests
+	p.queue.signal(p.limit(u))
+	return nil
+}
+
+func (p *Pool) add(u *url.URL) {
+	if _, ok := p.outstanding[*u]; ok {
+		//Looks like we already have this url.
+		return
+	}
+	var key = *u
+	p.keys = append(p.keys, &key)
+	p.outstanding[*u] = 0
+	if p.newLimiter != nil {
+		p.limiters[*u] = p.newLimiter()
+	}
+}
+
+//Remove a url from the pool. Requests already in flight against it may still Release it.
+func (p *Pool) Remove(u *url.URL) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var newkeys = make([]*url.URL, 0, len(p.keys))
+	for _, x := range p.keys {
+		if *x != *u {
+			newkeys = append(newkeys, x)
+		} else if p.outstanding[*u] > 0 || p.connections[*u] > 0 {
+			p.retired[x] = &retiredCounts{outstanding: p.outstanding[*u], connections: p.connections[*u]}
+		}
+	}
+	p.keys = newkeys
+	delete(p.outstanding, *u)
+	delete(p.limiters, *u)
+	delete(p.labels, *u)
+	delete(p.unhealthy, *u)
+	delete(p.errorCounts, *u)
+	p.endEjection(u)
+	delete(p.connections, *u)
+	//Waiting requests may have nothing left to wait for
+	p.queue.signal(len(p.queue.waiters))
+	return nil
+}
+
+//SetLabels attaches metadata, such as the zone a balancee runs in, to a balancee already in the pool
+func (p *Pool) SetLabels(u *url.URL, labels Labels) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.outstanding[*u]; !ok {
+		return fmt.Errorf("%s is not a balancee", u)
+	}
+	p.labels[*u] = labels
+	return nil
+}
+
+//SetHealthy marks a balancee as healthy or unhealthy. Unhealthy balancees are never offered to a Picker to choose.
+//Balancees are healthy until told otherwise, or until they are ejected for failing too many requests in a row. Being
+//told overrides any ejection, so an ejected balancee marked unhealthy stays so until it is marked healthy again.
+func (p *Pool) SetHealthy(u *url.URL, healthy bool) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.outstanding[*u]; !ok {
+		return fmt.Errorf("%s is not a balancee", u)
+	}
+	p.endEjection(u)
+	if healthy {
+		if p.unhealthy[*u] {
+			delete(p.unhealthy, *u)
+			p.queue.signal(p.limit(u))
+		}
+		return nil
+	}
+	p.unhealthy[*u] = true
+	return nil
+}
+
+//Healthy reports whether a particular balancee is healthy
+func (p *Pool) Healthy(u *url.URL) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var _, ok = p.outstanding[*u]
+	return ok && !p.unhealthy[*u]
+}
+
+//HealthyCount gives back how many balancees are healthy, and how many there are in all
+func (p *Pool) HealthyCount() (int, int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.keys) - len(p.unhealthy), len(p.keys)
+}
+
+//Labels gives back the metadata attached to a particular balancee
+func (p *Pool) Labels(u *url.URL) Labels {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.labels[*u]
+}
+
+//NumberOfBalancees returns the number of balancees that this pool knows about
+func (p *Pool) NumberOfBalancees() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.keys)
+}
+
+//Balancees returns a copy of the urls of the balancees that this pool knows about
+func (p *Pool) Balancees() []*url.URL {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var keysCopy = make([]*url.URL, len(p.keys))
+	copy(keysCopy, p.keys)
+	return keysCopy
+}
+
+//OutstandingRequests returns the number of outstanding requests for a particular balancee
+func (p *Pool) OutstandingRequests(u *url.URL) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.outstanding[*u]
+}
+
+//TotalOutstanding returns the number of outstanding requests across every balancee
+func (p *Pool) TotalOutstanding() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var total = 0
+	for _, outstanding := range p.outstanding {
+		total += outstanding
+	}
+	return total
+}
+
+//HighWatermark returns the most outstanding requests for a particular balancee. Only tracked when testing.
+func (p *Pool) HighWatermark(u *url.URL) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.highWatermark[*u]
+}
+
+//RequestCount gives back the number of requests that have come into a particular URL. Only tracked when testing.
+func (p *Pool) RequestCount(u *url.URL) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.requestCounter[*u]
+}
+
+//RecordError counts a failed request against a balancee still in the pool, and towards its ejection
+func (p *Pool) RecordError(u *url.URL, kind ErrorKind) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if _, ok := p.outstanding[*u]; !ok || p.retired[u] != nil {
+		return
+	}
+	var counts = p.errorCounts[*u]
+	switch kind {
+	case DialError:
+		counts.Dial++
+	case TimeoutError:
+		counts.Timeout++
+	case GRPCError:
+		counts.GRPC++
+	default:
+		counts.Response++
+	}
+	p.errorCounts[*u] = counts
+	p.recordFailure(u)
+}
+
+//Errors gives back how many requests to a balancee have failed, by how they failed
+func (p *Pool) Errors(u *url.URL) ErrorCounts {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.errorCounts[*u]
+}
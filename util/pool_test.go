@@ -0,0 +1,294 @@
+package util
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var urlA, _ = url.Parse("http://a")
+var urlB, _ = url.Parse("http://b")
+var urlC, _ = url.Parse("http://c")
+
+var pickFirst = PickerFunc(func(balancees []Balancee, req *http.Request) (*url.URL, error) {
+	return balancees[0].URL, nil
+})
+
+func TestPoolEmptyReturnsError(t *testing.T) {
+	var pool = NewPool([]url.URL{}, PoolOptions{})
+	if _, err := pool.Acquire(pickFirst, nil); err == nil {
+		t.Fatalf("An empty pool should not be able to acquire a balancee")
+	}
+}
+
+func TestPoolAddIgnoresDuplicates(t *testing.T) {
+	var pool = NewPool([]url.URL{*urlA}, PoolOptions{})
+	var duplicate, _ = url.Parse("http://a")
+	pool.Add(duplicate)
+	pool.Add(urlB)
+	if pool.NumberOfBalancees() != 2 {
+		t.Fatalf("Expected 2 balancees, had %d", pool.NumberOfBalancees())
+	}
+}
+
+func TestPoolRemoveDropsBalancee(t *testing.T) {
+	var pool = NewPool([]url.URL{*urlA, *urlB, *urlC}, PoolOptions{})
+	var toRemove, _ = url.Parse("http://b")
+	pool.Remove(toRemove)
+	if pool.NumberOfBalancees() != 2 {
+		t.Fatalf("Expected 2 balancees after removal, had %d", pool.NumberOfBalancees())
+	}
+	for _, u := range pool.Balancees() {
+		if *u == *urlB {
+			t.Fatalf("Removed balancee is still in the pool")
+		}
+	}
+}
+
+func TestPoolAccounting(t *testing.T) {
+	var pool = NewPool([]url.URL{*urlA, *urlB}, PoolOptions{IsTesting: true})
+	var first, _ = pool.Acquire(pickFirst, nil)
+	var second, _ = pool.Acquire(pickFirst, nil)
+	if pool.OutstandingRequests(urlA) != 2 {
+		t.Fatalf("Expected 2 outstanding requests, had %d", pool.OutstandingRequests(urlA))
+	}
+	pool.Release(first)
+	pool.Release(second)
+	if pool.OutstandingRequests(urlA) != 0 {
+		t.Fatalf("Expected 0 outstanding requests, had %d", pool.OutstandingRequests(urlA))
+	}
+	if pool.HighWatermark(urlA) != 2 || pool.RequestCount(urlA) != 2 {
+		t.Fatalf("Stats were not kept while testing")
+	}
+}
+
+func TestPoolReleaseAfterRemove(t *testing.T) {
+	var pool = NewPool([]url.URL{*urlA, *urlB}, PoolOptions{})
+	var acquired, _ = pool.Acquire(pickFirst, nil)
+	pool.Remove(acquired)
+	pool.Release(acquired)
+	pool.Add(acquired)
+	if pool.OutstandingRequests(urlA) != 0 {
+		t.Fatalf("Releasing a removed balancee should not leak into a re-added one")
+	}
+}
+
+func TestPoolStaleReleaseAfterReAdd(t *testing.T) {
+	var pool = NewPool([]url.URL{*urlA}, PoolOptions{})
+	var stale, _ = pool.Acquire(pickFirst, nil)
+	pool.Remove(urlA)
+	pool.Add(urlA)
+	var current, _ = pool.Acquire(pickFirst, nil)
+	pool.Release(stale)
+	if pool.OutstandingRequests(urlA) != 1 {
+		t.Fatalf("Releasing a request from before the balancee was re-added should not touch its new count")
+	}
+	pool.Release(current)
+	if pool.OutstandingRequests(urlA) != 0 || len(pool.retired) != 0 {
+		t.Fatalf("Expected every request to be settled")
+	}
+}
+
+func TestPoolRejectsUnknownChoice(t *testing.T) {
+	var pool = NewPool([]url.URL{*urlA, *urlB}, PoolOptions{})
+	var _, err = pool.Acquire(PickerFunc(func(balancees []Balancee, req *http.Request) (*url.URL, error) {
+		return urlC, nil
+	}), nil)
+	if err == nil {
+		t.Fatalf("A strategy choosing a url outside of the pool should be an error")
+	}
+}
+
+func TestPoolRespectsMaxInFlight(t *testing.T) {
+	var pool = NewPool([]url.URL{*urlA, *urlB}, PoolOptions{MaxInFlight: 1})
+	var first, _ = pool.Acquire(pickFirst, nil)
+	var second, _ = pool.Acquire(pickFirst, nil)
+	if *first == *second {
+		t.Fatalf("A balancee at its in-flight limit was chosen again")
+	}
+	if _, err := pool.Acquire(pickFirst, nil); err != ErrSaturated {
+		t.Fatalf("Expected ErrSaturated with every balancee at its limit, got %v", err)
+	}
+}
+
+func TestPoolRejectsChoicesNotOffered(t *testing.T) {
+	var pool = NewPool([]url.URL{*urlA, *urlB, *urlC}, PoolOptions{MaxInFlight: 1})
+	pool.SetHealthy(urlA, false)
+	var pickA = PickerFunc(func(balancees []Balancee, req *http.Request) (*url.URL, error) {
+		return urlA, nil
+	})
+	if _, err := pool.Acquire(pickA, nil); err == nil {
+		t.Fatalf("A picker choosing an unhealthy balancee should be an error")
+	}
+	pool.SetHealthy(urlA, true)
+	pool.Acquire(pickA, nil)
+	if _, err := pool.Acquire(pickA, nil); err == nil || pool.OutstandingRequests(urlA) != 1 {
+		t.Fatalf("A picker choosing a balancee at its in-flight limit should be an error")
+	}
+}
+
+func TestPoolRemoveWakesQueuedRequests(t *testing.T) {
+	var pool = NewPool([]url.URL{*urlA}, PoolOptions{
+		MaxInFlight: 1,
+		Queue:       QueueOptions{MaxDepth: 1},
+	})
+	pool.Acquire(pickFirst, nil)
+	var failed = make(chan error)
+	go func() {
+		var _, err = pool.Acquire(pickFirst, nil)
+		failed <- err
+	}()
+	for {
+		pool.lock.Lock()
+		var waiting = len(pool.queue.waiters)
+		pool.lock.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	pool.Remove(urlA)
+	select {
+	case err := <-failed:
+		if err != ErrNoBalancees {
+			t.Fatalf("Expected ErrNoBalancees once the only balancee was removed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("A queued request was left waiting on a removed balancee")
+	}
+}
+
+func TestPoolQueuedRequestGetsReleasedSlot(t *testing.T) {
+	var pool = NewPool([]url.URL{*urlA}, PoolOptions{
+		MaxInFlight: 1,
+		Queue:       QueueOptions{MaxDepth: 1},
+	})
+	var first, _ = pool.Acquire(pickFirst, nil)
+	var acquired = make(chan *url.URL)
+	go func() {
+		var u, _ = pool.Acquire(pickFirst, nil)
+		acquired <- u
+	}()
+	for {
+		pool.lock.Lock()
+		var waiting = len(pool.queue.waiters)
+		pool.lock.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := pool.Acquire(pickFirst, nil); err != ErrSaturated {
+		t.Fatalf("Expected ErrSaturated with a full queue, got %v", err)
+	}
+	pool.Release(first)
+	if u := <-acquired; u == nil || *u != *urlA {
+		t.Fatalf("The queued request did not get the released slot")
+	}
+}
+
+func TestPoolQueueTimesOut(t *testing.T) {
+	var pool = NewPool([]url.URL{*urlA}, PoolOptions{
+		MaxInFlight: 1,
+		Queue:       QueueOptions{MaxDepth: 1, MaxWait: 10 * time.Millisecond},
+	})
+	pool.Acquire(pickFirst, nil)
+	if _, err := pool.Acquire(pickFirst, nil); err != ErrQueueTimeout {
+		t.Fatalf("Expected ErrQueueTimeout, got %v", err)
+	}
+	if len(pool.queue.waiters) != 0 {
+		t.Fatalf("A timed out request was left in the queue")
+	}
+}
+
+func TestWaitQueueDiscipline(t *testing.T) {
+	var first, second = &waiter{ready: make(chan struct{})}, &waiter{ready: make(chan struct{})}
+	var fifo = waitQueue{options: QueueOptions{Discipline: FIFO}}
+	fifo.push(first)
+	fifo.push(second)
+	fifo.signal(1)
+	if !first.signaled || second.signaled {
+		t.Fatalf("FIFO should signal the longest waiting request first")
+	}
+	first, second = &waiter{ready: make(chan struct{})}, &waiter{ready: make(chan struct{})}
+	var lifo = waitQueue{options: QueueOptions{Discipline: LIFO}}
+	lifo.push(first)
+	lifo.push(second)
+	lifo.signal(1)
+	if first.signaled || !second.signaled {
+		t.Fatalf("LIFO should signal the most recently waiting request first")
+	}
+}
+
+type fixedLimiter struct {
+	limit   int
+	samples int
+}
+
+func (f *fixedLimiter) Limit() int {
+	return f.limit
+}
+
+func (f *fixedLimiter) OnSample(latency time.Duration, inFlight int, dropped bool) {
+	f.samples++
+	if dropped {
+		f.limit--
+	} else {
+		f.limit++
+	}
+}
+
+func TestPoolUsesLearnedLimits(t *testing.T) {
+	var pool = NewPool([]url.URL{*urlA, *urlB}, PoolOptions{
+		Limiter: func() Limiter {
+			return &fixedLimiter{limit: 1}
+		},
+	})
+	var first, _ = pool.Acquire(pickFirst, nil)
+	pool.Acquire(pickFirst, nil)
+	if _, err := pool.Acquire(pickFirst, nil); err != ErrSaturated {
+		t.Fatalf("Expected ErrSaturated with every balancee at its learned limit, got %v", err)
+	}
+	pool.Observe(first, time.Millisecond, false)
+	if pool.Limit(first) != 2 {
+		t.Fatalf("Expected the observed balancee's limit to grow to 2, was %d", pool.Limit(first))
+	}
+	if _, err := pool.Acquire(pickFirst, nil); err != nil {
+		t.Fatalf("Expected a raised limit to make room for another request, got %v", err)
+	}
+}
+
+func TestPoolEjectsBalanceesWhichKeepFailing(t *testing.T) {
+	var pool = NewPool([]url.URL{*urlA, *urlB}, PoolOptions{
+		Ejection: EjectionOptions{ConsecutiveFailures: 2, Duration: 20 * time.Millisecond},
+	})
+	pool.RecordError(urlA, GRPCError)
+	pool.RecordSuccess(urlA)
+	pool.RecordError(urlA, DialError)
+	if !pool.Healthy(urlA) {
+		t.Fatalf("Expected a success to end the run of failures")
+	}
+	pool.RecordError(urlA, TimeoutError)
+	if pool.Healthy(urlA) {
+		t.Fatalf("Expected two failures in a row to eject the balancee")
+	}
+	for i := 0; i < 10; i++ {
+		if u, _ := pool.Acquire(pickFirst, nil); *u != *urlB {
+			t.Fatalf("Expected an ejected balancee to be offered no requests")
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !pool.Healthy(urlA) {
+		t.Fatalf("Expected the balancee to be readmitted once its ejection was over")
+	}
+
+	//Being told a balancee is unhealthy outlasts its ejection
+	pool.RecordError(urlA, DialError)
+	pool.RecordError(urlA, DialError)
+	pool.SetHealthy(urlA, false)
+	time.Sleep(50 * time.Millisecond)
+	if pool.Healthy(urlA) {
+		t.Fatalf("Expected a balancee marked unhealthy to stay so after its ejection")
+	}
+}
@@ -0,0 +1,104 @@
+package util
+
+import (
+	"errors"
+	"time"
+)
+
+//QueueDiscipline decides which waiting request is given the next free slot
+type QueueDiscipline int
+
+const (
+	//FIFO gives the next free slot to the request which has waited longest
+	FIFO QueueDiscipline = iota
+	//LIFO gives the next free slot to the request which has waited least, which keeps latency low for most requests
+	//when overloaded at the cost of starving a few
+	LIFO
+)
+
+//ErrNoBalancees is returned when a pool has no balancees to choose from
+var ErrNoBalancees = errors.New("Number of balancees is zero, cannot handle")
+
+//ErrNoHealthyBalancees is returned when every balancee in a pool has been marked unhealthy
+var ErrNoHealthyBalancees = errors.New("No balancee is healthy, cannot handle")
+
+//ErrSaturated is returned when every balancee is at its in-flight limit and the wait queue is full or disabled
+var ErrSaturated = errors.New("Every balancee is at its in-flight limit")
+
+//ErrQueueTimeout is returned when a request waited longer than the queue's MaxWait for a free slot
+var ErrQueueTimeout = errors.New("Timed out waiting for a balancee to free up")
+
+//QueueOptions configures how requests wait when every balancee is at its in-flight limit
+type QueueOptions struct {
+	//MaxDepth is the most requests that may wait at once. Zero disables queueing.
+	MaxDepth int
+	//MaxWait is the longest a request may wait before giving up. Zero waits until the request's context is done.
+	MaxWait time.Duration
+	//Discipline defaults to FIFO
+	Discipline QueueDiscipline
+	//RetryAfter is suggested to clients which are turned away. Defaults to one second.
+	RetryAfter time.Duration
+}
+
+type waiter struct {
+	ready    chan struct{}
+	signaled bool
+}
+
+//waitQueue is not safe for concurrent use; the pool guards it with its own lock
+type waitQueue struct {
+	options QueueOptions
+	waiters []*waiter
+}
+
+func (q *waitQueue) full() bool {
+	return len(q.waiters) >= q.options.MaxDepth
+}
+
+//push adds w to the back of the queue
+func (q *waitQueue) push(w *waiter) {
+	q.waiters = append(q.waiters, w)
+}
+
+//pushNext puts w back where it will be the next to be signaled, for waiters which lost a freed slot to a newcomer
+func (q *waitQueue) pushNext(w *waiter) {
+	if q.options.Discipline == LIFO {
+		q.waiters = append(q.waiters, w)
+		return
+	}
+	q.waiters = append([]*waiter{w}, q.waiters...)
+}
+
+//signal wakes up to n waiters according to the queue discipline
+func (q *waitQueue) signal(n int) {
+	for ; n > 0 && len(q.waiters) > 0; n-- {
+		var w *waiter
+		if q.options.Discipline == LIFO {
+			w = q.waiters[len(q.waiters)-1]
+			q.waiters = q.waiters[:len(q.waiters)-1]
+		} else {
+			w = q.waiters[0]
+			q.waiters = q.waiters[1:]
+		}
+		w.signaled = true
+		close(w.ready)
+	}
+}
+
+//remove takes w out of the queue, reporting whether it was still waiting
+func (q *waitQueue) remove(w *waiter) bool {
+	for index, x := range q.waiters {
+		if x == w {
+			q.waiters = append(q.waiters[:index], q.waiters[index+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (q *waitQueue) retryAfter() time.Duration {
+	if q.options.RetryAfter <= 0 {
+		return time.Second
+	}
+	return q.options.RetryAfter
+}
@@ -1,6 +1,9 @@
 package util
 
-import "testing"
+import (
+	"sync"
+	"testing"
+)
 
 func TestGoRandomImplements(t *testing.T) {
 	var random RandomInt
@@ -30,3 +33,78 @@ func TestTestingRandom(t *testing.T) {
 	}
 
 }
+
+func TestShardedRandomIsReproducible(t *testing.T) {
+	var first = NewShardedRandom(42, 4)
+	var second = NewShardedRandom(42, 4)
+	var i = 0
+	for ; i < 100; i++ {
+		var a, _ = first.NextInt(0, 1000)
+		var b, _ = second.NextInt(0, 1000)
+		if a != b {
+			t.Fatalf("Two ShardedRandoms with the same seed gave different sequences")
+		}
+		if a < 0 || a >= 1000 {
+			t.Fatalf("ShardedRandom gave an answer outside of its range: %d", a)
+		}
+	}
+}
+
+func TestShardedRandomConcurrentUse(t *testing.T) {
+	var random = NewShardedRandom(1, 0)
+	var wg sync.WaitGroup
+	var i = 0
+	for ; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var j = 0
+			for ; j < 1000; j++ {
+				var nextInt, _ = random.NextInt(5, 10)
+				if nextInt < 5 || nextInt >= 10 {
+					t.Errorf("ShardedRandom gave an answer outside of its range: %d", nextInt)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSafeTestingRandom(t *testing.T) {
+	var values = []int{1, 3, 5}
+	var random = &SafeTestingRandom{
+		Values: values,
+	}
+	var wg sync.WaitGroup
+	var i = 0
+	for ; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var j = 0
+			for ; j < 10; j++ {
+				random.NextInt(0, 100)
+			}
+		}()
+	}
+	wg.Wait()
+	if random.CallCount() != 100 {
+		t.Fatalf("The safe testing random lost track of how many times it's been called! %d", random.CallCount())
+	}
+}
+
+func TestCryptoRandom(t *testing.T) {
+	var random RandomInt
+	random = CryptoRandom{}
+	var i = 0
+	for ; i < 100; i++ {
+		var nextInt, _ = random.NextInt(10, 20)
+		if nextInt < 10 || nextInt >= 20 {
+			t.Fatalf("CryptoRandom gave an answer outside of its range: %d", nextInt)
+		}
+	}
+	if _, err := random.NextInt(20, 10); err == nil {
+		t.Fatalf("CryptoRandom should refuse a minimum greater than its maximum")
+	}
+}
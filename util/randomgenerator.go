@@ -1,9 +1,6 @@
 package util
 
-import (
-	"errors"
-	"math/rand"
-)
+import "math/rand"
 
 //RandomInt gives a nextInt from its range which may or may not actually be random
 type RandomInt interface {
@@ -22,11 +19,8 @@ type TestingRandom struct {
 }
 
 func (g GoRandom) NextInt(minimum int, maximum int) (int, error) {
-	if maximum < minimum {
-		return 0, errors.New("Illegal state: Minimum is greater than maximum")
-	}
-	if maximum < 0 || minimum < 0 {
-		return 0, errors.New("Illegal state: Minimum and maximum must both be above zero")
+	if err := validateRange(minimum, maximum); err != nil {
+		return 0, err
 	}
 	var n = maximum - minimum
 	return rand.Intn(n) + minimum, nil
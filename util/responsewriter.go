@@ -0,0 +1,64 @@
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+//StatusRecorder remembers the status code written through it, while still letting handlers reach the flushing and
+//hijacking of the ResponseWriter it wraps
+type StatusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *StatusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *StatusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(b)
+}
+
+func (s *StatusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (s *StatusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := s.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, fmt.Errorf("%T does not support hijacking", s.ResponseWriter)
+}
+
+//Unwrap lets http.ResponseController find the original ResponseWriter
+func (s *StatusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+//StatusCode gives back the status written, defaulting to 200 as net/http does
+func (s *StatusRecorder) StatusCode() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
+
+//dropped reports whether the status is one a backend gives when it is overloaded or unreachable, including the gRPC
+//statuses which mean the same
+func (s *StatusRecorder) dropped() bool {
+	if code, ok := GRPCStatus(s.Header()); ok && GRPCOverloaded(code) {
+		return true
+	}
+	return s.status == http.StatusBadGateway || s.status == http.StatusServiceUnavailable || s.status == http.StatusGatewayTimeout
+}
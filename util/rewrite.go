@@ -0,0 +1,66 @@
+package util
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+//URLRewriter builds the URL a request is forwarded to, from the balancee chosen for it and the request as the client
+//sent it. It must give back a URL of its own, which the next handler is free to change.
+type URLRewriter func(balancee *url.URL, req *http.Request) *url.URL
+
+//JoinURL is the default URLRewriter. The scheme, user and host come from the balancee, the request's path is joined
+//onto the balancee's path, if it has one, and the request's query is added after the balancee's.
+func JoinURL(balancee *url.URL, req *http.Request) *url.URL {
+	var target = *balancee
+	if req == nil || req.URL == nil {
+		return &target
+	}
+	target.Path, target.RawPath = joinURLPath(balancee, req.URL)
+	switch {
+	case balancee.RawQuery == "":
+		target.RawQuery = req.URL.RawQuery
+	case req.URL.RawQuery != "":
+		target.RawQuery = balancee.RawQuery + "&" + req.URL.RawQuery
+	}
+	target.Fragment = ""
+	target.RawFragment = ""
+	return &target
+}
+
+//joinURLPath joins two paths with exactly one slash between them, keeping any escaping either had
+func joinURLPath(a *url.URL, b *url.URL) (string, string) {
+	if a.RawPath == "" && b.RawPath == "" {
+		return singleJoiningSlash(a.Path, b.Path), ""
+	}
+	var aPath = a.EscapedPath()
+	var bPath = b.EscapedPath()
+	var aSlash = strings.HasSuffix(aPath, "/")
+	var bSlash = strings.HasPrefix(bPath, "/")
+	switch {
+	case aSlash && bSlash:
+		return a.Path + b.Path[1:], aPath + bPath[1:]
+	case !aSlash && !bSlash:
+		return a.Path + "/" + b.Path, aPath + "/" + bPath
+	}
+	return a.Path + b.Path, aPath + bPath
+}
+
+func singleJoiningSlash(a string, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	}
+	var aSlash = strings.HasSuffix(a, "/")
+	var bSlash = strings.HasPrefix(b, "/")
+	switch {
+	case aSlash && bSlash:
+		return a + b[1:]
+	case !aSlash && !bSlash:
+		return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,85 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestJoinURL(t *testing.T) {
+	var cases = []struct {
+		balancee string
+		request  string
+		expected string
+	}{
+		{"http://a", "/page?x=1", "http://a/page?x=1"},
+		{"http://a:8080/", "/page", "http://a:8080/page"},
+		{"https://a/base", "/page", "https://a/base/page"},
+		{"https://a/base/", "/page/", "https://a/base/page/"},
+		{"http://a/base?key=1", "/page?x=1&y=2", "http://a/base/page?key=1&x=1&y=2"},
+		{"http://a?key=1", "/", "http://a/?key=1"},
+		{"http://user@a", "/page%2Fencoded", "http://user@a/page%2Fencoded"},
+		{"http://a/base%2Fencoded", "/page", "http://a/base%2Fencoded/page"},
+	}
+	for _, c := range cases {
+		var balancee, _ = url.Parse(c.balancee)
+		var req = httptest.NewRequest("GET", "http://client.example"+c.request, nil)
+		var joined = JoinURL(balancee, req)
+		if joined.String() != c.expected {
+			t.Fatalf("Expected %s joined with %s to be %s, got %s", c.balancee, c.request, c.expected, joined)
+		}
+		if joined == balancee {
+			t.Fatalf("JoinURL must give back a URL of its own")
+		}
+	}
+	var balancee, _ = url.Parse("http://a/base")
+	if JoinURL(balancee, &http.Request{}).String() != "http://a/base" {
+		t.Fatalf("A request without a URL should go to the balancee as it is")
+	}
+}
+
+func TestBalancerPreservesPathAndQuery(t *testing.T) {
+	var seen []*url.URL
+	var forwarded []string
+	var next = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen = append(seen, req.URL)
+		forwarded = append(forwarded, req.URL.String())
+		//A handler further on changing the URL must not affect the balancer or other requests
+		req.URL.Host = "changed"
+		var balancee, _ = BalanceeFromContext(req.Context())
+		balancee.Host = "changed"
+	})
+	var base, _ = url.Parse("http://a/api")
+	var balancer = NewBalancer([]url.URL{*base}, pickFirst, BalancerOptions{}, next)
+	balancer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users?id=1", nil))
+	balancer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users?id=2", nil))
+
+	if seen[0] == seen[1] {
+		t.Fatalf("Concurrent requests must not share a URL")
+	}
+	if forwarded[1] != "http://a/api/users?id=2" {
+		t.Fatalf("Expected the path and query to be kept, got %s", forwarded[1])
+	}
+	if balancer.OutstandingRequests(base) != 0 || balancer.NumberOfBalancees() != 1 {
+		t.Fatalf("Changing the forwarded URL changed the pool")
+	}
+}
+
+func TestBalancerUsesRewriter(t *testing.T) {
+	var seen *url.URL
+	var next = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen = req.URL
+	})
+	var balancer = NewBalancer([]url.URL{*urlA}, pickFirst, BalancerOptions{
+		Rewrite: func(balancee *url.URL, req *http.Request) *url.URL {
+			var target = JoinURL(balancee, req)
+			target.Path = "/v2" + target.Path
+			return target
+		},
+	}, next)
+	balancer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/users", nil))
+	if seen.String() != "http://a/v2/users" {
+		t.Fatalf("Expected the rewriter to decide the URL, got %s", seen)
+	}
+}
@@ -0,0 +1,166 @@
+package zone
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+
+	"github.com/jangie/goloadbalancers/util"
+)
+
+//ZoneAwarePicker keeps requests within the proxy's own zone, delegating the choice within a zone to another Picker
+//such as jsq.JoinShortestQueuePicker. When the local zone has too few healthy balancees, or is overloaded compared
+//to the rest, a proportional share of requests spills over to the other zones.
+type ZoneAwarePicker struct {
+	inner   util.Picker
+	options ZoneAwarePickerOptions
+}
+
+type ZoneAwarePickerOptions struct {
+	//LocalZone is the zone the proxy runs in. When empty every balancee is treated alike.
+	LocalZone string
+	//Label is the balancee label holding its zone. Defaults to "zone".
+	Label string
+	//MinHealthyPercent is the share of the local zone's balancees, between 0 and 1, that must be available for all
+	//requests to stay local. Below it, requests spill over in proportion to the share that is unavailable. Defaults to 0.7.
+	MinHealthyPercent float64
+	//MinLocalBalancees is the fewest available local balancees needed for any request to stay local. Defaults to 1.
+	MinLocalBalancees int
+	//OverloadFactor is how many times more outstanding requests the average local balancee may have than the average
+	//remote one before requests spill over. Used when balancees have no in-flight limits. Defaults to 2.
+	OverloadFactor float64
+	//OverloadUtilization is the share of the local zone's in-flight limits, between 0 and 1, in use above which requests
+	//spill over. Used when balancees have in-flight limits. Defaults to 0.8.
+	OverloadUtilization float64
+	//RandomGenerator decides which requests spill over. Defaults to util.GoRandom.
+	RandomGenerator util.RandomInt
+}
+
+//spillResolution is the granularity with which spill over probabilities are rolled
+const spillResolution = 10000
+
+//NewZoneAwarePicker gives a new ZoneAwarePicker back
+func NewZoneAwarePicker(inner util.Picker, options ZoneAwarePickerOptions) *ZoneAwarePicker {
+	if options.Label == "" {
+		options.Label = "zone"
+	}
+	if options.MinHealthyPercent <= 0 || options.MinHealthyPercent > 1 {
+		options.MinHealthyPercent = 0.7
+	}
+	if options.MinLocalBalancees <= 0 {
+		options.MinLocalBalancees = 1
+	}
+	if options.OverloadFactor <= 1 {
+		options.OverloadFactor = 2
+	}
+	if options.OverloadUtilization <= 0 || options.OverloadUtilization > 1 {
+		options.OverloadUtilization = 0.8
+	}
+	if options.RandomGenerator == nil {
+		options.RandomGenerator = &util.GoRandom{}
+	}
+	return &ZoneAwarePicker{
+		inner:   inner,
+		options: options,
+	}
+}
+
+//Pick is used when the pool can't tell the picker about unavailable balancees, in which case every local balancee
+//is taken to be available
+func (z *ZoneAwarePicker) Pick(balancees []util.Balancee, req *http.Request) (*url.URL, error) {
+	return z.PickWithMembership(balancees, balancees, req)
+}
+
+func (z *ZoneAwarePicker) PickWithMembership(available []util.Balancee, all []util.Balancee, req *http.Request) (*url.URL, error) {
+	if z.options.LocalZone == "" {
+		return z.inner.Pick(available, req)
+	}
+	var local, remote []util.Balancee
+	for _, balancee := range available {
+		if z.zoneOf(balancee) == z.options.LocalZone {
+			local = append(local, balancee)
+		} else {
+			remote = append(remote, balancee)
+		}
+	}
+	if len(local) == 0 || len(remote) == 0 {
+		return z.pick(available, req)
+	}
+	if len(local) < z.options.MinLocalBalancees {
+		return z.pick(remote, req)
+	}
+	var localShare = z.localShare(local, remote, all)
+	if localShare >= 1 {
+		return z.pick(local, req)
+	}
+	var roll, err = z.options.RandomGenerator.NextInt(0, spillResolution)
+	if err != nil {
+		return nil, err
+	}
+	if float64(roll) < localShare*spillResolution {
+		return z.pick(local, req)
+	}
+	return z.pick(remote, req)
+}
+
+//localShare gives back the share of requests, between 0 and 1, which should stay in the local zone
+func (z *ZoneAwarePicker) localShare(local []util.Balancee, remote []util.Balancee, all []util.Balancee) float64 {
+	var share = 1.0
+	var localMembers []util.Balancee
+	for _, balancee := range all {
+		if z.zoneOf(balancee) == z.options.LocalZone {
+			localMembers = append(localMembers, balancee)
+		}
+	}
+	if len(localMembers) > 0 {
+		var healthyPercent = float64(len(local)) / float64(len(localMembers))
+		if healthyPercent < z.options.MinHealthyPercent {
+			share = healthyPercent / z.options.MinHealthyPercent
+		}
+	}
+	return share * z.loadShare(local, localMembers, remote)
+}
+
+//loadShare gives back the share of requests, between 0 and 1, the local zone can take without being overloaded.
+//Utilization is measured over every local balancee, as those at their limit are missing from the available ones.
+func (z *ZoneAwarePicker) loadShare(local []util.Balancee, localMembers []util.Balancee, remote []util.Balancee) float64 {
+	var used, limits = 0, 0
+	for _, balancee := range localMembers {
+		used += balancee.Outstanding
+		limits += balancee.Limit
+	}
+	if limits > 0 {
+		var utilization = float64(used) / float64(limits)
+		if utilization <= z.options.OverloadUtilization {
+			return 1
+		}
+		return math.Max(0, (1-utilization)/(1-z.options.OverloadUtilization))
+	}
+	var outstanding, remoteOutstanding = 0, 0
+	for _, balancee := range local {
+		outstanding += balancee.Outstanding
+	}
+	for _, balancee := range remote {
+		remoteOutstanding += balancee.Outstanding
+	}
+	var localAverage = float64(outstanding) / float64(len(local))
+	var remoteAverage = float64(remoteOutstanding) / float64(len(remote))
+	//Idle remote balancees are no reason to leave the local zone until it has a real queue of its own
+	var threshold = math.Max(remoteAverage, 1) * z.options.OverloadFactor
+	if localAverage <= threshold {
+		return 1
+	}
+	return threshold / localAverage
+}
+
+func (z *ZoneAwarePicker) zoneOf(balancee util.Balancee) string {
+	return balancee.Labels[z.options.Label]
+}
+
+//pick delegates to the inner picker, unless there is nothing to choose between
+func (z *ZoneAwarePicker) pick(balancees []util.Balancee, req *http.Request) (*url.URL, error) {
+	if len(balancees) == 1 {
+		return balancees[0].URL, nil
+	}
+	return z.inner.Pick(balancees, req)
+}
@@ -0,0 +1,128 @@
+package zone
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/jangie/goloadbalancers/jsq"
+	"github.com/jangie/goloadbalancers/util"
+)
+
+var urlA, _ = url.Parse("http://a")
+var urlB, _ = url.Parse("http://b")
+var urlC, _ = url.Parse("http://c")
+var urlD, _ = url.Parse("http://d")
+
+func newZonedBalancer(options ZoneAwarePickerOptions) *util.Balancer {
+	var picker = NewZoneAwarePicker(jsq.JoinShortestQueuePicker{}, options)
+	var balancer = util.NewBalancer([]url.URL{}, picker, util.BalancerOptions{IsTesting: true}, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	balancer.AddWithLabels(urlA, util.Labels{"zone": "east"})
+	balancer.AddWithLabels(urlB, util.Labels{"zone": "east"})
+	balancer.AddWithLabels(urlC, util.Labels{"zone": "west"})
+	balancer.AddWithLabels(urlD, util.Labels{"zone": "west"})
+	return balancer
+}
+
+func TestZoneAwarePickerImplements(t *testing.T) {
+	var picker util.MembershipPicker
+	picker = NewZoneAwarePicker(jsq.JoinShortestQueuePicker{}, ZoneAwarePickerOptions{})
+	var balancees = []util.Balancee{{URL: urlA}, {URL: urlB}}
+	if chosen, _ := picker.Pick(balancees, nil); chosen != urlA {
+		t.Fatalf("Without a local zone, the inner picker should decide")
+	}
+}
+
+func TestZoneAwarePickerStaysLocal(t *testing.T) {
+	var balancer = newZonedBalancer(ZoneAwarePickerOptions{LocalZone: "west"})
+	var i = 0
+	for ; i < 100; i++ {
+		balancer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if balancer.RequestCount(urlA) != 0 || balancer.RequestCount(urlB) != 0 {
+		t.Fatalf("Requests left a healthy, idle local zone")
+	}
+	if balancer.RequestCount(urlC)+balancer.RequestCount(urlD) != 100 {
+		t.Fatalf("Requests should be balanced within the local zone")
+	}
+}
+
+func TestZoneAwarePickerSpillsOverWhenLocalZoneIsUnhealthy(t *testing.T) {
+	var randomGenerator = &util.TestingRandom{Values: []int{0, 4999, 5000, 9999}}
+	var balancer = newZonedBalancer(ZoneAwarePickerOptions{
+		LocalZone:         "west",
+		MinHealthyPercent: 1,
+		RandomGenerator:   randomGenerator,
+	})
+	balancer.SetHealthy(urlC, false)
+	var i = 0
+	for ; i < 100; i++ {
+		balancer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	if balancer.RequestCount(urlD) != 50 {
+		t.Fatalf("Half of the local zone is unhealthy, so half of the requests should stay local, but %d did", balancer.RequestCount(urlD))
+	}
+	if balancer.RequestCount(urlC) != 0 {
+		t.Fatalf("An unhealthy balancee was sent requests")
+	}
+}
+
+func TestZoneAwarePickerSpillsOverWhenLocalZoneIsDown(t *testing.T) {
+	var balancer = newZonedBalancer(ZoneAwarePickerOptions{LocalZone: "west"})
+	balancer.SetHealthy(urlC, false)
+	balancer.SetHealthy(urlD, false)
+	balancer.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if balancer.RequestCount(urlA)+balancer.RequestCount(urlB) != 1 {
+		t.Fatalf("With the local zone down, requests should go to other zones")
+	}
+}
+
+func TestZoneAwarePickerSpillsOverWhenLocalZoneIsOverloaded(t *testing.T) {
+	var picker = NewZoneAwarePicker(jsq.JoinShortestQueuePicker{}, ZoneAwarePickerOptions{
+		LocalZone:       "west",
+		RandomGenerator: &util.TestingRandom{Values: []int{9999}},
+	})
+	var balancees = []util.Balancee{
+		{URL: urlA, Outstanding: 1, Labels: util.Labels{"zone": "east"}},
+		{URL: urlC, Outstanding: 10, Labels: util.Labels{"zone": "west"}},
+	}
+	if chosen, _ := picker.Pick(balancees, nil); chosen != urlA {
+		t.Fatalf("An overloaded local zone should spill requests over to other zones")
+	}
+}
+
+func TestZoneAwarePickerStaysLocalAgainstIdleRemotes(t *testing.T) {
+	var picker = NewZoneAwarePicker(jsq.JoinShortestQueuePicker{}, ZoneAwarePickerOptions{
+		LocalZone:       "west",
+		RandomGenerator: &util.TestingRandom{Values: []int{9999}},
+	})
+	var balancees = []util.Balancee{
+		{URL: urlA, Labels: util.Labels{"zone": "east"}},
+		{URL: urlB, Labels: util.Labels{"zone": "east"}},
+		{URL: urlC, Outstanding: 1, Labels: util.Labels{"zone": "west"}},
+		{URL: urlD, Outstanding: 1, Labels: util.Labels{"zone": "west"}},
+	}
+	if chosen, _ := picker.Pick(balancees, nil); chosen != urlC {
+		t.Fatalf("One request each in flight locally should not send requests to idle remote zones, got %s", chosen)
+	}
+}
+
+func TestZoneAwarePickerMeasuresUtilizationOverTheWholeZone(t *testing.T) {
+	var picker = NewZoneAwarePicker(jsq.JoinShortestQueuePicker{}, ZoneAwarePickerOptions{
+		LocalZone:       "west",
+		RandomGenerator: &util.TestingRandom{Values: []int{9999}},
+	})
+	var east = util.Balancee{URL: urlA, Limit: 10, Labels: util.Labels{"zone": "east"}}
+	var full = util.Balancee{URL: urlC, Outstanding: 10, Limit: 10, Labels: util.Labels{"zone": "west"}}
+	var busy = util.Balancee{URL: urlD, Outstanding: 8, Limit: 10, Labels: util.Labels{"zone": "west"}}
+	//Only the busy balancee is available, but 90% of the zone's limit is in use, so requests should spill over
+	if chosen, _ := picker.PickWithMembership([]util.Balancee{east, busy}, []util.Balancee{east, full, busy}, nil); chosen != urlA {
+		t.Fatalf("A local balancee at its limit should count towards the zone's utilization, got %s", chosen)
+	}
+	//Beyond every limit, the local share is clamped to nothing rather than going negative
+	full.Outstanding, busy.Outstanding = 15, 15
+	if share := picker.loadShare([]util.Balancee{busy}, []util.Balancee{full, busy}, []util.Balancee{east}); share != 0 {
+		t.Fatalf("Expected no local share above full utilization, got %v", share)
+	}
+}